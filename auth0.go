@@ -1,8 +1,13 @@
 package auth0
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/square/go-jose.v2"
@@ -15,6 +20,23 @@ type SecretProvider interface {
 	GetSecret(token *jwt.JSONWebToken) (interface{}, error)
 }
 
+// RequestSecretProvider is implemented by the secret providers
+// resolving the secret from the request carrying the token, such as
+// a JWKClientSet choosing the JWKS URI of the tenant of the request.
+// The validation of a request prefers GetRequestSecret to GetSecret.
+type RequestSecretProvider interface {
+	SecretProvider
+	GetRequestSecret(r *http.Request, token *jwt.JSONWebToken) (interface{}, error)
+}
+
+// ContextSecretProvider is implemented by the secret providers
+// able to cancel the resolution of the secret, such as a JWKClient
+// downloading the keys, with the context of the validation.
+type ContextSecretProvider interface {
+	SecretProvider
+	GetSecretContext(ctx context.Context, token *jwt.JSONWebToken) (interface{}, error)
+}
+
 // SecretProviderFunc simple wrappers to provide
 // secret with functions.
 type SecretProviderFunc func(token *jwt.JSONWebToken) (interface{}, error)
@@ -31,9 +53,135 @@ func NewKeyProvider(key interface{}) SecretProvider {
 	})
 }
 
+// NewHS256SecretProvider provides the shared secret of the tokens signed
+// with HS256, the tokens signed with any other algorithm being rejected
+// with ErrInvalidAlgorithm even when the provider is trusted for it.
+func NewHS256SecretProvider(secret []byte) SecretProvider {
+	return newHMACSecretProvider(jose.HS256, secret)
+}
+
+// NewHS384SecretProvider provides the shared secret
+// of the tokens signed with HS384, like NewHS256SecretProvider.
+func NewHS384SecretProvider(secret []byte) SecretProvider {
+	return newHMACSecretProvider(jose.HS384, secret)
+}
+
+// NewHS512SecretProvider provides the shared secret
+// of the tokens signed with HS512, like NewHS256SecretProvider.
+func NewHS512SecretProvider(secret []byte) SecretProvider {
+	return newHMACSecretProvider(jose.HS512, secret)
+}
+
+// newHMACSecretProvider provides a copy of the secret, go-jose
+// verifying the HMAC signatures with a []byte key, for the
+// tokens signed with the algorithm only, so that a token signed
+// with a public key algorithm is never verified with the secret.
+func newHMACSecretProvider(alg jose.SignatureAlgorithm, secret []byte) SecretProvider {
+	key := append([]byte(nil), secret...)
+	return SecretProviderFunc(func(token *jwt.JSONWebToken) (interface{}, error) {
+		if len(token.Headers) < 1 {
+			return nil, ErrNoJWTHeaders
+		}
+		if token.Headers[0].Algorithm != string(alg) {
+			return nil, ErrInvalidAlgorithm
+		}
+		return key, nil
+	})
+}
+
+// NewKeySetProvider provides the keys of a static key set,
+// resolved by the kid of the token without any network call.
+func NewKeySetProvider(keys []jose.JSONWebKey) SecretProvider {
+	keySet := make(map[string]jose.JSONWebKey, len(keys))
+	for _, key := range keys {
+		keySet[key.KeyID] = key
+	}
+	return SecretProviderFunc(func(token *jwt.JSONWebToken) (interface{}, error) {
+		if len(token.Headers) < 1 {
+			return nil, ErrNoJWTHeaders
+		}
+		key, ok := keySet[token.Headers[0].KeyID]
+		if !ok {
+			return nil, ErrNoKeyFound
+		}
+		return key, nil
+	})
+}
+
+// NewKeyedSecretProvider provides the key matching the kid of the token
+// among the keys indexed by their ID, e.g. the old and the new key while
+// a signing key is rotated. The tokens without kid are verified with the
+// key indexed by the empty ID or, when there is only one, with the key.
+func NewKeyedSecretProvider(keys map[string]interface{}) SecretProvider {
+	keySet := make(map[string]interface{}, len(keys))
+	for kid, key := range keys {
+		keySet[kid] = key
+	}
+	return SecretProviderFunc(func(token *jwt.JSONWebToken) (interface{}, error) {
+		return keyByID(keySet, token)
+	})
+}
+
+// keyByID returns the key matching the kid of the token, the key indexed
+// by the empty ID or the only key verifying the tokens without kid.
+func keyByID(keySet map[string]interface{}, token *jwt.JSONWebToken) (interface{}, error) {
+	if len(token.Headers) < 1 {
+		return nil, ErrNoJWTHeaders
+	}
+	kid := token.Headers[0].KeyID
+	if key, ok := keySet[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keySet) == 1 {
+		for _, key := range keySet {
+			return key, nil
+		}
+	}
+	return nil, ErrNoKeyFound
+}
+
+// NewIssuerProvider routes the resolution of the key to the provider
+// of the issuer of the token, such as a JWKClient per issuer each with
+// its own cache, to accept the tokens of several federated issuers.
+// The iss claim is read before the signature is verified: the key of
+// the routed provider verifying the signature, a configuration with an
+// empty issuer still only accepts the tokens of the configured issuers.
+func NewIssuerProvider(providers map[string]SecretProvider) SecretProvider {
+	issuers := make(map[string]SecretProvider, len(providers))
+	for issuer, provider := range providers {
+		issuers[issuer] = provider
+	}
+	return SecretProviderFunc(func(token *jwt.JSONWebToken) (interface{}, error) {
+		claims := jwt.Claims{}
+		if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+			return nil, err
+		}
+		provider, ok := issuers[claims.Issuer]
+		if !ok {
+			return nil, ErrUnknownIssuer
+		}
+		return provider.GetSecret(token)
+	})
+}
+
 var (
 	// ErrNoJWTHeaders is returned when there are no headers in the JWT.
 	ErrNoJWTHeaders = errors.New("No headers in the token")
+	// ErrUnexpectedKeyID is returned when the kid of the token
+	// differs from the expected one.
+	ErrUnexpectedKeyID = errors.New("key ID of the token is not the expected one")
+	// ErrUnknownIssuer is returned when no provider
+	// is configured for the issuer of the token.
+	ErrUnknownIssuer = errors.New("no secret provider for the issuer of the token")
+	// ErrUnsupportedCriticalHeader is returned when the header of the
+	// token lists critical parameters, none being processed by the library.
+	ErrUnsupportedCriticalHeader = errors.New("token header has unsupported critical parameters")
+	// ErrInvertedValidityWindow is returned when the nbf claim of the
+	// token is after its exp claim, the token being never valid.
+	ErrInvertedValidityWindow = errors.New("token validity window is inverted: nbf is after exp")
+	// ErrInvalidAuthorizedParty is returned when the azp claim of the
+	// token is not one of the configured authorized parties.
+	ErrInvalidAuthorizedParty = errors.New("token azp claim is not an authorized party")
 )
 
 // Configuration contains
@@ -43,25 +191,240 @@ type Configuration struct {
 	secretProvider SecretProvider
 	expectedClaims jwt.Expected
 	signIn         jose.SignatureAlgorithm
+
+	// LenientTimestamps accepts exp, nbf and iat claims expressed
+	// as numeric strings (e.g. "1700000000"), as emitted by some
+	// non-compliant issuers. Timestamps must be numbers by default.
+	LenientTimestamps bool
+	// LenientIssuer accepts an iss claim expressed as a single
+	// element array rather than a string. Arrays with several
+	// elements are always rejected.
+	LenientIssuer bool
+	// ExpectedKeyID, when set, pins the key which must have signed
+	// the token: tokens with another kid header are rejected before
+	// any other processing.
+	ExpectedKeyID string
+	// FailureHook, when set, is called with the failed step and a
+	// sanitized reason of each failed validation, e.g. for logging.
+	FailureHook FailureHook
+	// Logger, when set, receives the sanitized reason of each failed
+	// validation, a failed download of the keys being logged as a warning.
+	Logger Logger
+	// Tracer, when set, traces the validations of the requests with a
+	// "auth0.ValidateRequest" span, with the outcome, the sanitized
+	// reason of a failure and the issuer of a valid token.
+	Tracer Tracer
+	// Leeway tolerates a clock skew with the issuer when checking the
+	// exp, nbf and iat claims, unless the leeway is passed explicitly.
+	// Defaults to jwt.DefaultLeeway, NoLeeway disabling the tolerance.
+	Leeway time.Duration
+	// Issuers are accepted in addition to the issuer of the constructor,
+	// e.g. to federate the tokens of several tenants. The iss claim of a
+	// token must match one of them when any issuer is configured.
+	Issuers []string
+	// AllowedAlgorithms, when set, rejects the tokens signed with any
+	// other algorithm before their key is resolved, e.g. to prevent a
+	// HS256 token verified with the public key of a RS256 issuer.
+	AllowedAlgorithms []jose.SignatureAlgorithm
+	// CustomClaimsValidator, when set, is called with all the claims of
+	// the tokens whose signature and registered claims are valid, e.g.
+	// to require an org_id claim. An error returned rejects the token
+	// and is returned as is, so ErrInsufficientScope is answered by
+	// the middleware with a 403 status.
+	CustomClaimsValidator func(claims map[string]interface{}) error
+	// AuthorizedParties, when set, requires the azp claim of the tokens to
+	// be one of these client IDs, e.g. to restrict an API shared by several
+	// front-ends to some of them. The tokens without azp claim are rejected
+	// with ErrInvalidAuthorizedParty as any other mismatch.
+	AuthorizedParties []string
+	// DecryptionKey, when set, decrypts the nested tokens, signed then
+	// encrypted as a JWE with a JWT cty header, e.g. to keep confidential
+	// claims out of cleartext. The signed token they hold is validated as
+	// any other. Encrypted tokens are rejected with ErrEncryptedToken
+	// when no decryption key is set.
+	DecryptionKey interface{}
+	// KeyEncryptionAlgorithm, when set, rejects the encrypted tokens
+	// whose key was encrypted with another algorithm.
+	KeyEncryptionAlgorithm jose.KeyAlgorithm
 }
 
-// NewConfiguration creates a configuration for server
-func NewConfiguration(provider SecretProvider, audience []string, issuer string, method jose.SignatureAlgorithm) Configuration {
-	return Configuration{
-		secretProvider: provider,
-		expectedClaims: jwt.Expected{Issuer: issuer, Audience: audience},
-		signIn:         method,
+// Configuring with NoLeeway will check the time claims without tolerance
+var NoLeeway = time.Duration(-1)
+
+// leeway returns the leeway of the validations
+// not passed one explicitly.
+func (c Configuration) leeway() time.Duration {
+	switch {
+	case c.Leeway == 0:
+		return jwt.DefaultLeeway
+	case c.Leeway < 0:
+		return 0
 	}
+	return c.Leeway
 }
 
-// NewConfigurationTrustProvider creates a configuration for server with no enforcement for token sig alg type, instead trust provider
+// NewConfiguration creates a configuration for server.
+// The aud claim of a token must contain any of the audiences.
+// An empty issuer skips the check of the iss claim and an empty
+// audience skips the check of the aud claim, empty strings within
+// the audience being ignored.
+func NewConfiguration(provider SecretProvider, audience []string, issuer string, method jose.SignatureAlgorithm) Configuration {
+	return NewConfigurationWithOptions(provider, WithAudience(audience...), WithIssuer(issuer), WithAlgorithm(method))
+}
+
+// NewConfigurationTrustProvider creates a configuration for server with no enforcement for token sig alg type, instead trust provider.
+// The issuer and audience are checked as for NewConfiguration.
 func NewConfigurationTrustProvider(provider SecretProvider, audience []string, issuer string) Configuration {
-	return Configuration{
-		secretProvider: provider,
-		expectedClaims: jwt.Expected{Issuer: issuer, Audience: audience},
+	return NewConfigurationWithOptions(provider, WithAudience(audience...), WithIssuer(issuer))
+}
+
+// ConfigOption configures the optional
+// checks of the configuration.
+type ConfigOption func(*Configuration)
+
+// NewConfigurationWithOptions creates a configuration for server with
+// the options. Without WithAudience, WithIssuer and WithAlgorithm, the
+// aud and iss claims are not checked and the provider is trusted for
+// the algorithm, as with NewConfigurationTrustProvider.
+func NewConfigurationWithOptions(provider SecretProvider, opts ...ConfigOption) Configuration {
+	c := Configuration{secretProvider: provider}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithAudience requires the aud claim of the tokens to contain any of
+// the audiences, the empty strings being ignored.
+func WithAudience(audience ...string) ConfigOption {
+	return func(c *Configuration) {
+		c.expectedClaims.Audience = nonEmpty(audience)
 	}
 }
 
+// WithIssuer requires the iss claim of the tokens to be the issuer,
+// an empty issuer skipping the check.
+func WithIssuer(issuer string) ConfigOption {
+	return func(c *Configuration) {
+		c.expectedClaims.Issuer = issuer
+	}
+}
+
+// WithIssuers accepts the issuers in addition to the one of
+// WithIssuer, as Configuration.Issuers.
+func WithIssuers(issuers ...string) ConfigOption {
+	return func(c *Configuration) {
+		c.Issuers = append(c.Issuers, issuers...)
+	}
+}
+
+// WithAlgorithm requires the tokens to be signed with the algorithm,
+// an empty algorithm trusting the provider.
+func WithAlgorithm(method jose.SignatureAlgorithm) ConfigOption {
+	return func(c *Configuration) {
+		c.signIn = method
+	}
+}
+
+// WithLeeway sets the leeway tolerating a clock skew with the
+// issuer, as Configuration.Leeway.
+func WithLeeway(leeway time.Duration) ConfigOption {
+	return func(c *Configuration) {
+		c.Leeway = leeway
+	}
+}
+
+// WithCustomClaims checks the claims of the tokens
+// with the validator, as Configuration.CustomClaimsValidator.
+func WithCustomClaims(validator func(claims map[string]interface{}) error) ConfigOption {
+	return func(c *Configuration) {
+		c.CustomClaimsValidator = validator
+	}
+}
+
+// WithAuthorizedParties requires the azp claim of the tokens to be
+// one of the client IDs, as Configuration.AuthorizedParties.
+func WithAuthorizedParties(clientIDs ...string) ConfigOption {
+	return func(c *Configuration) {
+		c.AuthorizedParties = nonEmpty(clientIDs)
+	}
+}
+
+// nonEmpty returns the values which are not empty, so that
+// an empty audience consistently means no check.
+func nonEmpty(values []string) []string {
+	var kept []string
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// allowsAlgorithm reports whether the alg header is allowed.
+// The none algorithm is never allowed, whatever the configuration.
+func (c Configuration) allowsAlgorithm(alg string) bool {
+	if strings.EqualFold(alg, "none") {
+		return false
+	}
+	if len(c.AllowedAlgorithms) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedAlgorithms {
+		if alg == string(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsIssuer reports whether the iss claim matches any of the
+// configured issuers, empty ones being ignored. No configured issuer
+// skips the check.
+func (c Configuration) acceptsIssuer(issuer string) bool {
+	configured := c.expectedClaims.Issuer != ""
+	if configured && issuer == c.expectedClaims.Issuer {
+		return true
+	}
+	for _, accepted := range c.Issuers {
+		if accepted == "" {
+			continue
+		}
+		if issuer == accepted {
+			return true
+		}
+		configured = true
+	}
+	return !configured
+}
+
+// acceptsAudience reports whether the aud claim contains any of the
+// accepted audiences, e.g. the former and the new identifier of an API
+// during a migration. No accepted audience skips the check.
+func acceptsAudience(accepted []string, audience jwt.Audience) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+	for _, aud := range accepted {
+		if audience.Contains(aud) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsAuthorizedParty reports whether the azp claim
+// is one of the authorized parties.
+func acceptsAuthorizedParty(authorized []string, azp string) bool {
+	for _, party := range authorized {
+		if azp != "" && azp == party {
+			return true
+		}
+	}
+	return false
+}
+
 // JWTValidator helps middleware
 // to validate token
 type JWTValidator struct {
@@ -80,72 +443,457 @@ func NewValidator(config Configuration, extractor RequestTokenExtractor) *JWTVal
 
 // ValidateRequest validates the token within
 // the http request.
-// A default leeway value of one minute is used to compare time values.
+// The leeway of the configuration, one minute by default,
+// is used to compare time values.
 func (v *JWTValidator) ValidateRequest(r *http.Request) (*jwt.JSONWebToken, error) {
-	return v.validateRequestWithLeeway(r, jwt.DefaultLeeway)
+	return v.validateRequestWithLeeway(r, v.extractor, v.config.leeway(), nil)
 }
 
 // ValidateRequestWithLeeway validates the token within
 // the http request.
 // The provided leeway value is used to compare time values.
 func (v *JWTValidator) ValidateRequestWithLeeway(r *http.Request, leeway time.Duration) (*jwt.JSONWebToken, error) {
-	return v.validateRequestWithLeeway(r, leeway)
+	return v.validateRequestWithLeeway(r, v.extractor, leeway, nil)
+}
+
+// validateRequestWithLeeway validates the token extracted from
+// the http request with the provided extractor.
+// The result, when not nil, is filled on success.
+func (v *JWTValidator) validateRequestWithLeeway(r *http.Request, extractor RequestTokenExtractor, leeway time.Duration, result *validationResult) (*jwt.JSONWebToken, error) {
+	if v.config.Tracer == nil {
+		return v.validateRequestInContext(r.Context(), r, extractor, leeway, result)
+	}
+
+	ctx, span := v.config.Tracer.Start(r.Context(), "auth0.ValidateRequest")
+	defer span.End()
+
+	if result == nil {
+		result = &validationResult{}
+	}
+	token, err := v.validateRequestInContext(ctx, r, extractor, leeway, result)
+	if err != nil {
+		span.SetAttribute("auth0.outcome", "invalid")
+		if reason, ok := sanitizedReason(err); ok {
+			span.SetAttribute("auth0.reason", reason)
+		}
+		return nil, err
+	}
+
+	span.SetAttribute("auth0.outcome", "valid")
+	span.SetAttribute("auth0.issuer", result.issuer)
+	return token, nil
+}
+
+// validationResult holds what the validation of a token decoded,
+// for the callers needing it without decoding the token again.
+type validationResult struct {
+	issuer string
+	// claims, when not nil, receives all the claims of the
+	// token, decoded along with the registered claims.
+	claims map[string]interface{}
+}
+
+// validateExtracted validates the token already extracted from the
+// http request like ValidateRequest, e.g. by a ValidatorRegistry.
+func (v *JWTValidator) validateExtracted(r *http.Request, token *jwt.JSONWebToken) (*jwt.JSONWebToken, error) {
+	extractor := RequestTokenExtractorFunc(func(*http.Request) (*jwt.JSONWebToken, error) {
+		return token, nil
+	})
+	return v.validateRequestWithLeeway(r, extractor, v.config.leeway(), nil)
+}
+
+// validateRequestInContext validates the token extracted from the http
+// request, its secret being resolved within the context.
+func (v *JWTValidator) validateRequestInContext(ctx context.Context, r *http.Request, extractor RequestTokenExtractor, leeway time.Duration, result *validationResult) (*jwt.JSONWebToken, error) {
+	token, err := extractor.Extract(r)
+	var encrypted *encryptedToken
+	if errors.As(err, &encrypted) {
+		if token, err = v.config.decrypt(encrypted.raw); err != nil {
+			v.config.reportFailure(StepDecryption, err)
+			return nil, err
+		}
+	}
+	if err != nil {
+		step := extractionStep(err)
+		v.config.reportFailure(step, err)
+		return nil, classifyError(step, err)
+	}
+
+	if err := v.validateTokenWithLeeway(ctx, r, token, leeway, result); err != nil {
+		return nil, err
+	}
+
+	return token, nil
 }
 
-func (v *JWTValidator) validateRequestWithLeeway(r *http.Request, leeway time.Duration) (*jwt.JSONWebToken, error) {
+// ValidateRequestWithRefresh validates the token within the http request
+// like ValidateRequest. When the validation fails because the signing key
+// was not found, the keys of the secret provider are refreshed, provided
+// it implements KeyIDRefresher or KeyRefresher, and the validation is
+// attempted once more. This makes the validation resilient to the rotation
+// of the keys. A KeyIDRefresher does not download the keys again for a kid
+// remembered as missing or within the MinRefetchInterval of a JWKClient.
+func (v *JWTValidator) ValidateRequestWithRefresh(r *http.Request) (*jwt.JSONWebToken, error) {
+	token, err := v.ValidateRequest(r)
+	if !errors.Is(err, ErrNoKeyFound) {
+		return token, err
+	}
+
+	switch refresher := v.config.secretProvider.(type) {
+	case KeyIDRefresher:
+		refreshErr := refresher.RefreshKeyID(r.Context(), v.requestKeyID(r))
+		if errors.Is(refreshErr, ErrNoKeyFound) {
+			return token, err
+		}
+		if refreshErr != nil {
+			return nil, refreshErr
+		}
+	case KeyRefresher:
+		if err := refresher.Refresh(r.Context()); err != nil {
+			return nil, err
+		}
+	default:
+		return token, err
+	}
+	return v.ValidateRequest(r)
+}
+
+// requestKeyID returns the kid of the token within the http request,
+// decrypted when nested, or an empty kid when it cannot be read.
+func (v *JWTValidator) requestKeyID(r *http.Request) string {
 	token, err := v.extractor.Extract(r)
+	var encrypted *encryptedToken
+	if errors.As(err, &encrypted) {
+		token, err = v.config.decrypt(encrypted.raw)
+	}
+	if err != nil || len(token.Headers) == 0 {
+		return ""
+	}
+	return token.Headers[0].KeyID
+}
+
+// ValidatedToken holds the protected header fields and
+// the claims of a validated token, e.g. for audit logging.
+type ValidatedToken struct {
+	Algorithm string
+	KeyID     string
+	Type      string
+	Claims    map[string]interface{}
+}
+
+// ValidateRequestDetailed validates the token within the http request
+// like ValidateRequest and returns its header fields and claims together.
+func (v *JWTValidator) ValidateRequestDetailed(r *http.Request) (*ValidatedToken, error) {
+	token, err := v.ValidateRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := v.RequestClaims(r, token, &claims); err != nil {
+		return nil, err
+	}
+
+	header := token.Headers[0]
+	typ, _ := header.ExtraHeaders[jose.HeaderType].(string)
+	return &ValidatedToken{
+		Algorithm: header.Algorithm,
+		KeyID:     header.KeyID,
+		Type:      typ,
+		Claims:    claims,
+	}, nil
+}
+
+// ValidateRequestChain validates the chain of tokens sent
+// in the authentication header of the http request, such as
+// an actor token followed by a subject token.
+// Each token is validated independently, the encrypted ones
+// being decrypted as by ValidateRequest, and the tokens are
+// returned in the order they were sent.
+func (v *JWTValidator) ValidateRequestChain(r *http.Request) ([]*jwt.JSONWebToken, error) {
+	parts, err := rawHeaderChain(r)
+	if err != nil {
+		step := extractionStep(err)
+		v.config.reportFailure(step, err)
+		return nil, classifyError(step, err)
+	}
+
+	tokens := make([]*jwt.JSONWebToken, 0, len(parts))
+	for _, part := range parts {
+		token, err := v.parseRawToken(part)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	for _, token := range tokens {
+		if err := v.validateTokenWithLeeway(r.Context(), r, token, v.config.leeway(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// ValidateRawToken parses and validates the compact serialized token,
+// e.g. received in a message outside of any http request, the secret
+// being resolved within the context.
+func (v *JWTValidator) ValidateRawToken(ctx context.Context, raw string) (*jwt.JSONWebToken, error) {
+	if raw == "" {
+		v.config.reportFailure(StepExtraction, ErrTokenNotFound)
+		return nil, ErrTokenNotFound
+	}
+	token, err := v.parseRawToken(raw)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := v.validateTokenWithLeeway(token, leeway); err != nil {
+	if err := v.validateTokenWithLeeway(ctx, nil, token, v.config.leeway(), nil); err != nil {
 		return nil, err
 	}
+	return token, nil
+}
 
+// parseRawToken parses the compact serialized token,
+// decrypting it when encrypted, and reports the failures.
+func (v *JWTValidator) parseRawToken(raw string) (*jwt.JSONWebToken, error) {
+	token, err := parseToken(raw)
+	var encrypted *encryptedToken
+	if errors.As(err, &encrypted) {
+		if token, err = v.config.decrypt(encrypted.raw); err != nil {
+			v.config.reportFailure(StepDecryption, err)
+			return nil, err
+		}
+	}
+	if err != nil {
+		v.config.reportFailure(StepParse, err)
+		return nil, classifyError(StepParse, err)
+	}
 	return token, nil
 }
 
 func (v *JWTValidator) ValidateToken(token *jwt.JSONWebToken) error {
-	return v.validateTokenWithLeeway(token, jwt.DefaultLeeway)
+	return v.validateTokenWithLeeway(context.Background(), nil, token, v.config.leeway(), nil)
 }
 
 func (v *JWTValidator) ValidateTokenWithLeeway(token *jwt.JSONWebToken, leeway time.Duration) error {
-	return v.validateTokenWithLeeway(token, leeway)
+	return v.validateTokenWithLeeway(context.Background(), nil, token, leeway, nil)
+}
+
+// validateTokenWithLeeway validates the token, the request
+// carrying it being nil when validated on its own.
+// The result, when not nil, is filled on success.
+func (v *JWTValidator) validateTokenWithLeeway(ctx context.Context, r *http.Request, token *jwt.JSONWebToken, leeway time.Duration, result *validationResult) error {
+	step, err := v.validateTokenSteps(ctx, r, token, leeway, result)
+	if err != nil {
+		v.config.reportFailure(step, err)
+		return classifyError(step, err)
+	}
+	return nil
 }
 
-func (v *JWTValidator) validateTokenWithLeeway(token *jwt.JSONWebToken, leeway time.Duration) error {
+// validateTokenSteps validates the token and
+// returns the failed step along with the error.
+func (v *JWTValidator) validateTokenSteps(ctx context.Context, r *http.Request, token *jwt.JSONWebToken, leeway time.Duration, result *validationResult) (ValidationStep, error) {
 	if len(token.Headers) < 1 {
-		return ErrNoJWTHeaders
+		return StepHeader, ErrNoJWTHeaders
+	}
+
+	// go-jose fails the verification of any token with a crit header,
+	// so no critical parameter can be whitelisted: such tokens are
+	// rejected upfront with a clear error.
+	if _, ok := token.Headers[0].ExtraHeaders["crit"]; ok {
+		return StepHeader, ErrUnsupportedCriticalHeader
+	}
+
+	if v.config.ExpectedKeyID != "" && token.Headers[0].KeyID != v.config.ExpectedKeyID {
+		return StepHeader, ErrUnexpectedKeyID
 	}
 
 	// trust secret provider when sig alg not configured and skip check
 	if v.config.signIn != "" {
 		header := token.Headers[0]
 		if header.Algorithm != string(v.config.signIn) {
-			return ErrInvalidAlgorithm
+			return StepHeader, ErrInvalidAlgorithm
 		}
 	}
 
-	claims := jwt.Claims{}
-	key, err := v.config.secretProvider.GetSecret(token)
+	if !v.config.allowsAlgorithm(token.Headers[0].Algorithm) {
+		return StepHeader, ErrInvalidAlgorithm
+	}
+
+	key, err := v.secret(ctx, r, token)
 	if err != nil {
-		return err
+		return StepKeyResolution, err
 	}
 
-	if err = token.Claims(key, &claims); err != nil {
-		return err
+	claims := claimsPool.Get().(*jwt.Claims)
+	defer func() {
+		*claims = jwt.Claims{}
+		claimsPool.Put(claims)
+	}()
+	var all []interface{}
+	if result != nil && result.claims != nil {
+		all = []interface{}{&result.claims}
+	}
+	if err = v.config.registeredClaims(token, key, claims, all...); err != nil {
+		if errors.Is(err, jose.ErrCryptoFailure) {
+			return StepSignature, err
+		}
+		return StepClaims, err
+	}
+
+	if claims.NotBefore != 0 && claims.Expiry != 0 && claims.NotBefore > claims.Expiry {
+		return StepClaims, ErrInvertedValidityWindow
 	}
 
+	// go-jose accepts a single issuer and requires all the expected
+	// audiences: they are checked here instead, in the same order
+	// relative to the other claims.
+	if !v.config.acceptsIssuer(claims.Issuer) {
+		return StepClaims, jwt.ErrInvalidIssuer
+	}
 	expected := v.config.expectedClaims.WithTime(time.Now())
+	audience := expected.Audience
+	expected.Issuer = ""
+	expected.Audience = nil
 	err = claims.ValidateWithLeeway(expected, leeway)
-	return err
+	if err != jwt.ErrInvalidIssuer && err != jwt.ErrInvalidSubject && !acceptsAudience(audience, claims.Audience) {
+		err = jwt.ErrInvalidAudience
+	}
+	if err != nil {
+		return StepClaims, err
+	}
+
+	if len(v.config.AuthorizedParties) > 0 {
+		var azp struct {
+			AuthorizedParty string `json:"azp"`
+		}
+		if err := token.Claims(key, &azp); err != nil {
+			return StepClaims, err
+		}
+		if !acceptsAuthorizedParty(v.config.AuthorizedParties, azp.AuthorizedParty) {
+			return StepClaims, ErrInvalidAuthorizedParty
+		}
+	}
+
+	if v.config.CustomClaimsValidator != nil {
+		custom := map[string]interface{}{}
+		if err := token.Claims(key, &custom); err != nil {
+			return StepClaims, err
+		}
+		if err := v.config.CustomClaimsValidator(custom); err != nil {
+			return StepClaims, err
+		}
+	}
+
+	if result != nil {
+		result.issuer = claims.Issuer
+	}
+	return "", nil
+}
+
+// claimsPool recycles the registered claims decoded by each
+// validation, the claims not outliving the validation.
+var claimsPool = sync.Pool{
+	New: func() interface{} {
+		return new(jwt.Claims)
+	},
+}
+
+// secret resolves the secret of the token, from the request carrying
+// it or within the context when the secret provider supports it.
+func (v *JWTValidator) secret(ctx context.Context, r *http.Request, token *jwt.JSONWebToken) (interface{}, error) {
+	if provider, ok := v.config.secretProvider.(RequestSecretProvider); ok && r != nil {
+		return provider.GetRequestSecret(r, token)
+	}
+	if provider, ok := v.config.secretProvider.(ContextSecretProvider); ok {
+		return provider.GetSecretContext(ctx, token)
+	}
+	return v.config.secretProvider.GetSecret(token)
 }
 
 // Claims unmarshall the claims of the provided token
 func (v *JWTValidator) Claims(token *jwt.JSONWebToken, values ...interface{}) error {
-	key, err := v.config.secretProvider.GetSecret(token)
+	return v.RequestClaims(nil, token, values...)
+}
+
+// RequestClaims unmarshall the claims of the token carried by the
+// request, resolving its secret from the request like its validation.
+func (v *JWTValidator) RequestClaims(r *http.Request, token *jwt.JSONWebToken, values ...interface{}) error {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	key, err := v.secret(ctx, r, token)
 	if err != nil {
 		return err
 	}
 	return token.Claims(key, values...)
-}
\ No newline at end of file
+}
+
+// NamespacedClaims unmarshalls the custom claims of the provided token
+// named under the namespace, such as the "https://myapp.example.com/"
+// namespace of Auth0 rules, and returns them with the namespace stripped.
+// The namespace should include its trailing separator.
+func (v *JWTValidator) NamespacedClaims(token *jwt.JSONWebToken, namespace string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+	if err := v.Claims(token, &claims); err != nil {
+		return nil, err
+	}
+
+	namespaced := map[string]interface{}{}
+	for name, value := range claims {
+		if strings.HasPrefix(name, namespace) && len(name) > len(namespace) {
+			namespaced[strings.TrimPrefix(name, namespace)] = value
+		}
+	}
+	return namespaced, nil
+}
+
+// timestampClaims are the registered claims holding a NumericDate.
+var timestampClaims = []string{"exp", "nbf", "iat"}
+
+// registeredClaims decodes the registered claims of the token,
+// applying the leniency rules of the configuration. The values,
+// if any, are decoded as is within the same verification.
+func (c Configuration) registeredClaims(token *jwt.JSONWebToken, key interface{}, claims *jwt.Claims, values ...interface{}) error {
+	if !c.LenientTimestamps && !c.LenientIssuer {
+		return token.Claims(key, append([]interface{}{claims}, values...)...)
+	}
+
+	raw := map[string]interface{}{}
+	if err := token.Claims(key, append([]interface{}{&raw}, values...)...); err != nil {
+		return err
+	}
+
+	if c.LenientTimestamps {
+		for _, name := range timestampClaims {
+			value, ok := raw[name].(string)
+			if !ok {
+				continue
+			}
+			timestamp, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return jwt.ErrUnmarshalNumericDate
+			}
+			raw[name] = timestamp
+		}
+	}
+
+	if c.LenientIssuer {
+		if issuers, ok := raw["iss"].([]interface{}); ok {
+			if len(issuers) != 1 {
+				return jwt.ErrInvalidIssuer
+			}
+			raw["iss"] = issuers[0]
+		}
+	}
+
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, claims)
+}
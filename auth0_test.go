@@ -1,13 +1,20 @@
 package auth0
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -539,3 +546,972 @@ func TestValidateRequestAndClaimsWithLeeway(t *testing.T) {
 		})
 	}
 }
+
+func getTestTokenWithClaims(claims interface{}, alg jose.SignatureAlgorithm, key interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(err)
+	}
+
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestValidateRequestLenientTimestamps(t *testing.T) {
+	now := time.Now()
+	stringTimestamps := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"iat": strconv.FormatInt(now.Unix(), 10),
+		"nbf": strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+		"exp": strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+	}, jose.HS256, defaultSecret)
+	expiredStringTimestamps := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"exp": strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+	}, jose.HS256, defaultSecret)
+	invalidStringTimestamps := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"exp": "tomorrow",
+	}, jose.HS256, defaultSecret)
+
+	tests := []struct {
+		name             string
+		lenient          bool
+		token            string
+		expectedErrorMsg string
+	}{
+		{
+			name:             "fail - string timestamps when strict",
+			lenient:          false,
+			token:            stringTimestamps,
+			expectedErrorMsg: "expected number value to unmarshal NumericDate",
+		},
+		{
+			name:    "pass - string timestamps when lenient",
+			lenient: true,
+			token:   stringTimestamps,
+		},
+		{
+			name:    "pass - numeric timestamps when lenient",
+			lenient: true,
+			token:   getTestToken(defaultAudience, defaultIssuer, now.Add(time.Hour), jose.HS256, defaultSecret),
+		},
+		{
+			name:             "fail - expired string timestamps when lenient",
+			lenient:          true,
+			token:            expiredStringTimestamps,
+			expectedErrorMsg: "token is expired (exp)",
+		},
+		{
+			name:             "fail - non numeric string timestamps when lenient",
+			lenient:          true,
+			token:            invalidStringTimestamps,
+			expectedErrorMsg: "expected number value to unmarshal NumericDate",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+			configuration.LenientTimestamps = test.lenient
+			validator, req := genTestConfiguration(configuration, test.token)
+
+			_, err := validator.ValidateRequest(req)
+			if test.expectedErrorMsg != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), test.expectedErrorMsg)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateRequestChain(t *testing.T) {
+	actorToken := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"sub": "actor",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, jose.HS256, defaultSecret)
+	subjectToken := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"sub": "subject",
+		"act": map[string]interface{}{"sub": "actor"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, jose.HS256, defaultSecret)
+	invalidSubjectToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, []byte("invalid secret"))
+
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+
+	for _, separator := range []string{" ", ","} {
+		validator, req := genTestConfiguration(configuration, actorToken+separator+subjectToken)
+
+		tokens, err := validator.ValidateRequestChain(req)
+		if !assert.NoError(t, err) || !assert.Len(t, tokens, 2) {
+			continue
+		}
+
+		actor, subject := map[string]interface{}{}, map[string]interface{}{}
+		assert.NoError(t, validator.Claims(tokens[0], &actor))
+		assert.NoError(t, validator.Claims(tokens[1], &subject))
+		assert.Equal(t, actor["sub"], subject["act"].(map[string]interface{})["sub"])
+	}
+
+	validator, req := genTestConfiguration(configuration, actorToken+" "+invalidSubjectToken)
+	_, err := validator.ValidateRequestChain(req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error in cryptographic primitive")
+}
+
+func TestValidateRequestLenientIssuer(t *testing.T) {
+	tokenWithIssuer := func(iss interface{}) string {
+		return getTestTokenWithClaims(map[string]interface{}{
+			"iss": iss,
+			"aud": defaultAudience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}, jose.HS256, defaultSecret)
+	}
+
+	tests := []struct {
+		name             string
+		lenient          bool
+		token            string
+		expectedErrorMsg string
+	}{
+		{
+			name:  "pass - string iss when strict",
+			token: tokenWithIssuer(defaultIssuer),
+		},
+		{
+			name:             "fail - single element array iss when strict",
+			token:            tokenWithIssuer([]string{defaultIssuer}),
+			expectedErrorMsg: "cannot unmarshal array",
+		},
+		{
+			name:    "pass - string iss when lenient",
+			lenient: true,
+			token:   tokenWithIssuer(defaultIssuer),
+		},
+		{
+			name:    "pass - single element array iss when lenient",
+			lenient: true,
+			token:   tokenWithIssuer([]string{defaultIssuer}),
+		},
+		{
+			name:             "fail - single element array with another iss when lenient",
+			lenient:          true,
+			token:            tokenWithIssuer([]string{"invalid iss"}),
+			expectedErrorMsg: "invalid issuer claim (iss)",
+		},
+		{
+			name:             "fail - multi element array iss when lenient",
+			lenient:          true,
+			token:            tokenWithIssuer([]string{defaultIssuer, "another iss"}),
+			expectedErrorMsg: "invalid issuer claim (iss)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+			configuration.LenientIssuer = test.lenient
+			validator, req := genTestConfiguration(configuration, test.token)
+
+			_, err := validator.ValidateRequest(req)
+			if test.expectedErrorMsg != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), test.expectedErrorMsg)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenExpectedKeyID(t *testing.T) {
+	pinnedKey := genRSASSAJWK(jose.RS256, "pinned")
+	configuration := NewConfiguration(NewKeyProvider(pinnedKey.Public()), defaultAudience, defaultIssuer, jose.RS256)
+	configuration.ExpectedKeyID = "pinned"
+	validator := NewValidator(configuration, nil)
+
+	token := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, pinnedKey, "pinned")
+	assert.NoError(t, validator.ValidateToken(token))
+
+	token = getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, pinnedKey, "another")
+	assert.Equal(t, ErrUnexpectedKeyID, validator.ValidateToken(token))
+}
+
+func TestHMACSecretProviders(t *testing.T) {
+	rsaKey := genRSASSAJWK(jose.RS256, "")
+
+	tests := []struct {
+		name          string
+		provider      SecretProvider
+		alg           jose.SignatureAlgorithm
+		key           interface{}
+		expectedError error
+	}{
+		{name: "HS256 round trip", provider: NewHS256SecretProvider(defaultSecret), alg: jose.HS256, key: defaultSecret},
+		{name: "HS384 round trip", provider: NewHS384SecretProvider(defaultSecret), alg: jose.HS384, key: defaultSecret},
+		{name: "HS512 round trip", provider: NewHS512SecretProvider(defaultSecret), alg: jose.HS512, key: defaultSecret},
+		{
+			name:          "other HMAC algorithm",
+			provider:      NewHS256SecretProvider(defaultSecret),
+			alg:           jose.HS512,
+			key:           defaultSecret,
+			expectedError: ErrInvalidAlgorithm,
+		},
+		{
+			name:          "RS256 token",
+			provider:      NewHS256SecretProvider(defaultSecret),
+			alg:           jose.RS256,
+			key:           rsaKey,
+			expectedError: ErrInvalidAlgorithm,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The provider is trusted for the algorithm, which it checks itself.
+			configuration := NewConfigurationTrustProvider(test.provider, defaultAudience, defaultIssuer)
+			validator, req := genTestConfiguration(configuration, getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), test.alg, test.key))
+			_, err := validator.ValidateRequest(req)
+			assert.Equal(t, test.expectedError, err)
+		})
+	}
+}
+
+func TestKeySetProvider(t *testing.T) {
+	keyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+	keyES384 := genECDSAJWK(jose.ES384, "keyES384")
+	provider := NewKeySetProvider([]jose.JSONWebKey{keyRS256.Public(), keyES384.Public()})
+	validator := NewValidator(NewConfigurationTrustProvider(provider, defaultAudience, defaultIssuer), nil)
+
+	tokenRS256 := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, keyRS256, "keyRS256")
+	tokenES384 := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.ES384, keyES384, "keyES384")
+	assert.NoError(t, validator.ValidateToken(tokenRS256))
+	assert.NoError(t, validator.ValidateToken(tokenES384))
+
+	unknownToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, keyRS256, "unknown")
+	assert.Equal(t, ErrNoKeyFound, validator.ValidateToken(unknownToken))
+}
+
+func TestKeyedSecretProvider(t *testing.T) {
+	oldSecret := []byte("old secret for the rotation tests")
+	newSecret := []byte("new secret for the rotation tests")
+	noKid := func(key []byte) *jwt.JSONWebToken {
+		token, err := jwt.ParseSigned(getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, key))
+		if err != nil {
+			panic(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name          string
+		keys          map[string]interface{}
+		token         *jwt.JSONWebToken
+		expectedError error
+	}{
+		{
+			name:  "key selected by kid",
+			keys:  map[string]interface{}{"old": oldSecret, "new": newSecret},
+			token: getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, newSecret, "new"),
+		},
+		{
+			name:  "previous key during the rotation",
+			keys:  map[string]interface{}{"old": oldSecret, "new": newSecret},
+			token: getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, oldSecret, "old"),
+		},
+		{
+			name:          "unknown kid",
+			keys:          map[string]interface{}{"old": oldSecret, "new": newSecret},
+			token:         getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, newSecret, "unknown"),
+			expectedError: ErrNoKeyFound,
+		},
+		{
+			name:  "no kid with a default key",
+			keys:  map[string]interface{}{"": oldSecret, "new": newSecret},
+			token: noKid(oldSecret),
+		},
+		{
+			name:  "no kid with a single key",
+			keys:  map[string]interface{}{"new": newSecret},
+			token: noKid(newSecret),
+		},
+		{
+			name:          "no kid with several keys",
+			keys:          map[string]interface{}{"old": oldSecret, "new": newSecret},
+			token:         noKid(newSecret),
+			expectedError: ErrNoKeyFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := NewKeyedSecretProvider(test.keys)
+			validator := NewValidator(NewConfiguration(provider, defaultAudience, defaultIssuer, jose.HS256), nil)
+			assert.Equal(t, test.expectedError, validator.ValidateToken(test.token))
+		})
+	}
+}
+
+func TestValidateRequestWithRefresh(t *testing.T) {
+	oldKey := genRSASSAJWK(jose.RS256, "old")
+	newKey := genRSASSAJWK(jose.RS256, "new")
+
+	var counter uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The new key is only published from the second download on,
+		// as a lagging JWKS endpoint would during a rotation.
+		jwks := JWKS{Keys: []jose.JSONWebKey{oldKey.Public()}}
+		if atomic.AddUint64(&counter, 1) > 1 {
+			jwks.Keys = append(jwks.Keys, newKey.Public())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	configuration := NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256)
+
+	claims := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	// Signing with a JSON Web Key sets its kid in the header.
+	raw := getTestTokenWithClaims(claims, jose.RS256, newKey)
+
+	validator, req := genTestConfiguration(configuration, raw)
+	_, err := validator.ValidateRequestWithRefresh(req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+
+	// A token failing validation for another reason is not retried.
+	forgedKey := oldKey
+	forgedKey.KeyID = "new"
+	raw = getTestTokenWithClaims(claims, jose.RS256, forgedKey)
+	validator, req = genTestConfiguration(configuration, raw)
+	_, err = validator.ValidateRequestWithRefresh(req)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+
+	// Without a refreshable secret provider, the error is returned as is.
+	provider := NewKeySetProvider([]jose.JSONWebKey{oldKey.Public()})
+	validator, req = genTestConfiguration(NewConfiguration(provider, defaultAudience, defaultIssuer, jose.RS256), raw)
+	_, err = validator.ValidateRequestWithRefresh(req)
+	assert.Equal(t, ErrNoKeyFound, err)
+}
+
+func TestValidateRequestWithRefreshUnknownKeyIDs(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+
+	var counter uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&counter, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		options JWKClientOptions
+		keyID   func(i int) string
+	}{
+		{
+			name:    "unknown key TTL",
+			options: JWKClientOptions{UnknownKeyTTL: time.Hour},
+			keyID:   func(int) string { return "forged" },
+		},
+		{
+			name:    "min refetch interval",
+			options: JWKClientOptions{MinRefetchInterval: time.Hour},
+			keyID:   func(i int) string { return fmt.Sprintf("forged-%d", i) },
+		},
+		{
+			name:    "unknown key TTL and min refetch interval",
+			options: JWKClientOptions{UnknownKeyTTL: time.Hour, MinRefetchInterval: time.Hour},
+			keyID:   func(i int) string { return fmt.Sprintf("forged-%d", i) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreUint64(&counter, 0)
+			test.options.URI = ts.URL
+			test.options.AllowInsecureJWKS = true
+			client := NewJWKClient(test.options, nil)
+			configuration := NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256)
+
+			claims := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+			for i := 0; i < 8; i++ {
+				raw := getTestTokenWithClaims(claims, jose.RS256, genRSASSAJWK(jose.RS256, test.keyID(i)))
+				validator, req := genTestConfiguration(configuration, raw)
+				_, err := validator.ValidateRequestWithRefresh(req)
+				assert.Equal(t, ErrNoKeyFound, err)
+			}
+			assert.Equal(t, uint64(1), atomic.LoadUint64(&counter), "forged kids should not force a download each")
+		})
+	}
+}
+
+func TestValidateTokenEmptyIssuerAndAudience(t *testing.T) {
+	claims := func(iss string, aud []string) string {
+		return getTestTokenWithClaims(jwt.Claims{
+			Issuer:   iss,
+			Audience: aud,
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}, jose.HS256, defaultSecret)
+	}
+
+	tests := []struct {
+		name          string
+		audience      []string
+		issuer        string
+		token         string
+		expectedError error
+	}{
+		{
+			name:     "empty issuer skips the iss check",
+			audience: defaultAudience,
+			token:    claims("another-issuer", defaultAudience),
+		},
+		{
+			name:     "empty issuer accepts a token without iss",
+			audience: defaultAudience,
+			token:    claims("", defaultAudience),
+		},
+		{
+			name:   "nil audience skips the aud check",
+			issuer: defaultIssuer,
+			token:  claims(defaultIssuer, []string{"another-audience"}),
+		},
+		{
+			name:     "empty audience skips the aud check",
+			audience: []string{},
+			issuer:   defaultIssuer,
+			token:    claims(defaultIssuer, nil),
+		},
+		{
+			name:     "empty string audience skips the aud check",
+			audience: []string{""},
+			issuer:   defaultIssuer,
+			token:    claims(defaultIssuer, []string{"another-audience"}),
+		},
+		{
+			name:          "set issuer is checked",
+			audience:      defaultAudience,
+			issuer:        defaultIssuer,
+			token:         claims("", defaultAudience),
+			expectedError: jwt.ErrInvalidIssuer,
+		},
+		{
+			name:          "set audience is checked",
+			audience:      []string{"", "audience"},
+			issuer:        defaultIssuer,
+			token:         claims(defaultIssuer, nil),
+			expectedError: jwt.ErrInvalidAudience,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, configuration := range []Configuration{
+				NewConfiguration(defaultSecretProvider, test.audience, test.issuer, jose.HS256),
+				NewConfigurationTrustProvider(defaultSecretProvider, test.audience, test.issuer),
+			} {
+				validator, req := genTestConfiguration(configuration, test.token)
+				_, err := validator.ValidateRequest(req)
+				assert.Equal(t, test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestValidateRequestDetailed(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "keyRS256")
+	provider := NewKeySetProvider([]jose.JSONWebKey{key.Public()})
+	configuration := NewConfiguration(provider, defaultAudience, defaultIssuer, jose.RS256)
+
+	raw := getTestTokenWithClaims(map[string]interface{}{
+		"iss": defaultIssuer,
+		"aud": defaultAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"sub": "user|42",
+	}, jose.RS256, key)
+
+	validator, req := genTestConfiguration(configuration, raw)
+	validated, err := validator.ValidateRequestDetailed(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "RS256", validated.Algorithm)
+	assert.Equal(t, "keyRS256", validated.KeyID)
+	assert.Equal(t, "JWT", validated.Type)
+	assert.Equal(t, "user|42", validated.Claims["sub"])
+
+	expired := getTestTokenWithClaims(jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(-time.Hour))}, jose.RS256, key)
+	validator, req = genTestConfiguration(configuration, expired)
+	validated, err = validator.ValidateRequestDetailed(req)
+	assert.True(t, errors.Is(err, ErrTokenExpired), "got %v", err)
+	assert.Nil(t, validated)
+}
+
+func TestValidateTokenCriticalHeader(t *testing.T) {
+	validator := NewValidator(NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256), nil)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: defaultSecret}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"crit": []string{"exp"}, "exp": 1700000000},
+	})
+	assert.NoError(t, err)
+	raw, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   defaultIssuer,
+		Audience: defaultAudience,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).CompactSerialize()
+	assert.NoError(t, err)
+
+	token, err := jwt.ParseSigned(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrUnsupportedCriticalHeader, validator.ValidateToken(token))
+}
+
+func TestValidateTokenInvertedValidityWindow(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		notBefore     time.Time
+		expiry        time.Time
+		expectedError error
+	}{
+		{
+			name:          "nbf after exp",
+			notBefore:     now.Add(2 * time.Hour),
+			expiry:        now.Add(time.Hour),
+			expectedError: ErrInvertedValidityWindow,
+		},
+		{
+			name:          "nbf after exp, both in the past",
+			notBefore:     now.Add(-time.Hour),
+			expiry:        now.Add(-2 * time.Hour),
+			expectedError: ErrInvertedValidityWindow,
+		},
+		{
+			name:      "nbf equal to exp",
+			notBefore: now,
+			expiry:    now,
+		},
+		{
+			name:      "nbf before exp",
+			notBefore: now.Add(-time.Hour),
+			expiry:    now.Add(time.Hour),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := getTestTokenWithClaims(jwt.Claims{
+				Issuer:    defaultIssuer,
+				Audience:  defaultAudience,
+				NotBefore: jwt.NewNumericDate(test.notBefore),
+				Expiry:    jwt.NewNumericDate(test.expiry),
+			}, jose.HS256, defaultSecret)
+
+			validator, req := genTestConfiguration(configuration, raw)
+			_, err := validator.ValidateRequest(req)
+			assert.Equal(t, test.expectedError, err)
+		})
+	}
+}
+
+func TestIssuerProvider(t *testing.T) {
+	genIssuerServer := func(key jose.JSONWebKey) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+		}))
+	}
+
+	// Both issuers use the same kid, each resolved by its own client.
+	keyA := genRSASSAJWK(jose.RS256, "key")
+	keyB := genRSASSAJWK(jose.RS256, "key")
+	tsA := genIssuerServer(keyA)
+	defer tsA.Close()
+	tsB := genIssuerServer(keyB)
+	defer tsB.Close()
+
+	provider := NewIssuerProvider(map[string]SecretProvider{
+		"https://a.example.com/": NewJWKClient(JWKClientOptions{URI: tsA.URL, AllowInsecureJWKS: true}, nil),
+		"https://b.example.com/": NewJWKClient(JWKClientOptions{URI: tsB.URL, AllowInsecureJWKS: true}, nil),
+	})
+	validator := NewValidator(NewConfiguration(provider, defaultAudience, "", jose.RS256), nil)
+
+	tests := []struct {
+		name          string
+		issuer        string
+		key           jose.JSONWebKey
+		expectedError error
+	}{
+		{name: "first issuer", issuer: "https://a.example.com/", key: keyA},
+		{name: "second issuer", issuer: "https://b.example.com/", key: keyB},
+		{name: "unknown issuer", issuer: "https://c.example.com/", key: keyA, expectedError: ErrUnknownIssuer},
+		{name: "issuer signing with the key of another", issuer: "https://b.example.com/", key: keyA, expectedError: jose.ErrCryptoFailure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := getTestTokenWithClaims(jwt.Claims{
+				Issuer:   test.issuer,
+				Audience: defaultAudience,
+				Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			}, jose.RS256, test.key)
+
+			token, err := jwt.ParseSigned(raw)
+			assert.NoError(t, err)
+			assertErrorIs(t, test.expectedError, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestNamespacedClaims(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	raw := getTestTokenWithClaims(map[string]interface{}{
+		"iss":                                 defaultIssuer,
+		"aud":                                 defaultAudience,
+		"exp":                                 time.Now().Add(time.Hour).Unix(),
+		"https://myapp.example.com/roles":     []string{"admin", "editor"},
+		"https://myapp.example.com/tenant":    "acme",
+		"https://myapp.example.com/":          "no name",
+		"https://otherapp.example.com/roles":  []string{"viewer"},
+		"https://myapp.example.com.evil/role": "admin",
+	}, jose.HS256, defaultSecret)
+
+	validator, req := genTestConfiguration(configuration, raw)
+	token, err := validator.ValidateRequest(req)
+	assert.NoError(t, err)
+
+	claims, err := validator.NamespacedClaims(token, "https://myapp.example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"roles":  []interface{}{"admin", "editor"},
+		"tenant": "acme",
+	}, claims)
+}
+
+func TestConfigurationLeeway(t *testing.T) {
+	tests := []struct {
+		name        string
+		leeway      time.Duration
+		expiredFor  time.Duration
+		expectedErr error
+	}{
+		{name: "default leeway within", expiredFor: 50 * time.Second},
+		{name: "default leeway beyond", expiredFor: 70 * time.Second, expectedErr: jwt.ErrExpired},
+		{name: "custom leeway within", leeway: 5 * time.Minute, expiredFor: 4 * time.Minute},
+		{name: "custom leeway beyond", leeway: 5 * time.Minute, expiredFor: 6 * time.Minute, expectedErr: jwt.ErrExpired},
+		{name: "no leeway", leeway: NoLeeway, expiredFor: 5 * time.Second, expectedErr: jwt.ErrExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+			configuration.Leeway = test.leeway
+			validator := NewValidator(configuration, nil)
+
+			raw := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-test.expiredFor), jose.HS256, defaultSecret)
+			token, err := jwt.ParseSigned(raw)
+			assert.NoError(t, err)
+			assertErrorIs(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestNewConfigurationWithOptions(t *testing.T) {
+	errDenied := errors.New("denied")
+	deny := func(claims map[string]interface{}) error { return errDenied }
+
+	tests := []struct {
+		name        string
+		opts        []ConfigOption
+		issuer      string
+		expiredFor  time.Duration
+		expectedErr error
+	}{
+		{name: "no option", issuer: "https://other.example.com/"},
+		{name: "issuer", opts: []ConfigOption{WithIssuer(defaultIssuer)}, issuer: "https://other.example.com/", expectedErr: jwt.ErrInvalidIssuer},
+		{name: "issuers", opts: []ConfigOption{WithIssuer(defaultIssuer), WithIssuers("https://other.example.com/")}, issuer: "https://other.example.com/"},
+		{name: "algorithm", opts: []ConfigOption{WithAlgorithm(jose.HS512)}, expectedErr: ErrInvalidAlgorithm},
+		{name: "leeway", opts: []ConfigOption{WithLeeway(5 * time.Minute)}, expiredFor: 4 * time.Minute},
+		{name: "no leeway", opts: []ConfigOption{WithLeeway(NoLeeway)}, expiredFor: 5 * time.Second, expectedErr: jwt.ErrExpired},
+		{name: "custom claims", opts: []ConfigOption{WithCustomClaims(deny)}, expectedErr: errDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := test.issuer
+			if issuer == "" {
+				issuer = defaultIssuer
+			}
+			expiry := time.Now().Add(time.Hour)
+			if test.expiredFor > 0 {
+				expiry = time.Now().Add(-test.expiredFor)
+			}
+
+			configuration := NewConfigurationWithOptions(defaultSecretProvider, append([]ConfigOption{WithAudience(defaultAudience...)}, test.opts...)...)
+			validator, req := genTestConfiguration(configuration, getTestToken(defaultAudience, issuer, expiry, jose.HS256, defaultSecret))
+			_, err := validator.ValidateRequest(req)
+			assertErrorIs(t, test.expectedErr, err)
+		})
+	}
+}
+
+func TestAnyAcceptedAudience(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, []string{"legacy", "new"}, defaultIssuer, jose.HS256)
+	validator := NewValidator(configuration, nil)
+
+	tests := []struct {
+		name        string
+		audience    []string
+		issuer      string
+		expiry      time.Time
+		expectedErr error
+	}{
+		{name: "new audience", audience: []string{"new"}},
+		{name: "legacy audience among others", audience: []string{"other", "legacy"}},
+		{name: "both audiences", audience: []string{"legacy", "new"}},
+		{name: "no accepted audience", audience: []string{"other"}, expectedErr: jwt.ErrInvalidAudience},
+		{name: "no audience", expectedErr: jwt.ErrInvalidAudience},
+		{name: "issuer checked first", audience: []string{"other"}, issuer: "https://other.example.com/", expectedErr: jwt.ErrInvalidIssuer},
+		{name: "audience checked before expiry", audience: []string{"other"}, expiry: time.Now().Add(-time.Hour), expectedErr: jwt.ErrInvalidAudience},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := test.issuer
+			if issuer == "" {
+				issuer = defaultIssuer
+			}
+			expiry := test.expiry
+			if expiry.IsZero() {
+				expiry = time.Now().Add(time.Hour)
+			}
+			token, err := jwt.ParseSigned(getTestToken(test.audience, issuer, expiry, jose.HS256, defaultSecret))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestAcceptedIssuers(t *testing.T) {
+	issuerA, issuerB := "https://tenant-a.example.com/", "https://tenant-b.example.com/"
+
+	tests := []struct {
+		name        string
+		issuer      string
+		issuers     []string
+		tokenIssuer string
+		expectedErr error
+	}{
+		{name: "issuer B among the issuers", issuers: []string{issuerA, issuerB}, tokenIssuer: issuerB},
+		{name: "constructor issuer with the issuers", issuer: issuerA, issuers: []string{issuerB}, tokenIssuer: issuerA},
+		{name: "issuer among the issuers", issuer: issuerA, issuers: []string{issuerB}, tokenIssuer: issuerB},
+		{name: "unknown issuer", issuers: []string{issuerA, issuerB}, tokenIssuer: "https://other.example.com/", expectedErr: jwt.ErrInvalidIssuer},
+		{name: "empty issuers skip the check", issuers: []string{""}, tokenIssuer: "https://other.example.com/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, test.issuer, jose.HS256)
+			configuration.Issuers = test.issuers
+			validator := NewValidator(configuration, nil)
+
+			token, err := jwt.ParseSigned(getTestToken(defaultAudience, test.tokenIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestAllowedAlgorithms(t *testing.T) {
+	rsaKey := genRSASSAJWK(jose.RS256, "")
+	rsaPublicKey := rsaKey.Public()
+	claims := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(claims)
+	noneToken := noneHeader + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+
+	tests := []struct {
+		name        string
+		allowed     []jose.SignatureAlgorithm
+		provider    SecretProvider
+		token       string
+		expectedErr error
+	}{
+		{
+			name:     "allowed algorithm",
+			allowed:  []jose.SignatureAlgorithm{jose.RS256, jose.ES256},
+			provider: NewKeyProvider(rsaPublicKey),
+			token:    getTestTokenWithClaims(claims, jose.RS256, rsaKey),
+		},
+		{
+			name:        "symmetric algorithm swapped in",
+			allowed:     []jose.SignatureAlgorithm{jose.RS256},
+			provider:    NewKeyProvider(defaultSecret),
+			token:       getTestTokenWithClaims(claims, jose.HS256, defaultSecret),
+			expectedErr: ErrInvalidAlgorithm,
+		},
+		{
+			name:        "none algorithm",
+			provider:    NewKeyProvider(defaultSecret),
+			token:       noneToken,
+			expectedErr: ErrInvalidAlgorithm,
+		},
+		{
+			name:     "no allowlist",
+			provider: NewKeyProvider(defaultSecret),
+			token:    getTestTokenWithClaims(claims, jose.HS256, defaultSecret),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfigurationTrustProvider(test.provider, defaultAudience, defaultIssuer)
+			configuration.AllowedAlgorithms = test.allowed
+			validator := NewValidator(configuration, nil)
+
+			token, err := jwt.ParseSigned(test.token)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestValidateRawToken(t *testing.T) {
+	validator := NewValidator(NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256), nil)
+
+	raw := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	token, err := validator.ValidateRawToken(context.Background(), raw)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HS256", token.Headers[0].Algorithm)
+	}
+
+	_, err = validator.ValidateRawToken(context.Background(), "")
+	assert.Equal(t, ErrTokenNotFound, err)
+	_, err = validator.ValidateRawToken(context.Background(), "not a token")
+	assert.Error(t, err)
+
+	expired := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	_, err = validator.ValidateRawToken(context.Background(), expired)
+	assert.True(t, errors.Is(err, ErrTokenExpired), "got %v", err)
+}
+
+func TestValidateRawTokenContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	key := genRSASSAJWK(jose.RS256, "key")
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	validator := NewValidator(NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	raw := getTestTokenWithClaims(jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience}, jose.RS256, key)
+	_, err := validator.ValidateRawToken(ctx, raw)
+	assert.Equal(t, context.Canceled, err, "the download of the keys should be cancelled")
+}
+
+func TestCustomClaimsValidator(t *testing.T) {
+	errUnverifiedEmail := errors.New("email not verified")
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	configuration.CustomClaimsValidator = func(claims map[string]interface{}) error {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return errUnverifiedEmail
+		}
+		if claims["org_id"] != "org_1" {
+			return ErrInsufficientScope
+		}
+		return nil
+	}
+	validator := NewValidator(configuration, nil)
+
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		expectedErr error
+	}{
+		{name: "valid custom claims", claims: map[string]interface{}{"email_verified": true, "org_id": "org_1"}},
+		{name: "unverified email", claims: map[string]interface{}{"email_verified": false, "org_id": "org_1"}, expectedErr: errUnverifiedEmail},
+		{name: "other organization", claims: map[string]interface{}{"email_verified": true, "org_id": "org_2"}, expectedErr: ErrInsufficientScope},
+		{name: "registered claims checked first", claims: map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, expectedErr: jwt.ErrExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := map[string]interface{}{
+				"iss": defaultIssuer,
+				"aud": defaultAudience,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			for name, value := range test.claims {
+				claims[name] = value
+			}
+			token, err := jwt.ParseSigned(getTestTokenWithClaims(claims, jose.HS256, defaultSecret))
+			assert.NoError(t, err)
+			assertErrorIs(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
+
+func TestAuthorizedParties(t *testing.T) {
+	tests := []struct {
+		name        string
+		parties     []string
+		claims      map[string]interface{}
+		expectedErr error
+	}{
+		{name: "unset", claims: map[string]interface{}{"azp": "other-client"}},
+		{name: "authorized party", parties: []string{"web-client", "mobile-client"}, claims: map[string]interface{}{"azp": "mobile-client"}},
+		{name: "other party", parties: []string{"web-client"}, claims: map[string]interface{}{"azp": "other-client"}, expectedErr: ErrInvalidAuthorizedParty},
+		{name: "missing azp", parties: []string{"web-client"}, expectedErr: ErrInvalidAuthorizedParty},
+		{name: "empty parties ignored", parties: []string{"", "web-client"}, claims: map[string]interface{}{"azp": ""}, expectedErr: ErrInvalidAuthorizedParty},
+		{name: "registered claims checked first", parties: []string{"web-client"}, claims: map[string]interface{}{"azp": "other-client", "exp": time.Now().Add(-time.Hour).Unix()}, expectedErr: jwt.ErrExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfigurationWithOptions(defaultSecretProvider,
+				WithAudience(defaultAudience...), WithIssuer(defaultIssuer), WithAlgorithm(jose.HS256),
+				WithAuthorizedParties(test.parties...))
+			validator := NewValidator(configuration, nil)
+
+			claims := map[string]interface{}{
+				"iss": defaultIssuer,
+				"aud": defaultAudience,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			for name, value := range test.claims {
+				claims[name] = value
+			}
+			token, err := jwt.ParseSigned(getTestTokenWithClaims(claims, jose.HS256, defaultSecret))
+			assert.NoError(t, err)
+			assertErrorIs(t, test.expectedErr, validator.ValidateToken(token))
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package auth0
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// genBenchmarkRequest returns the options of a JWKS server and a
+// request holding a RS256 token signed by its key, for the common
+// single issuer configuration.
+func genBenchmarkRequest(tb testing.TB) (JWKClientOptions, *http.Request, func()) {
+	key := genRSASSAJWK(jose.RS256, "keyRS256")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+
+	raw := getTestTokenWithClaims(jwt.Claims{
+		Issuer:   defaultIssuer,
+		Audience: defaultAudience,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, jose.RS256, key)
+
+	req, _ := http.NewRequest("", "http://localhost", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", raw))
+	return JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, req, ts.Close
+}
+
+// validateRequestCacheHitAllocs is the allocation budget of the hot path,
+// 107 allocs/op when measured, most of them being made by go-jose
+// parsing and verifying the token.
+const validateRequestCacheHitAllocs = 110
+
+// TestValidateRequestCacheHitAllocs fails when the hot path
+// allocates more than its budget, e.g. for an unused feature.
+func TestValidateRequestCacheHitAllocs(t *testing.T) {
+	opts, req, closeServer := genBenchmarkRequest(t)
+	defer closeServer()
+	client := NewJWKClient(opts, nil)
+	validator := NewValidator(NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256), nil)
+	if _, err := validator.ValidateRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := validator.ValidateRequest(req); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > validateRequestCacheHitAllocs {
+		t.Errorf("ValidateRequest made %v allocations on a cache hit, more than the budget of %d", allocs, validateRequestCacheHitAllocs)
+	}
+}
+
+// BenchmarkValidateRequestCacheHit covers the hot path,
+// its allocations being bounded by TestValidateRequestCacheHitAllocs.
+func BenchmarkValidateRequestCacheHit(b *testing.B) {
+	opts, req, closeServer := genBenchmarkRequest(b)
+	defer closeServer()
+	client := NewJWKClient(opts, nil)
+	validator := NewValidator(NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256), nil)
+	if _, err := validator.ValidateRequest(req); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := validator.ValidateRequest(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidateRequestCacheMiss(b *testing.B) {
+	opts, req, closeServer := genBenchmarkRequest(b)
+	defer closeServer()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := NewJWKClient(opts, nil)
+		validator := NewValidator(NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256), nil)
+		if _, err := validator.ValidateRequest(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	jose "gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -147,5 +150,16 @@ func genNewTestServer(genJWKS bool) (JWKClientOptions, *jwt.JSONWebToken, *jwt.J
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintln(w, string(value))
 	}))
-	return JWKClientOptions{URI: ts.URL}, tokenRS256, tokenES384, err
+	return JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, tokenRS256, tokenES384, err
+}
+
+// assertErrorIs asserts that err matches expected with errors.Is,
+// or that there is no error when expected is nil.
+func assertErrorIs(t *testing.T, expected error, err error) {
+	t.Helper()
+	if expected == nil {
+		assert.NoError(t, err)
+		return
+	}
+	assert.True(t, errors.Is(err, expected), "expected %v, got %v", expected, err)
 }
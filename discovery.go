@@ -0,0 +1,198 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultDiscoveryMaxAge is the default time a discovery
+	// document is cached before being fetched again.
+	DefaultDiscoveryMaxAge = 24 * time.Hour
+	// DefaultDiscoveryStaleGrace is the default time a discovery document
+	// keeps being served past its max age when fetching it again fails.
+	DefaultDiscoveryStaleGrace = time.Hour
+)
+
+var (
+	// ErrInvalidDiscoveryDocument is returned when the discovery
+	// document lacks the issuer or the JWKS URI.
+	ErrInvalidDiscoveryDocument = errors.New("discovery document should contain an issuer and a jwks_uri")
+	// ErrDiscoveryIssuerMismatch is returned when the issuer of the discovery
+	// document is not the one of its .well-known/openid-configuration URL.
+	ErrDiscoveryIssuerMismatch = errors.New("discovery document issuer does not match its URL")
+)
+
+const wellKnownDiscoveryPath = "/.well-known/openid-configuration"
+
+// DiscoveryDocument holds the OpenID provider metadata
+// retrieved from a .well-known/openid-configuration URL.
+type DiscoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// DiscoveryClientOptions configures a DiscoveryClient.
+type DiscoveryClientOptions struct {
+	URI string
+	// Client fetches the document, a client timing out
+	// after DefaultJWKSTimeout being used when nil.
+	Client *http.Client
+	// MaxAge is the time the document is cached before being fetched
+	// again, so that changes of the provider metadata propagate.
+	// Defaults to DefaultDiscoveryMaxAge.
+	MaxAge time.Duration
+	// StaleGrace is the time the last good document keeps being served
+	// past its max age while fetching it again fails.
+	// Defaults to DefaultDiscoveryStaleGrace.
+	StaleGrace time.Duration
+}
+
+// DiscoveryClient fetches and caches an OpenID Connect discovery document.
+type DiscoveryClient struct {
+	options DiscoveryClientOptions
+	// fetches shares the fetch of the document between the concurrent
+	// callers, mu only guarding the cached document.
+	fetches   singleflight.Group
+	mu        sync.Mutex
+	document  *DiscoveryDocument
+	fetchedAt time.Time
+	now       func() time.Time
+}
+
+// NewDiscoveryClient creates a new DiscoveryClient instance
+// from the provided options.
+func NewDiscoveryClient(options DiscoveryClientOptions) *DiscoveryClient {
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: DefaultJWKSTimeout}
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = DefaultDiscoveryMaxAge
+	}
+	if options.StaleGrace <= 0 {
+		options.StaleGrace = DefaultDiscoveryStaleGrace
+	}
+
+	return &DiscoveryClient{
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// Document returns the discovery document, fetching it when not cached
+// or older than the max age. When fetching it again fails, the last good
+// document is returned until the stale grace is over.
+// The concurrent callers share a single fetch, made within the context of
+// the first of them, each caller giving up waiting when its context is done.
+func (d *DiscoveryClient) Document(ctx context.Context) (DiscoveryDocument, error) {
+	d.mu.Lock()
+	cached, fetchedAt := d.document, d.fetchedAt
+	d.mu.Unlock()
+
+	age := d.now().Sub(fetchedAt)
+	if cached != nil && age < d.options.MaxAge {
+		return *cached, nil
+	}
+
+	results := d.fetches.DoChan(d.options.URI, func() (interface{}, error) {
+		document, err := d.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.document = &document
+		d.fetchedAt = d.now()
+		return document, nil
+	})
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case result := <-results:
+		if result.Err == nil {
+			return result.Val.(DiscoveryDocument), nil
+		}
+		err = result.Err
+	}
+	if cached != nil && age < d.options.MaxAge+d.options.StaleGrace {
+		return *cached, nil
+	}
+	return DiscoveryDocument{}, err
+}
+
+func (d *DiscoveryClient) fetch(ctx context.Context) (DiscoveryDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.options.URI, nil)
+	if err != nil {
+		return DiscoveryDocument{}, err
+	}
+	resp, err := d.options.Client.Do(req)
+	if err != nil {
+		return DiscoveryDocument{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return DiscoveryDocument{}, fmt.Errorf("discovery document request failed with status %d", resp.StatusCode)
+	}
+
+	var document DiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return DiscoveryDocument{}, err
+	}
+	if document.Issuer == "" || document.JWKSURI == "" {
+		return DiscoveryDocument{}, ErrInvalidDiscoveryDocument
+	}
+
+	return document, nil
+}
+
+// NewFromDiscovery fetches the discovery document of the URL and creates
+// a JWKClient downloading the keys from its jwks_uri along with a
+// Configuration expecting its issuer, the options adding e.g. the audience.
+// The document is fetched again past DefaultDiscoveryMaxAge, so that
+// a change of its jwks_uri is followed by the next downloads.
+// As required by OpenID Connect Discovery, the issuer of a document served
+// at a .well-known/openid-configuration URL must be the one of the URL.
+func NewFromDiscovery(ctx context.Context, discoveryURL string, opts ...ConfigOption) (*JWKClient, Configuration, error) {
+	return NewFromDiscoveryClient(ctx, NewDiscoveryClient(DiscoveryClientOptions{URI: discoveryURL}), opts...)
+}
+
+// NewFromDiscoveryClient is NewFromDiscovery for a DiscoveryClient, which
+// caches the document with its own max age. The JWKClient resolves the
+// jwks_uri through the DiscoveryClient on each download, and shares its
+// HTTP client.
+func NewFromDiscoveryClient(ctx context.Context, discovery *DiscoveryClient, opts ...ConfigOption) (*JWKClient, Configuration, error) {
+	document, err := discovery.Document(ctx)
+	if err != nil {
+		return nil, Configuration{}, err
+	}
+	if !issuerMatchesDiscoveryURL(document.Issuer, discovery.options.URI) {
+		return nil, Configuration{}, ErrDiscoveryIssuerMismatch
+	}
+
+	client := NewJWKClient(NewJWKClientOptions(document.JWKSURI, WithHTTPClient(discovery.options.Client)), nil)
+	client.discovery = discovery
+	config := NewConfigurationWithOptions(client, append([]ConfigOption{WithIssuer(document.Issuer)}, opts...)...)
+	return client, config, nil
+}
+
+// issuerMatchesDiscoveryURL reports whether the issuer is the one of a
+// .well-known/openid-configuration URL, the trailing slashes being ignored.
+// The issuer of a document served at another URL is not checked.
+func issuerMatchesDiscoveryURL(issuer, discoveryURL string) bool {
+	if !strings.HasSuffix(discoveryURL, wellKnownDiscoveryPath) {
+		return true
+	}
+	return strings.TrimSuffix(issuer, "/") == strings.TrimSuffix(discoveryURL, wellKnownDiscoveryPath)
+}
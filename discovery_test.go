@@ -0,0 +1,285 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func genDiscoveryTestServer(counter *uint64, failing *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint64(counter, 1)
+		if atomic.LoadInt32(failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DiscoveryDocument{
+			Issuer:  defaultIssuer,
+			JWKSURI: fmt.Sprintf("https://example.com/jwks/%d", n),
+		})
+	}))
+}
+
+func TestDiscoveryClientMaxAge(t *testing.T) {
+	var counter uint64
+	var failing int32
+	ts := genDiscoveryTestServer(&counter, &failing)
+	defer ts.Close()
+
+	now := time.Now()
+	client := NewDiscoveryClient(DiscoveryClientOptions{URI: ts.URL, MaxAge: time.Hour})
+	client.now = func() time.Time { return now }
+
+	document, err := client.Document(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, defaultIssuer, document.Issuer)
+	firstJWKSURI := document.JWKSURI
+
+	now = now.Add(59 * time.Minute)
+	document, err = client.Document(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, firstJWKSURI, document.JWKSURI)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&counter))
+
+	now = now.Add(2 * time.Minute)
+	document, err = client.Document(context.Background())
+	assert.NoError(t, err)
+	assert.NotEqual(t, firstJWKSURI, document.JWKSURI)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+}
+
+func TestDiscoveryClientStaleGrace(t *testing.T) {
+	var counter uint64
+	var failing int32
+	ts := genDiscoveryTestServer(&counter, &failing)
+	defer ts.Close()
+
+	now := time.Now()
+	client := NewDiscoveryClient(DiscoveryClientOptions{URI: ts.URL, MaxAge: time.Hour, StaleGrace: 10 * time.Minute})
+	client.now = func() time.Time { return now }
+
+	good, err := client.Document(context.Background())
+	assert.NoError(t, err)
+
+	atomic.StoreInt32(&failing, 1)
+	now = now.Add(65 * time.Minute)
+	document, err := client.Document(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, good, document)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+
+	now = now.Add(10 * time.Minute)
+	_, err = client.Document(context.Background())
+	assert.Error(t, err)
+}
+
+func TestDiscoveryClientSharedFetch(t *testing.T) {
+	var requests uint64
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		started <- struct{}{}
+		<-release
+		json.NewEncoder(w).Encode(DiscoveryDocument{Issuer: defaultIssuer, JWKSURI: "https://example.com/jwks"})
+	}))
+	defer ts.Close()
+
+	client := NewDiscoveryClient(DiscoveryClientOptions{URI: ts.URL})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			document, err := client.Document(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, defaultIssuer, document.Issuer)
+		}()
+	}
+	<-started
+
+	// A caller does not wait for the fetch in flight past its own context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Document(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second, "the caller should not wait for the fetch")
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&requests), "the fetch should be shared")
+}
+
+func TestDiscoveryClientInvalidDocument(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"issuer": "issuer"}`))
+	}))
+	defer ts.Close()
+
+	client := NewDiscoveryClient(DiscoveryClientOptions{URI: ts.URL})
+	_, err := client.Document(context.Background())
+	assert.Equal(t, ErrInvalidDiscoveryDocument, err)
+}
+
+func TestDiscoveryClientDefaultTimeout(t *testing.T) {
+	discovery := NewDiscoveryClient(DiscoveryClientOptions{URI: "https://example.com/.well-known/openid-configuration"})
+	assert.Equal(t, DefaultJWKSTimeout, discovery.options.Client.Timeout)
+}
+
+func TestNewFromDiscovery(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+	var issuer string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(DiscoveryDocument{Issuer: issuer, JWKSURI: "https://" + r.Host + "/jwks.json"})
+		case "/jwks.json":
+			json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+		}
+	}))
+	defer ts.Close()
+	discoveryURL := ts.URL + "/.well-known/openid-configuration"
+
+	t.Run("consistent issuer", func(t *testing.T) {
+		issuer = ts.URL + "/"
+		discovery := NewDiscoveryClient(DiscoveryClientOptions{URI: discoveryURL, Client: ts.Client()})
+		client, config, err := NewFromDiscoveryClient(context.Background(), discovery, WithAudience(defaultAudience...))
+		assert.NoError(t, err)
+		assert.Equal(t, ts.URL+"/jwks.json", client.options.URI)
+		assert.Equal(t, discovery.options.Client, client.options.Client)
+
+		validator := NewValidator(config, nil)
+		token := getTestTokenWithKid(defaultAudience, issuer, time.Now().Add(time.Hour), jose.RS256, key, "key")
+		assert.NoError(t, validator.ValidateToken(token))
+
+		token = getTestTokenWithKid(defaultAudience, "https://other.example.com/", time.Now().Add(time.Hour), jose.RS256, key, "key")
+		assert.Error(t, validator.ValidateToken(token))
+	})
+
+	t.Run("changed jwks_uri", func(t *testing.T) {
+		rotatedKey := genRSASSAJWK(jose.RS256, "rotated")
+		jwksPath := "/jwks.json"
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				json.NewEncoder(w).Encode(DiscoveryDocument{Issuer: "https://" + r.Host, JWKSURI: "https://" + r.Host + jwksPath})
+			case "/jwks.json":
+				json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+			case "/rotated.json":
+				json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{rotatedKey.Public()}})
+			}
+		}))
+		defer ts.Close()
+
+		now := time.Now()
+		discovery := NewDiscoveryClient(DiscoveryClientOptions{URI: ts.URL + "/.well-known/openid-configuration", Client: ts.Client()})
+		discovery.now = func() time.Time { return now }
+		client, _, err := NewFromDiscoveryClient(context.Background(), discovery)
+		assert.NoError(t, err)
+		_, err = client.GetKey("key")
+		assert.NoError(t, err)
+
+		// The next download follows the jwks_uri of the document fetched again.
+		jwksPath = "/rotated.json"
+		now = now.Add(DefaultDiscoveryMaxAge)
+		_, err = client.GetKey("rotated")
+		assert.NoError(t, err)
+	})
+
+	t.Run("mismatching issuer", func(t *testing.T) {
+		issuer = "https://other.example.com/"
+		discovery := NewDiscoveryClient(DiscoveryClientOptions{URI: discoveryURL, Client: ts.Client()})
+		_, _, err := NewFromDiscoveryClient(context.Background(), discovery)
+		assert.Equal(t, ErrDiscoveryIssuerMismatch, err)
+	})
+
+	t.Run("failed fetch", func(t *testing.T) {
+		_, _, err := NewFromDiscovery(context.Background(), discoveryURL)
+		assert.Error(t, err)
+	})
+}
+
+// TestCognitoUserPool validates the tokens of an AWS Cognito user pool, whose
+// issuer has no trailing slash and whose JWKS always holds two keys. The
+// access tokens have no aud claim but a client_id and a token_use claim.
+func TestCognitoUserPool(t *testing.T) {
+	keys := []jose.JSONWebKey{
+		genRSASSAJWK(jose.RS256, "1a2b3c4d5e6f7g8h9i0jKLMNOPQRSTUVWXYZabcdef="),
+		genRSASSAJWK(jose.RS256, "zyxwvUTSRQPONMLKJIhgfedcba9876543210ABCDEF="),
+	}
+	var jwksDownloads uint64
+	var issuer string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/us-east-1_Example/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(DiscoveryDocument{Issuer: issuer, JWKSURI: issuer + "/.well-known/jwks.json"})
+		case "/us-east-1_Example/.well-known/jwks.json":
+			atomic.AddUint64(&jwksDownloads, 1)
+			json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{keys[0].Public(), keys[1].Public()}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	issuer = ts.URL + "/us-east-1_Example"
+
+	discovery := NewDiscoveryClient(DiscoveryClientOptions{URI: issuer + "/.well-known/openid-configuration", Client: ts.Client()})
+	_, configuration, err := NewFromDiscoveryClient(context.Background(), discovery,
+		WithAlgorithm(jose.RS256),
+		WithCustomClaims(func(claims map[string]interface{}) error {
+			if claims["token_use"] != "access" || claims["client_id"] != "app-client-id" {
+				return ErrInsufficientScope
+			}
+			return nil
+		}))
+	assert.NoError(t, err)
+	validator := NewValidator(configuration, nil)
+
+	signCognitoToken := func(key jose.JSONWebKey, tokenUse string) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": key.KeyID}}).WithType("JWT"))
+		assert.NoError(t, err)
+		raw, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:  issuer,
+			Subject: "user",
+			Expiry:  jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}).Claims(map[string]interface{}{
+			"token_use": tokenUse,
+			"client_id": "app-client-id",
+		}).CompactSerialize()
+		assert.NoError(t, err)
+		return raw
+	}
+
+	// Each key is selected by the kid of the token among the two keys.
+	for _, key := range keys {
+		_, err := validator.ValidateRawToken(context.Background(), signCognitoToken(key, "access"))
+		assert.NoError(t, err, key.KeyID)
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&jwksDownloads))
+
+	_, err = validator.ValidateRawToken(context.Background(), signCognitoToken(keys[0], "id"))
+	assert.Equal(t, ErrInsufficientScope, err)
+
+	// Tokens without kid are ambiguous with two keys.
+	token := getTestTokenWithKid(nil, issuer, time.Now().Add(time.Hour), jose.RS256, keys[0], "")
+	client := NewJWKClient(JWKClientOptions{URI: issuer + "/.well-known/jwks.json", Client: ts.Client(), SoleKeyFallback: true}, nil)
+	_, err = client.GetSecret(token)
+	assert.Equal(t, ErrAmbiguousKeyID, err)
+}
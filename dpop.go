@@ -0,0 +1,70 @@
+package auth0
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrInvalidDPoPAccessTokenHash is returned when the ath claim of a DPoP
+	// proof is missing or does not match the presented access token.
+	ErrInvalidDPoPAccessTokenHash = errors.New("ath claim of the DPoP proof does not match the access token")
+	// ErrInvalidDPoPKeyBinding is returned when the key of a DPoP proof
+	// does not match the cnf jkt confirmation of the access token.
+	ErrInvalidDPoPKeyBinding = errors.New("key of the DPoP proof does not match the access token confirmation")
+)
+
+// ValidateDPoPAccessTokenHash checks that the ath claim of the DPoP proof
+// is the base64url encoded SHA-256 hash of the presented access token,
+// as described in section 4.3 of RFC 9449.
+func ValidateDPoPAccessTokenHash(accessToken string, proofClaims map[string]interface{}) error {
+	ath, ok := proofClaims["ath"].(string)
+	if !ok || ath == "" {
+		return ErrInvalidDPoPAccessTokenHash
+	}
+
+	sum := sha256.Sum256([]byte(accessToken))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(ath), []byte(expected)) != 1 {
+		return ErrInvalidDPoPAccessTokenHash
+	}
+	return nil
+}
+
+// ValidateDPoPKeyBinding checks that the jkt member of the cnf claim
+// of the access token is the SHA-256 thumbprint of the public key
+// carried by the jwk header of the DPoP proof, as described in
+// section 6.1 of RFC 9449.
+func ValidateDPoPKeyBinding(accessTokenClaims map[string]interface{}, proof *jwt.JSONWebToken) error {
+	cnf, ok := accessTokenClaims["cnf"].(map[string]interface{})
+	if !ok {
+		return ErrInvalidDPoPKeyBinding
+	}
+	jkt, ok := cnf["jkt"].(string)
+	if !ok || jkt == "" {
+		return ErrInvalidDPoPKeyBinding
+	}
+
+	if len(proof.Headers) < 1 {
+		return ErrNoJWTHeaders
+	}
+	key := proof.Headers[0].JSONWebKey
+	if key == nil {
+		return ErrInvalidDPoPKeyBinding
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	expected := base64.RawURLEncoding.EncodeToString(thumbprint)
+	if subtle.ConstantTimeCompare([]byte(jkt), []byte(expected)) != 1 {
+		return ErrInvalidDPoPKeyBinding
+	}
+	return nil
+}
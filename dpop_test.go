@@ -0,0 +1,48 @@
+package auth0
+
+import (
+	"crypto"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestValidateDPoPAccessTokenHash(t *testing.T) {
+	// Example taken from section 7.1 of RFC 9449.
+	accessToken := "Kz~8mXK1EalYznwH-LC-1fBAo.4Ljp~zsPE_NeO.gxU"
+	ath := "fUHyO2r2Z3DZ53EsNrWBb0xWXoaNy59IiKCAqksmQEo"
+
+	assert.NoError(t, ValidateDPoPAccessTokenHash(accessToken, map[string]interface{}{"ath": ath}))
+	assert.Equal(t, ErrInvalidDPoPAccessTokenHash, ValidateDPoPAccessTokenHash("another-access-token", map[string]interface{}{"ath": ath}))
+	assert.Equal(t, ErrInvalidDPoPAccessTokenHash, ValidateDPoPAccessTokenHash(accessToken, map[string]interface{}{}))
+}
+
+func TestValidateDPoPKeyBinding(t *testing.T) {
+	proofKey := genECDSAJWK(jose.ES256, "")
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: proofKey}, (&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(map[string]interface{}{"htm": "GET"}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := jwt.ParseSigned(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey := proofKey.Public()
+	thumbprint, err := publicKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	assert.NoError(t, ValidateDPoPKeyBinding(map[string]interface{}{"cnf": map[string]interface{}{"jkt": jkt}}, proof))
+	assert.Equal(t, ErrInvalidDPoPKeyBinding, ValidateDPoPKeyBinding(map[string]interface{}{"cnf": map[string]interface{}{"jkt": "another"}}, proof))
+	assert.Equal(t, ErrInvalidDPoPKeyBinding, ValidateDPoPKeyBinding(map[string]interface{}{}, proof))
+}
@@ -0,0 +1,149 @@
+package auth0
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DefaultIssuerTrustTTL is the default time the
+// decisions of an IssuerTrustFunc are cached.
+const DefaultIssuerTrustTTL = time.Minute
+
+// IssuerTrustFunc decides whether the issuer is trusted
+// and returns the URI of its JWKS when it is. It may be
+// called concurrently, e.g. for the tokens of new issuers.
+type IssuerTrustFunc func(iss string) (trusted bool, jwksURI string)
+
+// DynamicIssuerOptions configures a DynamicIssuerProvider.
+type DynamicIssuerOptions struct {
+	Trust IssuerTrustFunc
+	// TrustTTL is the time the decisions of Trust are cached.
+	// Defaults to DefaultIssuerTrustTTL.
+	TrustTTL time.Duration
+	// ClientOptions are the options of the JWK clients
+	// created per JWKS URI, their URI being overridden.
+	ClientOptions JWKClientOptions
+}
+
+// DynamicIssuerProvider routes the resolution of the key to a JWK client
+// for the JWKS URI of the issuer of the token, the trusted issuers being
+// decided at runtime, e.g. as tenants are onboarded and offboarded.
+// Tokens of untrusted issuers are rejected with ErrUnknownIssuer.
+type DynamicIssuerProvider struct {
+	options DynamicIssuerOptions
+	mu      sync.Mutex
+	trusted map[string]trustedIssuer
+	// untrusted is bounded so that tokens with
+	// random issuers cannot exhaust the memory.
+	untrusted *unknownKeyCache
+	clients   map[string]*JWKClient
+	now       func() time.Time
+}
+
+type trustedIssuer struct {
+	jwksURI   string
+	checkedAt time.Time
+}
+
+// NewDynamicIssuerProvider creates a new DynamicIssuerProvider
+// instance from the provided options.
+func NewDynamicIssuerProvider(options DynamicIssuerOptions) *DynamicIssuerProvider {
+	if options.TrustTTL <= 0 {
+		options.TrustTTL = DefaultIssuerTrustTTL
+	}
+	d := &DynamicIssuerProvider{
+		options:   options,
+		trusted:   map[string]trustedIssuer{},
+		untrusted: newUnknownKeyCache(options.TrustTTL, DefaultMaxUnknownKeys),
+		clients:   map[string]*JWKClient{},
+		now:       time.Now,
+	}
+	d.untrusted.now = func() time.Time { return d.now() }
+	return d
+}
+
+// GetSecret implements the GetSecret method of the SecretProvider interface.
+// The iss claim is read before the signature is verified, by the key
+// of the JWKS of the issuer.
+func (d *DynamicIssuerProvider) GetSecret(token *jwt.JSONWebToken) (interface{}, error) {
+	return d.GetSecretContext(context.Background(), token)
+}
+
+// GetSecretContext implements the ContextSecretProvider interface,
+// the download of the keys of the issuer being cancelled with the context.
+func (d *DynamicIssuerProvider) GetSecretContext(ctx context.Context, token *jwt.JSONWebToken) (interface{}, error) {
+	claims := jwt.Claims{}
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, err
+	}
+
+	client, err := d.client(claims.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetSecretContext(ctx, token)
+}
+
+// client returns the JWK client of the issuer, consulting the trust
+// function when not cached. The trust function is called without
+// holding the lock, so that a slow decision does not block the others.
+func (d *DynamicIssuerProvider) client(iss string) (*JWKClient, error) {
+	d.mu.Lock()
+	if d.untrusted.contains(iss) {
+		d.mu.Unlock()
+		return nil, ErrUnknownIssuer
+	}
+	issuer, ok := d.trusted[iss]
+	d.mu.Unlock()
+
+	checked := !ok || d.now().Sub(issuer.checkedAt) >= d.options.TrustTTL
+	if checked {
+		trusted, jwksURI := d.options.Trust(iss)
+		if !trusted {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			previous, ok := d.trusted[iss]
+			delete(d.trusted, iss)
+			if ok {
+				d.dropClient(previous.jwksURI)
+			}
+			d.untrusted.add(iss)
+			return nil, ErrUnknownIssuer
+		}
+		issuer = trustedIssuer{jwksURI: jwksURI, checkedAt: d.now()}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if checked {
+		previous, ok := d.trusted[iss]
+		d.trusted[iss] = issuer
+		if ok && previous.jwksURI != issuer.jwksURI {
+			d.dropClient(previous.jwksURI)
+		}
+	}
+
+	client, ok := d.clients[issuer.jwksURI]
+	if !ok {
+		options := d.options.ClientOptions
+		options.URI = issuer.jwksURI
+		client = NewJWKClient(options, nil)
+		d.clients[issuer.jwksURI] = client
+	}
+	return client, nil
+}
+
+// dropClient forgets the JWK client of the JWKS URI once no trusted
+// issuer uses it, so that the clients do not outlive the offboarded
+// issuers. Must be called with the lock held.
+func (d *DynamicIssuerProvider) dropClient(jwksURI string) {
+	for _, issuer := range d.trusted {
+		if issuer.jwksURI == jwksURI {
+			return
+		}
+	}
+	delete(d.clients, jwksURI)
+}
@@ -0,0 +1,169 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestDynamicIssuerProvider(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	calls := map[string]int{}
+	onboarded := map[string]bool{"https://tenant-a.example.com/": true}
+	provider := NewDynamicIssuerProvider(DynamicIssuerOptions{
+		Trust: func(iss string) (bool, string) {
+			calls[iss]++
+			return onboarded[iss], ts.URL
+		},
+		TrustTTL:      time.Minute,
+		ClientOptions: JWKClientOptions{AllowInsecureJWKS: true},
+	})
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+	validator := NewValidator(NewConfiguration(provider, defaultAudience, "", jose.RS256), nil)
+
+	validate := func(iss string) error {
+		raw := getTestTokenWithClaims(jwt.Claims{
+			Issuer:   iss,
+			Audience: defaultAudience,
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}, jose.RS256, key)
+		token, err := jwt.ParseSigned(raw)
+		assert.NoError(t, err)
+		return validator.ValidateToken(token)
+	}
+
+	assert.NoError(t, validate("https://tenant-a.example.com/"))
+	assert.Equal(t, ErrUnknownIssuer, validate("https://tenant-b.example.com/"))
+
+	// The decisions are cached.
+	assert.NoError(t, validate("https://tenant-a.example.com/"))
+	assert.Equal(t, ErrUnknownIssuer, validate("https://tenant-b.example.com/"))
+	assert.Equal(t, 1, calls["https://tenant-a.example.com/"])
+	assert.Equal(t, 1, calls["https://tenant-b.example.com/"])
+
+	// The trust function is consulted again once the decisions expire.
+	onboarded = map[string]bool{"https://tenant-b.example.com/": true}
+	now = now.Add(time.Minute)
+	assert.Equal(t, ErrUnknownIssuer, validate("https://tenant-a.example.com/"))
+	assert.NoError(t, validate("https://tenant-b.example.com/"))
+	assert.Equal(t, 2, calls["https://tenant-a.example.com/"])
+	assert.Equal(t, 2, calls["https://tenant-b.example.com/"])
+}
+
+func TestDynamicIssuerProviderTrustWithoutLock(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	provider := NewDynamicIssuerProvider(DynamicIssuerOptions{
+		Trust: func(iss string) (bool, string) {
+			if iss == "https://slow.example.com/" {
+				close(started)
+				<-release
+			}
+			return true, ts.URL
+		},
+		ClientOptions: JWKClientOptions{AllowInsecureJWKS: true},
+	})
+	secret := func(iss string) error {
+		raw := getTestTokenWithClaims(jwt.Claims{Issuer: iss}, jose.RS256, key)
+		token, err := jwt.ParseSigned(raw)
+		assert.NoError(t, err)
+		_, err = provider.GetSecretContext(context.Background(), token)
+		return err
+	}
+	assert.NoError(t, secret("https://fast.example.com/"))
+
+	done := make(chan error)
+	go func() { done <- secret("https://slow.example.com/") }()
+	<-started
+
+	// A slow trust decision does not block the cached issuers.
+	assert.NoError(t, secret("https://fast.example.com/"))
+	close(release)
+	assert.NoError(t, <-done)
+}
+
+func TestDynamicIssuerProviderContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	provider := NewDynamicIssuerProvider(DynamicIssuerOptions{
+		Trust:         func(iss string) (bool, string) { return true, ts.URL },
+		ClientOptions: JWKClientOptions{AllowInsecureJWKS: true},
+	})
+	raw := getTestTokenWithClaims(jwt.Claims{Issuer: defaultIssuer}, jose.RS256, genRSASSAJWK(jose.RS256, "key"))
+	token, err := jwt.ParseSigned(raw)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = provider.GetSecretContext(ctx, token)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+}
+
+func TestDynamicIssuerProviderDropsClients(t *testing.T) {
+	jwksURIs := map[string]string{
+		"https://tenant-a.example.com/": "https://tenant-a.example.com/jwks.json",
+		"https://tenant-b.example.com/": "https://shared.example.com/jwks.json",
+		"https://tenant-c.example.com/": "https://shared.example.com/jwks.json",
+	}
+	provider := NewDynamicIssuerProvider(DynamicIssuerOptions{
+		Trust: func(iss string) (bool, string) {
+			jwksURI, ok := jwksURIs[iss]
+			return ok, jwksURI
+		},
+		TrustTTL: time.Minute,
+	})
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+
+	for iss := range jwksURIs {
+		_, err := provider.client(iss)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, provider.clients, 2)
+
+	// The client of an offboarded issuer is dropped,
+	// unless its JWKS URI is used by another issuer.
+	delete(jwksURIs, "https://tenant-a.example.com/")
+	delete(jwksURIs, "https://tenant-b.example.com/")
+	now = now.Add(2 * time.Minute)
+	for _, iss := range []string{"https://tenant-a.example.com/", "https://tenant-b.example.com/"} {
+		_, err := provider.client(iss)
+		assert.Equal(t, ErrUnknownIssuer, err)
+	}
+	assert.Len(t, provider.clients, 1)
+	assert.Contains(t, provider.clients, "https://shared.example.com/jwks.json")
+
+	// So is the client of a JWKS URI no longer used once changed.
+	jwksURIs["https://tenant-c.example.com/"] = "https://tenant-c.example.com/jwks.json"
+	_, err := provider.client("https://tenant-c.example.com/")
+	assert.NoError(t, err)
+	assert.Len(t, provider.clients, 1)
+	assert.Contains(t, provider.clients, "https://tenant-c.example.com/jwks.json")
+}
@@ -0,0 +1,34 @@
+package auth0
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorMapper maps a validation error to the HTTP status, the
+// RFC 6750 error code and the message answered to the client.
+// An empty code answers a challenge without error attribute.
+type ErrorMapper func(err error) (status int, code string, message string)
+
+// DefaultErrorMapper is used by the middleware created without
+// the WithErrorMapper option. Overriding it changes the mapping
+// globally and should be done before serving requests.
+var DefaultErrorMapper ErrorMapper = MapError
+
+// MapError is the default mapping of the validation errors:
+//   - a missing token is answered with a 401 status and no error code
+//   - a token lacking a scope with a 403 status and insufficient_scope
+//   - a failure to fetch the keys with a 500 status and server_error
+//   - any other error with a 401 status and invalid_token
+func MapError(err error) (status int, code string, message string) {
+	switch {
+	case errors.Is(err, ErrTokenNotFound), errors.Is(err, ErrNilRequest):
+		return http.StatusUnauthorized, "", "the request has no access token"
+	case errors.Is(err, ErrInsufficientScope):
+		return http.StatusForbidden, "insufficient_scope", "the access token does not grant the required scope"
+	case errors.Is(err, ErrKeyFetchFailed), errors.Is(err, ErrInvalidContentType), errors.Is(err, ErrJWKSStatus), errors.Is(err, ErrInsecureJWKSURI),
+		errors.Is(err, ErrEmptyJWKS):
+		return http.StatusInternalServerError, "server_error", "the signing keys could not be retrieved"
+	}
+	return http.StatusUnauthorized, "invalid_token", "the access token is invalid"
+}
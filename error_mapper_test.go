@@ -0,0 +1,76 @@
+package auth0
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "token not found", err: ErrTokenNotFound, expectedStatus: http.StatusUnauthorized},
+		{name: "nil request", err: ErrNilRequest, expectedStatus: http.StatusUnauthorized},
+		{name: "insufficient scope", err: ErrInsufficientScope, expectedStatus: http.StatusForbidden, expectedCode: "insufficient_scope"},
+		{name: "invalid JWKS content type", err: ErrInvalidContentType, expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "JWKS endpoint failure", err: &RetryError{Attempts: []error{&JWKSStatusError{StatusCode: http.StatusBadGateway}}}, expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "empty JWKS", err: ErrEmptyJWKS, expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "insecure JWKS URI", err: ErrInsecureJWKSURI, expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "wrapped error", err: fmt.Errorf("downloading keys: %w", ErrInvalidContentType), expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "keys not fetched", err: &ValidationError{Kind: ErrKeyFetchFailed, Err: errors.New("dial tcp: connection refused")}, expectedStatus: http.StatusInternalServerError, expectedCode: "server_error"},
+		{name: "expired token", err: jwt.ErrExpired, expectedStatus: http.StatusUnauthorized, expectedCode: "invalid_token"},
+		{name: "unknown key", err: ErrNoKeyFound, expectedStatus: http.StatusUnauthorized, expectedCode: "invalid_token"},
+		{name: "invalid algorithm", err: ErrInvalidAlgorithm, expectedStatus: http.StatusUnauthorized, expectedCode: "invalid_token"},
+		{name: "unknown error", err: errors.New("unknown"), expectedStatus: http.StatusUnauthorized, expectedCode: "invalid_token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, code, message := MapError(test.err)
+			assert.Equal(t, test.expectedStatus, status)
+			assert.Equal(t, test.expectedCode, code)
+			assert.NotEmpty(t, message)
+		})
+	}
+}
+
+func TestMiddlewareErrorMapper(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	expiredToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	teapot := func(err error) (int, string, string) {
+		return http.StatusTeapot, "teapot", err.Error()
+	}
+
+	serve := func(opts ...MiddlewareOption) *httptest.ResponseRecorder {
+		validator, req := genTestConfiguration(configuration, expiredToken)
+		rec := httptest.NewRecorder()
+		Middleware(validator, opts...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(WithErrorMapper(teapot))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, `Bearer error="teapot"`, rec.Header().Get("WWW-Authenticate"))
+
+	defaultErrorMapper := DefaultErrorMapper
+	DefaultErrorMapper = teapot
+	defer func() { DefaultErrorMapper = defaultErrorMapper }()
+
+	rec = serve()
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	rec = serve(WithErrorMapper(MapError))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer error="invalid_token"`, rec.Header().Get("WWW-Authenticate"))
+}
@@ -3,6 +3,7 @@ module github.com/auth0-community/go-auth0
 require (
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/crypto v0.0.0-20180802221240-56440b844dfe // indirect
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	gopkg.in/square/go-jose.v2 v2.1.7
 )
 
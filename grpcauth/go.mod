@@ -0,0 +1,25 @@
+module github.com/auth0-community/go-auth0/grpcauth
+
+go 1.21
+
+require (
+	github.com/auth0-community/go-auth0 v1.0.1-0.20190927140239-2f65fab42a93
+	github.com/stretchr/testify v1.4.0
+	google.golang.org/grpc v1.64.1
+	gopkg.in/square/go-jose.v2 v2.1.7
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+)
+
+replace github.com/auth0-community/go-auth0 => ../
@@ -0,0 +1,110 @@
+// Package grpcauth validates the tokens of gRPC calls, sent with the
+// Bearer scheme in the authorization metadata, with a JWTValidator.
+// It is a separate module to keep the gRPC dependency optional.
+package grpcauth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/auth0-community/go-auth0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type contextKey struct{}
+
+var tokenContextKey = contextKey{}
+
+// RawFromMetadata returns the compact serialized JWT sent with the
+// Bearer scheme in the authorization metadata of the incoming call.
+// It returns auth0.ErrTokenNotFound when the metadata is absent.
+func RawFromMetadata(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", auth0.ErrTokenNotFound
+	}
+	for _, value := range md.Get("authorization") {
+		if raw, err := auth0.RawFromBearer(value); err == nil {
+			return raw, nil
+		}
+	}
+	return "", auth0.ErrTokenNotFound
+}
+
+// FromMetadata returns the JWT sent with the Bearer scheme
+// in the authorization metadata of the incoming call, parsed
+// like auth0.ParseToken: an encrypted token is reported with
+// an error matching auth0.ErrEncryptedToken.
+func FromMetadata(ctx context.Context) (*jwt.JSONWebToken, error) {
+	raw, err := RawFromMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return auth0.ParseToken(raw)
+}
+
+// Option configures the interceptor.
+type Option func(*interceptor)
+
+// WithErrorMapper overrides auth0.DefaultErrorMapper for this interceptor.
+func WithErrorMapper(mapper auth0.ErrorMapper) Option {
+	return func(i *interceptor) {
+		i.mapError = mapper
+	}
+}
+
+type interceptor struct {
+	validator *auth0.JWTValidator
+	mapError  auth0.ErrorMapper
+}
+
+// UnaryServerInterceptor validates the token of each unary call with
+// the validator before calling the handler, the validated token being
+// available to the handler with TokenFromContext. Calls without a valid
+// token fail with the code matching the status of auth0.DefaultErrorMapper,
+// unless overridden with WithErrorMapper.
+func UnaryServerInterceptor(validator *auth0.JWTValidator, options ...Option) grpc.UnaryServerInterceptor {
+	i := &interceptor{validator: validator}
+	for _, option := range options {
+		option(i)
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		raw, err := RawFromMetadata(ctx)
+		if err != nil {
+			return nil, i.statusError(err)
+		}
+		token, err := i.validator.ValidateRawToken(ctx, raw)
+		if err != nil {
+			return nil, i.statusError(err)
+		}
+		return handler(context.WithValue(ctx, tokenContextKey, token), req)
+	}
+}
+
+// TokenFromContext returns the token validated by the interceptor.
+func TokenFromContext(ctx context.Context) (*jwt.JSONWebToken, bool) {
+	token, ok := ctx.Value(tokenContextKey).(*jwt.JSONWebToken)
+	return token, ok
+}
+
+// statusError converts a validation error to a gRPC status,
+// with the code matching the HTTP status of the error mapper.
+func (i *interceptor) statusError(err error) error {
+	mapError := i.mapError
+	if mapError == nil {
+		mapError = auth0.DefaultErrorMapper
+	}
+	httpStatus, _, message := mapError(err)
+	switch httpStatus {
+	case http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, message)
+	case http.StatusInternalServerError:
+		return status.Error(codes.Internal, message)
+	}
+	return status.Error(codes.Unauthenticated, message)
+}
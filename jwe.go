@@ -0,0 +1,65 @@
+package auth0
+
+import (
+	"errors"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrEncryptedToken is returned for an encrypted token received by a
+// validator configured without decryption key, or by the extractors
+// used on their own.
+var ErrEncryptedToken = errors.New("token is encrypted")
+
+// encryptedToken is returned by the extractors for a compact JWE,
+// which the validator configured with a decryption key decrypts.
+type encryptedToken struct {
+	raw string
+}
+
+func (e *encryptedToken) Error() string {
+	return ErrEncryptedToken.Error()
+}
+
+// Is reports whether the target is ErrEncryptedToken.
+func (e *encryptedToken) Is(target error) bool {
+	return target == ErrEncryptedToken
+}
+
+// ParseToken parses the compact serialized token as the extractors do,
+// e.g. for a token read outside of any http request. An encrypted token
+// is reported with an error matching ErrEncryptedToken, which the validator
+// configured with a DecryptionKey decrypts when returned by an extractor.
+func ParseToken(raw string) (*jwt.JSONWebToken, error) {
+	return parseToken(raw)
+}
+
+// parseToken parses the compact serialized token, reporting a JWE,
+// serialized in five parts instead of three, as an encryptedToken.
+func parseToken(raw string) (*jwt.JSONWebToken, error) {
+	if isEncrypted(raw) {
+		return nil, &encryptedToken{raw: raw}
+	}
+	return jwt.ParseSigned(raw)
+}
+
+func isEncrypted(raw string) bool {
+	return strings.Count(raw, ".") == 4
+}
+
+// decrypt returns the signed token nested in the encrypted one,
+// whose cty header must be JWT, to be validated as any signed token.
+func (c Configuration) decrypt(raw string) (*jwt.JSONWebToken, error) {
+	if c.DecryptionKey == nil {
+		return nil, ErrEncryptedToken
+	}
+	nested, err := jwt.ParseSignedAndEncrypted(raw)
+	if err != nil {
+		return nil, err
+	}
+	if c.KeyEncryptionAlgorithm != "" && nested.Headers[0].Algorithm != string(c.KeyEncryptionAlgorithm) {
+		return nil, ErrInvalidAlgorithm
+	}
+	return nested.Decrypt(c.DecryptionKey)
+}
@@ -0,0 +1,136 @@
+package auth0
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func getTestEncryptedToken(claims jwt.Claims, recipient *rsa.PublicKey, alg jose.KeyAlgorithm, cty jose.ContentType) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: defaultSecret}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(err)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A128GCM, jose.Recipient{Algorithm: alg, Key: recipient}, (&jose.EncrypterOptions{}).WithContentType(cty))
+	if err != nil {
+		panic(err)
+	}
+	var raw string
+	if cty == "" {
+		// An encrypted token which is not signed has no cty header.
+		raw, err = jwt.Encrypted(encrypter).Claims(claims).CompactSerialize()
+	} else {
+		raw, err = jwt.SignedAndEncrypted(signer, encrypter).Claims(claims).CompactSerialize()
+	}
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func TestValidateEncryptedToken(t *testing.T) {
+	decryptionKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	claims := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	expired := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(-time.Hour))}
+
+	tests := []struct {
+		name          string
+		decryptionKey interface{}
+		keyAlgorithm  jose.KeyAlgorithm
+		raw           string
+		expectedErr   error
+	}{
+		{
+			name:          "nested token",
+			decryptionKey: decryptionKey,
+			raw:           getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"),
+		},
+		{
+			name:          "expected key algorithm",
+			decryptionKey: decryptionKey,
+			keyAlgorithm:  jose.RSA_OAEP,
+			raw:           getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"),
+		},
+		{
+			name:          "unexpected key algorithm",
+			decryptionKey: decryptionKey,
+			keyAlgorithm:  jose.RSA_OAEP_256,
+			raw:           getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"),
+			expectedErr:   ErrInvalidAlgorithm,
+		},
+		{
+			name:        "no decryption key",
+			raw:         getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"),
+			expectedErr: ErrEncryptedToken,
+		},
+		{
+			name:          "encrypted for another key",
+			decryptionKey: decryptionKey,
+			raw:           getTestEncryptedToken(claims, &otherKey.PublicKey, jose.RSA_OAEP, "JWT"),
+			expectedErr:   jose.ErrCryptoFailure,
+		},
+		{
+			name:          "encrypted token not signed",
+			decryptionKey: decryptionKey,
+			raw:           getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, ""),
+			expectedErr:   jwt.ErrInvalidContentType,
+		},
+		{
+			name:          "nested token validated",
+			decryptionKey: decryptionKey,
+			raw:           getTestEncryptedToken(expired, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"),
+			expectedErr:   ErrTokenExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+			configuration.DecryptionKey = test.decryptionKey
+			configuration.KeyEncryptionAlgorithm = test.keyAlgorithm
+
+			validator, req := genTestConfiguration(configuration, test.raw)
+			token, err := validator.ValidateRequest(req)
+			assertErrorIs(t, test.expectedErr, err)
+			if test.expectedErr == nil {
+				validated := jwt.Claims{}
+				assert.NoError(t, validator.Claims(token, &validated))
+				assert.Equal(t, defaultIssuer, validated.Issuer)
+			}
+
+			_, err = validator.ValidateRawToken(context.Background(), test.raw)
+			assertErrorIs(t, test.expectedErr, err)
+
+			_, err = validator.ValidateRequestChain(req)
+			assertErrorIs(t, test.expectedErr, err)
+		})
+	}
+}
+
+func TestExtractEncryptedToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	claims := jwt.Claims{Issuer: defaultIssuer, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	raw := getTestEncryptedToken(claims, &key.PublicKey, jose.RSA_OAEP, "JWT")
+
+	req := httptest.NewRequest("GET", "http://localhost?token="+raw, nil)
+	req.Header.Set("Authorization", "Bearer "+raw)
+
+	_, err := FromHeader(req)
+	assert.True(t, errors.Is(err, ErrEncryptedToken), "got %v", err)
+	_, err = FromParams(req)
+	assert.True(t, errors.Is(err, ErrEncryptedToken), "got %v", err)
+	assert.NotContains(t, err.Error(), raw)
+	_, err = ParseToken(raw)
+	assert.True(t, errors.Is(err, ErrEncryptedToken), "got %v", err)
+	_, err = FromHeaderChain(req)
+	assert.True(t, errors.Is(err, ErrEncryptedToken), "got %v", err)
+}
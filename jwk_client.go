@@ -2,91 +2,916 @@ package auth0
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"gopkg.in/square/go-jose.v2/jwt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/square/go-jose.v2"
 )
 
 var (
 	ErrInvalidContentType = errors.New("should have a JSON content type for JWKS endpoint")
+	ErrJWKSStatus         = errors.New("unexpected status of the JWKS endpoint")
 	ErrInvalidAlgorithm   = errors.New("algorithm is invalid")
+	ErrInsecureJWKSURI    = errors.New("JWKS URI should use https")
+	// ErrEmptyJWKS is returned when the JWKS endpoint serves no keys,
+	// the keys already cached being kept.
+	ErrEmptyJWKS = errors.New("JWKS endpoint returned no keys")
+	// ErrOfflineKeyMissing is returned in offline mode when
+	// the key is not in the cache, the keys never being downloaded.
+	ErrOfflineKeyMissing = errors.New("key is not cached and downloads are disabled in offline mode")
+	// ErrAmbiguousKeyID is returned with SoleKeyFallback when a token
+	// has no kid while the key set holds several keys.
+	ErrAmbiguousKeyID = errors.New("token has no kid and the key set holds several keys")
+	// ErrNoKeySetDownloaded is returned by LastKeySet
+	// when the keys have not been downloaded yet.
+	ErrNoKeySetDownloaded = errors.New("no key set has been downloaded yet")
 )
 
 type JWKClientOptions struct {
 	URI    string
 	Client *http.Client
+	// DownloadGrace is the time given to the JWKS endpoint to recover
+	// from a failed download before the error is surfaced to the caller.
+	// During the grace the download is retried a few times.
+	// Zero disables the grace.
+	DownloadGrace time.Duration
+	// RetryPolicy, when set, retries the failed downloads with an
+	// exponential backoff instead of the fixed retries of the grace.
+	// A set DownloadGrace still bounds the overall time spent.
+	RetryPolicy *RetryPolicy
+	// AllowInsecureJWKS allows downloading the keys from a plain
+	// http URI. It should only be set for local testing.
+	AllowInsecureJWKS bool
+	// MatchKeyThumbprints additionally indexes the downloaded keys by
+	// their material thumbprint. A token whose kid is unknown but which
+	// is signed by the material of an already downloaded key is then
+	// verified from cache, without downloading the keys again.
+	// This suits providers relabelling their kids without rotating the keys.
+	MatchKeyThumbprints bool
+	// LockObserver, when set, receives the time spent waiting for and
+	// holding the lock guarding the filling of the key cache.
+	LockObserver LockObserver
+	// UnknownKeyTTL, when set, remembers for this long the kids missing
+	// from the downloaded keys: tokens with these kids are rejected with
+	// ErrNoKeyFound without downloading the keys again.
+	UnknownKeyTTL time.Duration
+	// MaxUnknownKeys bounds the number of remembered unknown kids,
+	// the least recently used being evicted first.
+	// Defaults to DefaultMaxUnknownKeys.
+	MaxUnknownKeys int
+	// OfflineOnly disables the downloads of the keys, which are only
+	// served from the cache, to be seeded beforehand. A missing key is
+	// reported with ErrOfflineKeyMissing, no network call being ever made.
+	OfflineOnly bool
+	// RefreshAheadThreshold, when set, is the fraction of the max age of
+	// a cached key (e.g. 0.8) past which getting it triggers a download
+	// of the keys in background, the cached key being still served.
+	// This keeps the validation latency flat around the key expiry.
+	// It requires a key cacher implementing KeyInfoCacher.
+	RefreshAheadThreshold float64
+	// Headers are added to the requests downloading the keys,
+	// e.g. the credentials required by a gateway in front of the JWKS URI.
+	Headers http.Header
+	// RequestModifier, when set, is called with each request downloading
+	// the keys, after the Headers have been added, e.g. to sign it.
+	RequestModifier func(*http.Request)
+	// MinRefetchInterval, when set, is the time after a download during
+	// which a cache miss is resolved from the keys just downloaded rather
+	// than by downloading them again: a kid missing from them is rejected
+	// with ErrNoKeyFound without any network call.
+	MinRefetchInterval time.Duration
+	// OnKeysChanged, when set, is called with the kids added to and
+	// removed from the key set when a download serves a different key
+	// set than the previous one, e.g. to log the rotations. It is not
+	// called for the first download nor when the key set is unchanged.
+	// It may be called while the client is locked and must not call it.
+	OnKeysChanged func(added, removed []string)
+	// MaxCachedKeys, when set, bounds the persistent key cacher created
+	// when none is provided, whose keys never expire: without it, the
+	// cache grows with every new kid served by the JWKS endpoint.
+	MaxCachedKeys int
+	// Logger, when set, receives the downloads of the keys with their
+	// URI and duration, the cache hits and misses and the rotations.
+	Logger Logger
+	// Tracer, when set, traces the resolution of the keys with a
+	// "auth0.GetKey" span, with the kid, the JWKS URI and whether the
+	// cache was hit, and the downloads with a "auth0.DownloadKeys" span.
+	Tracer Tracer
+	// HonorCacheControl expires the keys of a downloaded key set after the
+	// max-age of the Cache-Control header of the response, clamped between
+	// MinCacheControlAge and MaxCacheControlAge when set. Without the header,
+	// or with a clamped max-age of zero, the keys expire after the max age
+	// of the key cacher. It requires a key cacher implementing TTLKeyCacher.
+	HonorCacheControl bool
+	// MinCacheControlAge bounds the max-age honored from below,
+	// e.g. so that a max-age=0 does not download the keys too often.
+	MinCacheControlAge time.Duration
+	// MaxCacheControlAge bounds the max-age honored from above.
+	MaxCacheControlAge time.Duration
+	// SoleKeyFallback verifies the tokens without kid with the only key
+	// of the key set, as sent by some issuers signing with a single key.
+	// They are rejected with ErrAmbiguousKeyID when the key set holds
+	// several keys. A rotation of the sole key is picked up at the next
+	// download, e.g. with Refresh. Such tokens are rejected by default.
+	SoleKeyFallback bool
+	// VerifyX5C checks the x5c certificate chain of the keys which have
+	// one: its leaf certificate must hold the key and match the x5t and
+	// x5t#S256 thumbprints of the token when present, failing with
+	// ErrCertificateMismatch otherwise. The keys without chain are used
+	// as is. This hardens against a JWKS serving a mismatched key.
+	VerifyX5C bool
+	// X5CRoots, when set with VerifyX5C, additionally requires the chains
+	// to chain up to these roots, failing with ErrUntrustedCertificate.
+	X5CRoots *x509.CertPool
 }
 
+// DefaultJWKSTimeout is the timeout of the HTTP client downloading the
+// keys when none is provided, so that a hung JWKS endpoint cannot block
+// the validations indefinitely. It can be overridden before the clients
+// are created.
+var DefaultJWKSTimeout = 30 * time.Second
+
+// JWKOption configures the options
+// created by NewJWKClientOptions.
+type JWKOption func(*JWKClientOptions)
+
+// NewJWKClientOptions creates the options downloading the keys from the
+// JWKS URI with an HTTP client timing out after DefaultJWKSTimeout,
+// rather than with http.DefaultClient which never times out.
+func NewJWKClientOptions(uri string, opts ...JWKOption) JWKClientOptions {
+	options := JWKClientOptions{
+		URI:    uri,
+		Client: &http.Client{Timeout: DefaultJWKSTimeout},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithHTTPClient downloads the keys with the client.
+func WithHTTPClient(client *http.Client) JWKOption {
+	return func(o *JWKClientOptions) {
+		o.Client = client
+	}
+}
+
+// WithTimeout sets the timeout of the downloads of the keys on a
+// copy of the client, the client passed to WithHTTPClient being
+// left untouched.
+func WithTimeout(timeout time.Duration) JWKOption {
+	return func(o *JWKClientOptions) {
+		client := http.Client{}
+		if o.Client != nil {
+			client = *o.Client
+		}
+		client.Timeout = timeout
+		o.Client = &client
+	}
+}
+
+// WithHeaders adds the headers to the requests downloading the keys,
+// as JWKClientOptions.Headers.
+func WithHeaders(headers http.Header) JWKOption {
+	return func(o *JWKClientOptions) {
+		if o.Headers == nil {
+			o.Headers = http.Header{}
+		}
+		for name, values := range headers {
+			for _, value := range values {
+				o.Headers.Add(name, value)
+			}
+		}
+	}
+}
+
+// WithLogger sets the Logger of the options.
+func WithLogger(logger Logger) JWKOption {
+	return func(o *JWKClientOptions) {
+		o.Logger = logger
+	}
+}
+
+// WithTracer sets the Tracer of the options.
+func WithTracer(tracer Tracer) JWKOption {
+	return func(o *JWKClientOptions) {
+		o.Tracer = tracer
+	}
+}
+
+// WithRetry retries the failed downloads with the policy,
+// as JWKClientOptions.RetryPolicy.
+func WithRetry(policy RetryPolicy) JWKOption {
+	return func(o *JWKClientOptions) {
+		o.RetryPolicy = &policy
+	}
+}
+
+// JWKSStatusError is returned when the JWKS endpoint answers
+// with an unsuccessful status. It unwraps to ErrJWKSStatus.
+type JWKSStatusError struct {
+	StatusCode  int
+	ContentType string
+	// Body is the beginning of the response, to help diagnosing
+	// a JWKS URI pointing at an error or a login page.
+	Body string
+}
+
+func (e *JWKSStatusError) Error() string {
+	return describeResponse(e.StatusCode, e.ContentType, e.Body)
+}
+
+func (e *JWKSStatusError) Unwrap() error {
+	return ErrJWKSStatus
+}
+
+// LockObserver receives the durations a lock was waited for and held.
+// It is called after the lock has been released.
+type LockObserver func(wait, hold time.Duration)
+
 type JWKS struct {
 	Keys []jose.JSONWebKey `json:"keys"`
 }
 
 type JWKClient struct {
-	keyCacher KeyCacher
-	mu        sync.Mutex
-	options   JWKClientOptions
-	extractor RequestTokenExtractor
+	keyCacher   KeyCacher
+	mu          sync.Mutex
+	options     JWKClientOptions
+	extractor   RequestTokenExtractor
+	thumbprints map[string]jose.JSONWebKey
+	unknownKeys *unknownKeyCache
+	// downloads deduplicates the concurrent downloads on cache misses.
+	downloads singleflight.Group
+	// shared is the download in flight, cancelled once all its waiters
+	// are gone. Each download has its own key in downloads, numbered
+	// by sharedGen, so that no waiter joins a cancelled one.
+	sharedMu  sync.Mutex
+	shared    *sharedDownload
+	sharedGen uint64
+	// refreshing is set while a background refresh runs.
+	refreshing int32
+	// etag and etagKeys are the ETag and the keys of the last
+	// downloaded key set, served again on a 304 Not Modified.
+	etagMu   sync.Mutex
+	etag     string
+	etagKeys []jose.JSONWebKey
+	// lastKeys are the keys downloaded at lastDownloadAt,
+	// resolving the misses within the MinRefetchInterval.
+	lastMu         sync.Mutex
+	lastDownloadAt time.Time
+	lastKeys       []jose.JSONWebKey
+	// lastMaxAge is the clamped Cache-Control max-age of the last
+	// downloaded key set, zero when not honored or not sent.
+	lastMaxAge time.Duration
+	// keyIDs are the kids of the last downloaded key set,
+	// diffed with the next one for OnKeysChanged.
+	keyIDsMu sync.Mutex
+	keyIDs   map[string]bool
+	// discovery, when set, resolves the JWKS URI of each download
+	// from the discovery document in place of the URI option.
+	discovery *DiscoveryClient
 }
 
 // NewJWKClient creates a new JWKClient instance from the
-// provided options.
+// provided options. Without Client, the keys are downloaded
+// with a client timing out after DefaultJWKSTimeout.
 func NewJWKClient(options JWKClientOptions, extractor RequestTokenExtractor) *JWKClient {
 	return NewJWKClientWithCache(options, extractor, nil)
 }
 
 // NewJWKClientWithCache creates a new JWKClient instance from the
 // provided options and a custom keycacher interface.
-// Passing nil to keyCacher will create a persistent key cacher
+// Passing nil to keyCacher will create a persistent key cacher, bounded
+// by MaxCachedKeys when set
 func NewJWKClientWithCache(options JWKClientOptions, extractor RequestTokenExtractor, keyCacher KeyCacher) *JWKClient {
 	if extractor == nil {
 		extractor = RequestTokenExtractorFunc(FromHeader)
 	}
+	if keyCacher == nil && options.MaxCachedKeys > 0 {
+		keyCacher = NewPersistentKeyCacher(options.MaxCachedKeys)
+	}
 	if keyCacher == nil {
 		keyCacher = newMemoryPersistentKeyCacher()
 	}
 	if options.Client == nil {
-		options.Client = http.DefaultClient
+		options.Client = &http.Client{Timeout: DefaultJWKSTimeout}
 	}
+	options.Logger = loggerOrNop(options.Logger)
 
-	return &JWKClient{
+	client := &JWKClient{
 		keyCacher: keyCacher,
 		options:   options,
 		extractor: extractor,
 	}
+	if options.UnknownKeyTTL > 0 {
+		client.unknownKeys = newUnknownKeyCache(options.UnknownKeyTTL, options.MaxUnknownKeys)
+	}
+	return client
 }
 
 // GetKey returns the key associated with the provided ID.
 func (j *JWKClient) GetKey(ID string) (jose.JSONWebKey, error) {
-	searchedKey, err := j.keyCacher.Get(ID)
+	return j.GetKeyContext(context.Background(), ID)
+}
 
+// GetKeyContext returns the key associated with the provided ID,
+// giving up its download when the context is done. The download is
+// shared with the concurrent misses and only cancelled once the
+// contexts of all of them are done.
+func (j *JWKClient) GetKeyContext(ctx context.Context, ID string) (jose.JSONWebKey, error) {
+	if j.options.Tracer == nil {
+		key, _, err := j.getKey(ctx, ID)
+		return key, err
+	}
+
+	ctx, span := j.options.Tracer.Start(ctx, "auth0.GetKey")
+	defer span.End()
+	span.SetAttribute("jwks.uri", j.options.URI)
+	span.SetAttribute("jwks.kid", ID)
+
+	key, cacheHit, err := j.getKey(ctx, ID)
+	span.SetAttribute("jwks.cache_hit", cacheHit)
 	if err != nil {
-		j.mu.Lock()
-		defer j.mu.Unlock()
+		span.RecordError(err)
+	}
+	return key, err
+}
 
-		keys, err := j.downloadKeys()
-		if err != nil {
-			return jose.JSONWebKey{}, err
+// getKey returns the key associated with the provided ID
+// and whether it was served from the cache.
+func (j *JWKClient) getKey(ctx context.Context, ID string) (jose.JSONWebKey, bool, error) {
+	searchedKey, err := j.keyCacher.Get(ID)
+	if err != nil {
+		j.options.Logger.Debugf("key %q is not cached: %v", ID, err)
+		if j.isUnknownKey(ID) {
+			return jose.JSONWebKey{}, false, ErrNoKeyFound
 		}
-		addedKey, err := j.keyCacher.Add(ID, keys)
+
+		keys := j.recentKeys()
+		if keys == nil {
+			if keys, err = j.downloadKeysShared(ctx); err != nil {
+				return jose.JSONWebKey{}, false, err
+			}
+		}
+
+		defer j.unlock(j.lock())
+		if j.options.MatchKeyThumbprints {
+			j.indexThumbprints(keys)
+		}
+		addedKey, err := j.addKeys(ID, keys)
 		if err != nil {
+			if err == ErrNoKeyFound && j.unknownKeys != nil {
+				j.unknownKeys.add(ID)
+			}
+			return jose.JSONWebKey{}, false, err
+		}
+		return *addedKey, false, nil
+	}
+
+	j.options.Logger.Debugf("key %q served from the cache", ID)
+	if j.options.RefreshAheadThreshold > 0 {
+		j.refreshAhead(ID)
+	}
+	return *searchedKey, true, nil
+}
+
+// isUnknownKey reports whether the kid is remembered
+// as missing from the downloaded keys.
+func (j *JWKClient) isUnknownKey(ID string) bool {
+	if j.unknownKeys == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.unknownKeys.contains(ID)
+}
+
+// recentKeys returns the keys downloaded within the MinRefetchInterval
+// without the keys for encryption, or nil when they must be downloaded again.
+func (j *JWKClient) recentKeys() []jose.JSONWebKey {
+	if j.options.MinRefetchInterval <= 0 {
+		return nil
+	}
+	j.lastMu.Lock()
+	defer j.lastMu.Unlock()
+	if time.Since(j.lastDownloadAt) >= j.options.MinRefetchInterval {
+		return nil
+	}
+	return verificationKeys(j.lastKeys)
+}
+
+// storeLastKeys remembers the downloaded keys for the
+// MinRefetchInterval and the SoleKeyFallback.
+func (j *JWKClient) storeLastKeys(keys []jose.JSONWebKey) {
+	j.lastMu.Lock()
+	defer j.lastMu.Unlock()
+	j.lastDownloadAt = time.Now()
+	j.lastKeys = keys
+}
+
+// addKeys adds the keys to the cache, expiring after the max-age
+// of the last downloaded key set when honored and sent.
+func (j *JWKClient) addKeys(ID string, keys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	j.lastMu.Lock()
+	maxAge := j.lastMaxAge
+	j.lastMu.Unlock()
+
+	if keyCacher, ok := j.keyCacher.(TTLKeyCacher); ok && maxAge > 0 {
+		return keyCacher.AddWithTTL(ID, keys, maxAge)
+	}
+	return j.keyCacher.Add(ID, keys)
+}
+
+// LastKeySet returns a copy of the key set last downloaded along with
+// the time it was downloaded, e.g. for a diagnostics endpoint listing
+// the trusted keys. The key material is shared and must not be modified.
+func (j *JWKClient) LastKeySet() (jose.JSONWebKeySet, time.Time, error) {
+	j.lastMu.Lock()
+	defer j.lastMu.Unlock()
+	if j.lastDownloadAt.IsZero() {
+		return jose.JSONWebKeySet{}, time.Time{}, ErrNoKeySetDownloaded
+	}
+	keys := make([]jose.JSONWebKey, len(j.lastKeys))
+	copy(keys, j.lastKeys)
+	return jose.JSONWebKeySet{Keys: keys}, j.lastDownloadAt, nil
+}
+
+// soleKey returns the key of a key set holding a single key, for the
+// tokens without kid. The key set last downloaded is used while the key
+// is cached, and downloaded otherwise.
+func (j *JWKClient) soleKey(ctx context.Context) (jose.JSONWebKey, error) {
+	j.lastMu.Lock()
+	lastKeys := verificationKeys(j.lastKeys)
+	j.lastMu.Unlock()
+	if len(lastKeys) == 1 {
+		if key, err := j.keyCacher.Get(lastKeys[0].KeyID); err == nil {
+			return *key, nil
+		}
+	}
+
+	keys := j.recentKeys()
+	if keys == nil {
+		var err error
+		if keys, err = j.downloadKeysShared(ctx); err != nil {
 			return jose.JSONWebKey{}, err
 		}
-		return *addedKey, nil
 	}
+	if len(keys) != 1 {
+		return jose.JSONWebKey{}, ErrAmbiguousKeyID
+	}
+
+	defer j.unlock(j.lock())
+	addedKey, err := j.addKeys(keys[0].KeyID, keys)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return *addedKey, nil
+}
+
+// storeMaxAge stores the max-age of the response downloading the keys,
+// clamped between the min and max ages honored, when enabled.
+func (j *JWKClient) storeMaxAge(header http.Header) {
+	if !j.options.HonorCacheControl {
+		return
+	}
+	maxAge, ok := cacheControlMaxAge(header.Get("Cache-Control"))
+	if ok {
+		if maxAge < j.options.MinCacheControlAge {
+			maxAge = j.options.MinCacheControlAge
+		}
+		if j.options.MaxCacheControlAge > 0 && maxAge > j.options.MaxCacheControlAge {
+			maxAge = j.options.MaxCacheControlAge
+		}
+	}
+
+	j.lastMu.Lock()
+	defer j.lastMu.Unlock()
+	j.lastMaxAge = maxAge
+}
+
+// cacheControlMaxAge returns the max-age directive of a Cache-Control
+// header value, if any and valid.
+func cacheControlMaxAge(value string) (time.Duration, bool) {
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) < 8 || !strings.EqualFold(directive[:8], "max-age=") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(directive[8:], `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(math.MaxInt64/time.Second) {
+			seconds = int64(math.MaxInt64 / time.Second)
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// sharedDownload is a download shared by the concurrent cache misses.
+type sharedDownload struct {
+	key     string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// downloadKeysShared downloads the keys on a cache miss, the concurrent
+// misses sharing a single download of the JWKS URI. The download is
+// detached from the context of the callers, each of them giving up
+// waiting for it when its own context is done, and is cancelled once
+// all of them gave up.
+func (j *JWKClient) downloadKeysShared(ctx context.Context) ([]jose.JSONWebKey, error) {
+	_, span := tracerOrNop(j.options.Tracer).Start(ctx, "auth0.DownloadKeys")
+	defer span.End()
+	span.SetAttribute("jwks.uri", j.options.URI)
+
+	shared := j.joinSharedDownload()
+	defer j.leaveSharedDownload(shared)
+
+	results := j.downloads.DoChan(shared.key, func() (interface{}, error) {
+		defer j.endSharedDownload(shared)
+		return j.downloadKeysWithGrace(shared.ctx)
+	})
+	select {
+	case <-ctx.Done():
+		span.RecordError(ctx.Err())
+		return nil, ctx.Err()
+	case result := <-results:
+		span.SetAttribute("jwks.shared", result.Shared)
+		if result.Err != nil {
+			span.RecordError(result.Err)
+			return nil, result.Err
+		}
+		keys := result.Val.([]jose.JSONWebKey)
+		span.SetAttribute("jwks.keys", len(keys))
+		return keys, nil
+	}
+}
+
+// joinSharedDownload returns the download in flight,
+// starting a new one when there is none.
+func (j *JWKClient) joinSharedDownload() *sharedDownload {
+	j.sharedMu.Lock()
+	defer j.sharedMu.Unlock()
+	if j.shared == nil {
+		j.sharedGen++
+		ctx, cancel := context.WithCancel(context.Background())
+		j.shared = &sharedDownload{
+			key:    j.options.URI + "#" + strconv.FormatUint(j.sharedGen, 10),
+			ctx:    ctx,
+			cancel: cancel,
+		}
+	}
+	j.shared.waiters++
+	return j.shared
+}
+
+// leaveSharedDownload cancels the download once its last waiter is gone,
+// the next cache miss starting a new one.
+func (j *JWKClient) leaveSharedDownload(shared *sharedDownload) {
+	j.sharedMu.Lock()
+	defer j.sharedMu.Unlock()
+	shared.waiters--
+	if shared.waiters == 0 {
+		shared.cancel()
+		if j.shared == shared {
+			j.shared = nil
+		}
+	}
+}
+
+// endSharedDownload stops sharing the finished download,
+// the next cache miss starting a new one.
+func (j *JWKClient) endSharedDownload(shared *sharedDownload) {
+	j.sharedMu.Lock()
+	defer j.sharedMu.Unlock()
+	if j.shared == shared {
+		j.shared = nil
+	}
+}
+
+// refreshAhead refreshes the keys in background once the cached key
+// is past the refresh threshold of its max age. A single background
+// refresh runs at a time, and its failures are ignored: the key keeps
+// being served until its expiry, when it is downloaded synchronously.
+func (j *JWKClient) refreshAhead(ID string) {
+	keyCacher, ok := j.keyCacher.(KeyInfoCacher)
+	if !ok {
+		return
+	}
+	info, err := keyCacher.Info(ID)
+	if err != nil || info.ExpiresAt.IsZero() {
+		return
+	}
+
+	maxAge := info.ExpiresAt.Sub(info.AddedAt)
+	threshold := time.Duration(float64(maxAge) * j.options.RefreshAheadThreshold)
+	if j.cacherNow().Sub(info.AddedAt) < threshold {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&j.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&j.refreshing, 0)
+		j.refreshCached(context.Background(), ID)
+	}()
+}
+
+// refreshCached downloads the keys and adds again only the keys still
+// cached, along with the kid triggering the refresh, so that a cacher
+// bounded below the size of the JWKS does not evict them for the others.
+func (j *JWKClient) refreshCached(ctx context.Context, ID string) error {
+	keys, err := j.downloadKeysShared(ctx)
+	if err != nil {
+		return err
+	}
+
+	cached := map[string]bool{ID: true}
+	if keyCacher, ok := j.keyCacher.(InspectableKeyCacher); ok {
+		for _, keyID := range keyCacher.Keys() {
+			cached[keyID] = true
+		}
+	}
+	return j.storeKeys(keys, cached)
+}
+
+// cacherNow returns the current time of the clock of the key cacher,
+// to compare with the times it records, e.g. set with WithClock.
+func (j *JWKClient) cacherNow() time.Time {
+	if keyCacher, ok := j.keyCacher.(interface{ now() time.Time }); ok {
+		return keyCacher.now()
+	}
+	return time.Now()
+}
+
+// KeyRefresher is implemented by the secret providers
+// able to reload their keys on demand.
+type KeyRefresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// KeyIDRefresher is implemented by the secret providers able to
+// reload their keys on demand for a kid, unless known to be missing.
+type KeyIDRefresher interface {
+	RefreshKeyID(ctx context.Context, keyID string) error
+}
+
+// Refresh downloads the keys and adds all of them to the cache,
+// regardless of the keys already cached.
+func (j *JWKClient) Refresh(ctx context.Context) error {
+	keys, err := j.downloadKeysShared(ctx)
+	if err != nil {
+		return err
+	}
+	return j.storeKeys(keys, nil)
+}
 
-	return *searchedKey, nil
+// RefreshKeyID downloads the keys and adds all of them to the cache
+// like Refresh, unless the kid is remembered as missing for the
+// UnknownKeyTTL or the keys were downloaded within the
+// MinRefetchInterval, ErrNoKeyFound being returned then.
+func (j *JWKClient) RefreshKeyID(ctx context.Context, keyID string) error {
+	if j.isUnknownKey(keyID) || j.recentKeys() != nil {
+		return ErrNoKeyFound
+	}
+	return j.Refresh(ctx)
 }
 
-func (j *JWKClient) downloadKeys() ([]jose.JSONWebKey, error) {
-	req, err := http.NewRequest("GET", j.options.URI, new(bytes.Buffer))
+// storeKeys adds the keys to the cache, only those with a kid
+// within keep when not nil, the kids remembered as missing being forgotten.
+func (j *JWKClient) storeKeys(keys []jose.JSONWebKey, keep map[string]bool) error {
+	defer j.unlock(j.lock())
+
+	if j.options.MatchKeyThumbprints {
+		j.indexThumbprints(keys)
+	}
+	for _, key := range keys {
+		if j.unknownKeys != nil {
+			j.unknownKeys.forget(key.KeyID)
+		}
+		if keep != nil && !keep[key.KeyID] {
+			continue
+		}
+		if _, err := j.addKeys(key.KeyID, []jose.JSONWebKey{key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Warmup downloads the keys into the cache ahead of the first request,
+// e.g. before a readiness probe succeeds, so that it is a cache hit.
+// The download is retried like any other and is cancelled with the context,
+// unless shared with concurrent cache misses still waiting for it.
+// A memory key cacher bounded below the size of the JWKS is only warmed
+// with the first keys of the JWKS, up to its max size.
+func (j *JWKClient) Warmup(ctx context.Context) error {
+	keys, err := j.downloadKeysShared(ctx)
 	if err != nil {
+		return err
+	}
+	return j.storeKeys(keys, j.warmupKeyIDs(keys))
+}
+
+// warmupKeyIDs returns the kids of the first keys fitting in the
+// key cacher when it is bounded, or nil to warm all the keys.
+func (j *JWKClient) warmupKeyIDs(keys []jose.JSONWebKey) map[string]bool {
+	keyCacher, ok := j.keyCacher.(interface{ capacity() int })
+	if !ok {
+		return nil
+	}
+	capacity := keyCacher.capacity()
+	if capacity == MaxCacheSizeNoCheck || capacity >= len(keys) {
+		return nil
+	}
+
+	keep := make(map[string]bool, capacity)
+	for _, key := range keys[:capacity] {
+		keep[key.KeyID] = true
+	}
+	return keep
+}
+
+// downloadKeysWithGrace downloads the keys, retrying a failed download
+// until it succeeds or the download grace or the context deadline is reached.
+// The downloaded keys are remembered for the MinRefetchInterval, and
+// returned without the keys for encryption.
+func (j *JWKClient) downloadKeysWithGrace(ctx context.Context) ([]jose.JSONWebKey, error) {
+	if j.options.OfflineOnly {
+		return nil, ErrOfflineKeyMissing
+	}
+	j.options.Logger.Debugf("downloading the keys from %s", j.options.URI)
+	start := time.Now()
+	keys, err := j.downloadKeysOrRetry(ctx)
+	if err != nil {
+		j.options.Logger.Errorf("downloading the keys from %s failed after %s: %v", j.options.URI, time.Since(start), err)
+		return keys, err
+	}
+	j.options.Logger.Debugf("downloaded %d keys from %s in %s", len(keys), j.options.URI, time.Since(start))
+	j.storeLastKeys(keys)
+	j.diffKeyIDs(keys)
+	return verificationKeys(keys), nil
+}
+
+// verificationKeys returns the keys which can verify signatures,
+// the keys declared for encryption with a "use" of "enc" being dropped.
+func verificationKeys(keys []jose.JSONWebKey) []jose.JSONWebKey {
+	filtered := make([]jose.JSONWebKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Use != "enc" {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+// diffKeyIDs logs and calls OnKeysChanged with the sorted kids
+// added and removed since the previous download.
+func (j *JWKClient) diffKeyIDs(keys []jose.JSONWebKey) {
+	keyIDs := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		keyIDs[key.KeyID] = true
+	}
+
+	j.keyIDsMu.Lock()
+	previous := j.keyIDs
+	j.keyIDs = keyIDs
+	j.keyIDsMu.Unlock()
+	if previous == nil {
+		return
+	}
+
+	var added, removed []string
+	for keyID := range keyIDs {
+		if !previous[keyID] {
+			added = append(added, keyID)
+		}
+	}
+	for keyID := range previous {
+		if !keyIDs[keyID] {
+			removed = append(removed, keyID)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		j.options.Logger.Debugf("keys of %s changed, added %v, removed %v", j.options.URI, added, removed)
+		if j.options.OnKeysChanged != nil {
+			j.options.OnKeysChanged(added, removed)
+		}
+	}
+}
+
+// downloadKeysOrRetry downloads the keys, retrying a failed download
+// with the retry policy if any, or a few times during the grace.
+func (j *JWKClient) downloadKeysOrRetry(ctx context.Context) ([]jose.JSONWebKey, error) {
+	if j.options.RetryPolicy != nil {
+		return j.downloadKeysWithRetry(ctx, *j.options.RetryPolicy)
+	}
+
+	keys, err := j.downloadKeys(ctx)
+	if err == nil || j.options.DownloadGrace <= 0 {
+		return keys, err
+	}
+
+	graceCtx, cancel := context.WithTimeout(ctx, j.options.DownloadGrace)
+	defer cancel()
+
+	ticker := time.NewTicker(j.options.DownloadGrace / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-graceCtx.Done():
+			return keys, err
+		case <-ticker.C:
+			if keys, err = j.downloadKeys(ctx); err == nil {
+				return keys, nil
+			}
+		}
+	}
+}
+
+// downloadKeysWithRetry downloads the keys, retrying a failed download
+// with the backoff of the policy until it succeeds, the attempts are
+// exhausted or the download grace or the context deadline is reached.
+func (j *JWKClient) downloadKeysWithRetry(ctx context.Context, policy RetryPolicy) ([]jose.JSONWebKey, error) {
+	graceCtx := ctx
+	if j.options.DownloadGrace > 0 {
+		var cancel context.CancelFunc
+		graceCtx, cancel = context.WithTimeout(ctx, j.options.DownloadGrace)
+		defer cancel()
+	}
+
+	keys, err := j.downloadKeys(ctx)
+	if err == nil {
+		return keys, nil
+	}
+	attempts := []error{err}
+	for retry := 0; retryable(err) && retry+1 < policy.MaxAttempts; retry++ {
+		timer := time.NewTimer(policy.delay(retry))
+		select {
+		case <-graceCtx.Done():
+			timer.Stop()
+			return keys, &RetryError{Attempts: attempts}
+		case <-timer.C:
+		}
+		if keys, err = j.downloadKeys(ctx); err == nil {
+			return keys, nil
+		}
+		attempts = append(attempts, err)
+	}
+	return keys, &RetryError{Attempts: attempts}
+}
+
+func (j *JWKClient) downloadKeys(ctx context.Context) ([]jose.JSONWebKey, error) {
+	uri, err := j.jwksURI(ctx)
+	if err != nil {
+		return []jose.JSONWebKey{}, err
+	}
+	if err := j.checkURI(uri); err != nil {
 		return []jose.JSONWebKey{}, err
 	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, new(bytes.Buffer))
+	if err != nil {
+		return []jose.JSONWebKey{}, err
+	}
+	for name, values := range j.options.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	etag, etagKeys := j.lastETag()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if j.options.RequestModifier != nil {
+		j.options.RequestModifier(req)
+	}
 	resp, err := j.options.Client.Do(req)
 
 	if err != nil {
@@ -94,32 +919,328 @@ func (j *JWKClient) downloadKeys() ([]jose.JSONWebKey, error) {
 	}
 	defer resp.Body.Close()
 
-	if contentH := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentH, "application/json") &&
-		!strings.HasPrefix(contentH, "application/jwk-set+json") {
-		return []jose.JSONWebKey{}, ErrInvalidContentType
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		j.storeMaxAge(resp.Header)
+		return etagKeys, nil
+	}
+	contentH := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK {
+		return []jose.JSONWebKey{}, &JWKSStatusError{
+			StatusCode:  resp.StatusCode,
+			ContentType: contentH,
+			Body:        bodySnippet(resp.Body),
+		}
 	}
 
-	var jwks = JWKS{}
-	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if !strings.HasPrefix(contentH, "application/json") &&
+		!strings.HasPrefix(contentH, "application/jwk-set+json") {
+		return []jose.JSONWebKey{}, fmt.Errorf("%w: %s", ErrInvalidContentType,
+			describeResponse(resp.StatusCode, contentH, bodySnippet(resp.Body)))
+	}
 
+	jwks, err := decodeJWKS(resp.Body)
 	if err != nil {
 		return []jose.JSONWebKey{}, err
 	}
 
 	if len(jwks.Keys) < 1 {
-		return []jose.JSONWebKey{}, ErrNoKeyFound
+		return []jose.JSONWebKey{}, ErrEmptyJWKS
 	}
 
+	j.storeETag(resp.Header.Get("ETag"), jwks.Keys)
+	j.storeMaxAge(resp.Header)
 	return jwks.Keys, nil
 }
 
+// lastETag returns the ETag of the last downloaded key set
+// along with a copy of its keys.
+func (j *JWKClient) lastETag() (string, []jose.JSONWebKey) {
+	j.etagMu.Lock()
+	defer j.etagMu.Unlock()
+	return j.etag, append([]jose.JSONWebKey(nil), j.etagKeys...)
+}
+
+// storeETag remembers the ETag of the downloaded key set, so that
+// the next download is conditional. The cached keys being re-added on
+// a 304 Not Modified, their max age starts again without a transfer.
+func (j *JWKClient) storeETag(etag string, keys []jose.JSONWebKey) {
+	j.etagMu.Lock()
+	defer j.etagMu.Unlock()
+	j.etag = etag
+	j.etagKeys = nil
+	if etag != "" {
+		j.etagKeys = append([]jose.JSONWebKey(nil), keys...)
+	}
+}
+
+// maxBodySnippet bounds the length of the
+// response quoted by the download errors.
+const maxBodySnippet = 200
+
+// bodySnippet reads the beginning of an unexpected response.
+func bodySnippet(r io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(r, maxBodySnippet+1))
+	if len(data) > maxBodySnippet {
+		return strings.TrimSpace(string(data[:maxBodySnippet])) + "..."
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// describeResponse describes an unexpected response of the JWKS
+// endpoint, e.g. "JWKS endpoint returned 404 text/html: <html>...".
+func describeResponse(status int, contentType, body string) string {
+	description := fmt.Sprintf("JWKS endpoint returned %d", status)
+	if contentType != "" {
+		description += " " + contentType
+	}
+	if body != "" {
+		description += ": " + body
+	}
+	return description
+}
+
+// decodeJWKS decodes a key set, normalizing the numeric kids emitted
+// by some providers to their string form so that they match the kid of
+// the tokens. Kids being opaque identifiers, "kid": 3 matches "kid": "3".
+// Only the key set is normalized: a numeric kid in the header of a token
+// is rejected by go-jose when the token is parsed, and cannot be rewritten
+// before as the header is covered by the signature.
+func decodeJWKS(r io.Reader) (JWKS, error) {
+	var raw struct {
+		Keys []map[string]json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return JWKS{}, err
+	}
+
+	jwks := JWKS{Keys: make([]jose.JSONWebKey, 0, len(raw.Keys))}
+	for _, fields := range raw.Keys {
+		if kid, ok := fields["kid"]; ok {
+			var number json.Number
+			if err := json.Unmarshal(kid, &number); err == nil {
+				fields["kid"], _ = json.Marshal(number.String())
+			}
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return JWKS{}, err
+		}
+		var key jose.JSONWebKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return JWKS{}, err
+		}
+		jwks.Keys = append(jwks.Keys, key)
+	}
+	return jwks, nil
+}
+
+// jwksURI returns the URI to download the keys from, the one of
+// the discovery document when created from a DiscoveryClient.
+func (j *JWKClient) jwksURI(ctx context.Context) (string, error) {
+	if j.discovery == nil {
+		return j.options.URI, nil
+	}
+	document, err := j.discovery.Document(ctx)
+	if err != nil {
+		return "", err
+	}
+	return document.JWKSURI, nil
+}
+
+// checkURI ensures the keys are downloaded over TLS
+// unless insecure URIs have been explicitly allowed.
+func (j *JWKClient) checkURI(uri string) error {
+	if j.options.AllowInsecureJWKS {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(u.Scheme, "https") {
+		return ErrInsecureJWKSURI
+	}
+	return nil
+}
+
 // GetSecret implements the GetSecret method of the SecretProvider interface.
+// The key is resolved by kid and must be compatible with the algorithm of
+// the token: a key without alg is compatible with the algorithms of its key
+// type, and a RSA key declared for RS256 also verifies PS256 tokens.
 func (j *JWKClient) GetSecret(token *jwt.JSONWebToken) (interface{}, error) {
+	return j.GetSecretContext(context.Background(), token)
+}
+
+// GetSecretContext returns the key of the token like GetSecret,
+// cancelling its download when the context is done.
+func (j *JWKClient) GetSecretContext(ctx context.Context, token *jwt.JSONWebToken) (interface{}, error) {
 	if len(token.Headers) < 1 {
 		return nil, ErrNoJWTHeaders
 	}
 
 	header := token.Headers[0]
 
-	return j.GetKey(header.KeyID)
+	key, err := j.resolveKey(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !keyAllowsAlgorithm(key, header.Algorithm) {
+		var ok bool
+		if key, ok = j.lastKeyForAlgorithm(header.KeyID, header.Algorithm); !ok {
+			return nil, ErrInvalidAlgorithm
+		}
+	}
+	if j.options.VerifyX5C {
+		if err := verifyCertificates(key, header, j.options.X5CRoots); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (j *JWKClient) resolveKey(ctx context.Context, token *jwt.JSONWebToken) (jose.JSONWebKey, error) {
+	header := token.Headers[0]
+
+	if header.KeyID == "" && j.options.SoleKeyFallback {
+		return j.soleKey(ctx)
+	}
+
+	if j.options.MatchKeyThumbprints {
+		if key, err := j.keyCacher.Get(header.KeyID); err == nil {
+			return *key, nil
+		}
+		if j.isUnknownKey(header.KeyID) {
+			return jose.JSONWebKey{}, ErrNoKeyFound
+		}
+		if key, ok := j.keyByThumbprint(token); ok {
+			return key, nil
+		}
+	}
+
+	return j.GetKeyContext(ctx, header.KeyID)
+}
+
+// lastKeyForAlgorithm looks in the key set last downloaded for a key with
+// the kid which can verify the algorithm, when several keys share the kid
+// and the cached one cannot, e.g. a "sig" key declared for another alg.
+// The keys with a "use" of "sig" are preferred.
+func (j *JWKClient) lastKeyForAlgorithm(keyID, alg string) (jose.JSONWebKey, bool) {
+	j.lastMu.Lock()
+	defer j.lastMu.Unlock()
+
+	var found jose.JSONWebKey
+	ok := false
+	for _, key := range verificationKeys(j.lastKeys) {
+		if key.KeyID != keyID || !keyAllowsAlgorithm(key, alg) {
+			continue
+		}
+		if key.Use == "sig" {
+			return key, true
+		}
+		if !ok {
+			found, ok = key, true
+		}
+	}
+	return found, ok
+}
+
+// keyAllowsAlgorithm reports whether the key can verify tokens signed
+// with the algorithm. The alg of a JWK being optional, a key without alg
+// is compatible with the algorithms of its key type. The material of a RSA
+// key being the same for all the RSA algorithms, a RSA key declared for
+// one of them is compatible with the others.
+func keyAllowsAlgorithm(key jose.JSONWebKey, alg string) bool {
+	if !keyTypeAllowsAlgorithm(key.Key, alg) {
+		return false
+	}
+	if key.Algorithm == "" || key.Algorithm == alg {
+		return true
+	}
+	return isRSAAlgorithm(key.Algorithm) && isRSAAlgorithm(alg)
+}
+
+// keyTypeAllowsAlgorithm reports whether the key material matches the
+// family of the algorithm. Other key types are left to go-jose.
+func keyTypeAllowsAlgorithm(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		return isRSAAlgorithm(alg)
+	case *ecdsa.PublicKey, *ecdsa.PrivateKey:
+		return strings.HasPrefix(alg, "ES")
+	case []byte:
+		return strings.HasPrefix(alg, "HS")
+	}
+	return true
+}
+
+// isRSAAlgorithm reports whether the algorithm is a RSA signature
+// algorithm, the RSA encryption ones such as RSA-OAEP being excluded.
+func isRSAAlgorithm(alg string) bool {
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		return true
+	}
+	return false
+}
+
+// lock acquires the client lock. The time waited is only
+// measured when a lock observer is set.
+func (j *JWKClient) lock() (acquired time.Time, wait time.Duration) {
+	if j.options.LockObserver == nil {
+		j.mu.Lock()
+		return time.Time{}, 0
+	}
+	start := time.Now()
+	j.mu.Lock()
+	acquired = time.Now()
+	return acquired, acquired.Sub(start)
+}
+
+// unlock releases the client lock and reports
+// its durations to the lock observer.
+func (j *JWKClient) unlock(acquired time.Time, wait time.Duration) {
+	j.mu.Unlock()
+	if j.options.LockObserver != nil {
+		j.options.LockObserver(wait, time.Since(acquired))
+	}
+}
+
+// indexThumbprints replaces the thumbprint index with the
+// material of the downloaded keys. Must be called with the lock held.
+func (j *JWKClient) indexThumbprints(keys []jose.JSONWebKey) {
+	j.thumbprints = make(map[string]jose.JSONWebKey, len(keys))
+	for _, key := range keys {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			continue
+		}
+		j.thumbprints[string(thumbprint)] = key
+	}
+}
+
+// keyByThumbprint looks for the indexed key material which signed the token.
+// When found, the key is cached under the kid of the token. The signature
+// is verified against the indexed keys without holding the lock.
+func (j *JWKClient) keyByThumbprint(token *jwt.JSONWebToken) (jose.JSONWebKey, bool) {
+	acquired, wait := j.lock()
+	candidates := make([]jose.JSONWebKey, 0, len(j.thumbprints))
+	for _, key := range j.thumbprints {
+		candidates = append(candidates, key)
+	}
+	j.unlock(acquired, wait)
+
+	keyID := token.Headers[0].KeyID
+	for _, key := range candidates {
+		if err := token.Claims(key); err != nil {
+			continue
+		}
+		key.KeyID = keyID
+		defer j.unlock(j.lock())
+		addedKey, err := j.addKeys(keyID, []jose.JSONWebKey{key})
+		if err != nil {
+			return key, true
+		}
+		return *addedKey, true
+	}
+	return jose.JSONWebKey{}, false
 }
@@ -0,0 +1,74 @@
+package auth0
+
+import (
+	"net/http"
+	"sync"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// URIResolver returns the JWKS URI of the request, e.g. the one of the
+// Auth0 domain of its tenant. It must only return trusted URIs.
+type URIResolver func(r *http.Request) (string, error)
+
+// JWKClientSet routes the resolution of the key to a JWK client for
+// the JWKS URI of the request, each with its own cache, so that a
+// single validator serves the tenants of several Auth0 domains.
+// It implements RequestSecretProvider: a token validated or whose
+// claims are read without its request is rejected with ErrNilRequest.
+type JWKClientSet struct {
+	resolver URIResolver
+	options  JWKClientOptions
+	mu       sync.Mutex
+	clients  map[string]*JWKClient
+}
+
+// NewJWKClientSet creates a new JWKClientSet instance from the URI
+// resolver and the options of the JWK clients, their URI being overridden.
+func NewJWKClientSet(resolver URIResolver, options JWKClientOptions) *JWKClientSet {
+	return &JWKClientSet{
+		resolver: resolver,
+		options:  options,
+		clients:  map[string]*JWKClient{},
+	}
+}
+
+// GetSecret implements the GetSecret method of the SecretProvider interface.
+// The JWKS URI being resolved from the request, it fails with ErrNilRequest.
+func (s *JWKClientSet) GetSecret(token *jwt.JSONWebToken) (interface{}, error) {
+	return nil, ErrNilRequest
+}
+
+// GetRequestSecret implements the RequestSecretProvider interface,
+// the download of the keys being cancelled with the request.
+func (s *JWKClientSet) GetRequestSecret(r *http.Request, token *jwt.JSONWebToken) (interface{}, error) {
+	client, err := s.Client(r)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetSecretContext(r.Context(), token)
+}
+
+// Client returns the JWK client of the JWKS URI of the request,
+// creating it on the first request for this URI.
+func (s *JWKClientSet) Client(r *http.Request) (*JWKClient, error) {
+	if r == nil {
+		return nil, ErrNilRequest
+	}
+	uri, err := s.resolver(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clients[uri]
+	if !ok {
+		options := s.options
+		options.URI = uri
+		client = NewJWKClient(options, nil)
+		s.clients[uri] = client
+	}
+	return client, nil
+}
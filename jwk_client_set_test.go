@@ -0,0 +1,77 @@
+package auth0
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestJWKClientSet(t *testing.T) {
+	keyA := genRSASSAJWK(jose.RS256, "key")
+	keyB := genRSASSAJWK(jose.RS256, "key")
+	jwksServer := func(key jose.JSONWebKey) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+		}))
+	}
+	tsA, tsB := jwksServer(keyA), jwksServer(keyB)
+	defer tsA.Close()
+	defer tsB.Close()
+
+	errUnknownTenant := errors.New("unknown tenant")
+	tenants := map[string]string{"a": tsA.URL, "b": tsB.URL}
+	set := NewJWKClientSet(func(r *http.Request) (string, error) {
+		uri, ok := tenants[r.Header.Get("X-Tenant")]
+		if !ok {
+			return "", errUnknownTenant
+		}
+		return uri, nil
+	}, JWKClientOptions{AllowInsecureJWKS: true})
+	validator := NewValidator(NewConfiguration(set, defaultAudience, defaultIssuer, jose.RS256), nil)
+
+	request := func(tenant string, key jose.JSONWebKey) *http.Request {
+		raw := getTestTokenWithClaims(jwt.Claims{
+			Issuer:   defaultIssuer,
+			Audience: defaultAudience,
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}, jose.RS256, key)
+		r, _ := http.NewRequest("GET", "http://localhost", nil)
+		r.Header.Set("Authorization", "Bearer "+raw)
+		r.Header.Set("X-Tenant", tenant)
+		return r
+	}
+
+	_, err := validator.ValidateRequest(request("a", keyA))
+	assert.NoError(t, err)
+	_, err = validator.ValidateRequest(request("b", keyB))
+	assert.NoError(t, err)
+	detailed, err := validator.ValidateRequestDetailed(request("b", keyB))
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultIssuer, detailed.Claims["iss"])
+	}
+
+	// Each tenant only accepts the keys of its own JWKS.
+	_, err = validator.ValidateRequest(request("a", keyB))
+	assert.True(t, errors.Is(err, jose.ErrCryptoFailure), "unexpected error: %v", err)
+	_, err = validator.ValidateRequest(request("c", keyA))
+	assert.Equal(t, errUnknownTenant, err)
+
+	clientA, err := set.Client(request("a", keyA))
+	assert.NoError(t, err)
+	clientB, err := set.Client(request("b", keyB))
+	assert.NoError(t, err)
+	assert.True(t, clientA.keyCacher != clientB.keyCacher, "each URI should have its own cache")
+
+	// Without its request the JWKS URI of a token cannot be resolved.
+	token, err := jwt.ParseSigned(getTestTokenWithClaims(jwt.Claims{Issuer: defaultIssuer}, jose.RS256, keyA))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrNilRequest, validator.ValidateToken(token))
+}
@@ -1,12 +1,17 @@
 package auth0
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/square/go-jose.v2/jwt"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -47,6 +52,10 @@ func (mockKC *mockKeyCacher) Add(keyID string, webKeys []jose.JSONWebKey) (*jose
 	return nil, ErrNoKeyFound
 }
 
+func (mockKC *mockKeyCacher) Remove(keyID string) error {
+	return nil
+}
+
 func TestJWKDownloadKeySuccess(t *testing.T) {
 	opts, tokenRS256, tokenES384, err := genNewTestServer(true)
 	if err != nil {
@@ -55,7 +64,7 @@ func TestJWKDownloadKeySuccess(t *testing.T) {
 	}
 	client := NewJWKClient(opts, nil)
 
-	keys, err := client.downloadKeys()
+	keys, err := client.downloadKeys(context.Background())
 	if err != nil || len(keys) < 1 {
 		t.Errorf("The keys should have been correctly received: %v", err)
 		t.FailNow()
@@ -73,7 +82,7 @@ func TestJWKDownloadKeyBadRequest(t *testing.T) {
 	opts := JWKClientOptions{URI: "\t.://"}
 	client := NewJWKClient(opts, nil)
 
-	keys, err := client.downloadKeys()
+	keys, err := client.downloadKeys(context.Background())
 	assert.Error(t, err)
 	assert.Empty(t, keys)
 }
@@ -82,7 +91,7 @@ func TestJWKDownloadKeyFailed(t *testing.T) {
 	opts := JWKClientOptions{URI: "invalidURI"}
 	client := NewJWKClient(opts, nil)
 
-	keys, err := client.downloadKeys()
+	keys, err := client.downloadKeys(context.Background())
 	assert.Error(t, err)
 	assert.Empty(t, keys)
 }
@@ -92,8 +101,7 @@ func TestJWKDownloadKeyNoKeys(t *testing.T) {
 	client := NewJWKClient(opts, nil)
 
 	_, err = client.GetSecret(tokenES384)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "no Keys has been found")
+	assert.Equal(t, ErrEmptyJWKS, err)
 }
 
 func TestJWKDownloadKeyNotFound(t *testing.T) {
@@ -118,13 +126,16 @@ func TestJWKDownloadKeyInvalid(t *testing.T) {
 		fmt.Fprintln(w, "Invalid Data")
 	}))
 
-	opts := JWKClientOptions{URI: ts.URL}
+	opts := JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}
 	client := NewJWKClient(opts, nil)
 
-	_, err := client.downloadKeys()
-	if err != ErrInvalidContentType {
+	_, err := client.downloadKeys(context.Background())
+	if !errors.Is(err, ErrInvalidContentType) {
 		t.Errorf("An ErrInvalidContentType should be returned in case of invalid Content-Type Header.")
 	}
+	if err == nil || !strings.Contains(err.Error(), "JWKS endpoint returned 200 text/plain; charset=utf-8: Invalid Data") {
+		t.Errorf("The error should describe the response, got %v.", err)
+	}
 
 	// Invalid Payload
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,10 +143,10 @@ func TestJWKDownloadKeyInvalid(t *testing.T) {
 		fmt.Fprintln(w, "Invalid Data")
 	}))
 
-	opts = JWKClientOptions{URI: ts.URL}
+	opts = JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}
 	client = NewJWKClient(opts, nil)
 
-	_, err = client.downloadKeys()
+	_, err = client.downloadKeys(context.Background())
 	if err == nil {
 		t.Errorf("An non JSON payload should return an error.")
 	}
@@ -279,3 +290,1218 @@ func (m *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 	atomic.AddUint64(m.ops, 1)
 	return m.rt.RoundTrip(req)
 }
+
+func TestJWKClientDownloadGrace(t *testing.T) {
+	opts, tokenRS256, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var counter uint64
+	upstream := opts.URI
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint64(&counter, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, upstream, http.StatusFound)
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, err = client.GetSecret(tokenRS256)
+	assert.Error(t, err, "the failed download should be surfaced without grace")
+
+	atomic.StoreUint64(&counter, 0)
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, DownloadGrace: time.Second}, nil)
+	testGetSecret(t, client, tokenRS256)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+}
+
+func TestJWKClientDownloadErrorPage(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Not Found ", 50) + "</body></html>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, page)
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, err := client.GetKey("keyRS256")
+	assert.True(t, errors.Is(err, ErrJWKSStatus))
+	assert.Equal(t, &JWKSStatusError{
+		StatusCode:  http.StatusNotFound,
+		ContentType: "text/html",
+		Body:        page[:maxBodySnippet] + "...",
+	}, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "JWKS endpoint returned 404 text/html: <html><body>Not Found"))
+}
+
+func TestJWKClientDownloadGraceExceeded(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, DownloadGrace: 100 * time.Millisecond}, nil)
+
+	start := time.Now()
+	_, err := client.GetKey("keyRS256")
+	assert.Equal(t, &JWKSStatusError{StatusCode: http.StatusServiceUnavailable}, err)
+	assert.True(t, time.Since(start) < time.Second, "the grace should bound the wait")
+}
+
+func TestJWKClientRequireTLS(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	})
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	tlsTS := httptest.NewTLSServer(handler)
+	defer tlsTS.Close()
+
+	tests := []struct {
+		name        string
+		options     JWKClientOptions
+		expectedErr error
+	}{
+		{
+			name:        "fail - http URI",
+			options:     JWKClientOptions{URI: ts.URL},
+			expectedErr: ErrInsecureJWKSURI,
+		},
+		{
+			name:    "pass - https URI",
+			options: JWKClientOptions{URI: tlsTS.URL, Client: tlsTS.Client()},
+		},
+		{
+			name:    "pass - http URI allowed as insecure",
+			options: JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := NewJWKClient(test.options, nil)
+			_, err := client.GetKey("keyRS256")
+			assert.Equal(t, test.expectedErr, err)
+		})
+	}
+}
+
+func TestJWKClientMatchKeyThumbprints(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "old")
+
+	var counter uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&counter, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+
+	oldToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, jsonWebKeyRS256, "old")
+	newToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, jsonWebKeyRS256, "new")
+	otherToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, genRSASSAJWK(jose.RS256, "other"), "other")
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, MatchKeyThumbprints: true}, nil)
+
+	testGetSecret(t, client, oldToken)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&counter))
+
+	// The kid changed but the key material is the same.
+	testGetSecret(t, client, newToken)
+	testGetSecret(t, client, newToken)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&counter))
+
+	// Another key material is still downloaded.
+	_, err := client.GetSecret(otherToken)
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+
+	// A kid known to be missing is not matched against the index again.
+	var locks uint64
+	client = NewJWKClient(JWKClientOptions{
+		URI:                 ts.URL,
+		AllowInsecureJWKS:   true,
+		MatchKeyThumbprints: true,
+		UnknownKeyTTL:       time.Hour,
+		LockObserver:        func(wait, hold time.Duration) { atomic.AddUint64(&locks, 1) },
+	}, nil)
+	testGetSecret(t, client, oldToken)
+	_, err = client.GetSecret(otherToken)
+	assert.Equal(t, ErrNoKeyFound, err)
+	atomic.StoreUint64(&locks, 0)
+	_, err = client.GetSecret(otherToken)
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&locks), "the index should not be scanned")
+
+	// Without the thumbprint index the new kid is downloaded.
+	atomic.StoreUint64(&counter, 0)
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	testGetSecret(t, client, oldToken)
+	_, err = client.GetSecret(newToken)
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&counter))
+}
+
+func TestJWKClientRSAKeySharedByAlgorithms(t *testing.T) {
+	sharedKey := genRSASSAJWK(jose.RS256, "shared")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{sharedKey.Public()}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	validator := NewValidator(NewConfigurationTrustProvider(client, defaultAudience, defaultIssuer), nil)
+
+	for _, alg := range []jose.SignatureAlgorithm{jose.RS256, jose.PS256} {
+		token := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), alg, sharedKey, "shared")
+		assert.NoError(t, validator.ValidateToken(token), string(alg))
+	}
+}
+
+func TestJWKClientLockObserver(t *testing.T) {
+	opts, tokenRS256, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var mu sync.Mutex
+	var waits, holds []time.Duration
+	opts.LockObserver = func(wait, hold time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		waits = append(waits, wait)
+		holds = append(holds, hold)
+	}
+	// Every call misses the cache and fills it under the lock.
+	client := NewJWKClientWithCache(opts, nil, newMockKeyCacher(ErrNoKeyFound, nil, "keyRS256"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.GetSecret(tokenRS256)
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, holds, 5) {
+		for i := range holds {
+			assert.True(t, waits[i] >= 0 && waits[i] < 10*time.Second, "plausible wait %v", waits[i])
+			assert.True(t, holds[i] > 0 && holds[i] < 10*time.Second, "plausible hold %v", holds[i])
+		}
+	}
+}
+
+func TestJWKClientRetryPolicy(t *testing.T) {
+	opts, tokenRS256, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var counter uint64
+	upstream := opts.URI
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint64(&counter, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, upstream, http.StatusFound)
+	}))
+	defer ts.Close()
+
+	policy := &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, RetryPolicy: policy}, nil)
+	_, err = client.GetSecret(tokenRS256)
+	var retryErr *RetryError
+	if assert.True(t, errors.As(err, &retryErr), "the attempts should be exhausted") {
+		assert.Len(t, retryErr.Attempts, 3)
+	}
+	assert.True(t, errors.Is(err, ErrJWKSStatus))
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&counter))
+
+	testGetSecret(t, client, tokenRS256)
+	assert.Equal(t, uint64(4), atomic.LoadUint64(&counter))
+}
+
+func TestJWKClientRetryPolicyPermanentFailure(t *testing.T) {
+	var counter uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&counter, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	policy := &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, RetryPolicy: policy}, nil)
+	_, err := client.GetKey("keyRS256")
+	assert.Equal(t, &RetryError{Attempts: []error{&JWKSStatusError{StatusCode: http.StatusNotFound}}}, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&counter), "a 4xx should not be retried")
+}
+
+func TestJWKClientNumericKeyID(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "3")
+	jsonWebKeyES384 := genECDSAJWK(jose.ES384, "4")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]interface{}{}
+		for _, key := range []jose.JSONWebKey{jsonWebKeyRS256.Public(), jsonWebKeyES384.Public()} {
+			data, _ := key.MarshalJSON()
+			fields := map[string]interface{}{}
+			json.Unmarshal(data, &fields)
+			keys = append(keys, fields)
+		}
+		// The first key has a numeric kid, the second a string one.
+		keys[0]["kid"] = 3
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	for _, token := range []*jwt.JSONWebToken{
+		getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, jsonWebKeyRS256, "3"),
+		getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.ES384, jsonWebKeyES384, "4"),
+	} {
+		key, err := client.GetSecret(token)
+		assert.NoError(t, err)
+		assert.Equal(t, token.Headers[0].KeyID, key.(jose.JSONWebKey).KeyID)
+		assert.NoError(t, token.Claims(key, &jwt.Claims{}))
+	}
+
+	// Only the kids of the key set are normalized: a numeric kid in the
+	// signed header of the token itself is rejected when parsed.
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jsonWebKeyRS256}, &jose.SignerOptions{ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": 3}})
+	assert.NoError(t, err)
+	raw, err := jwt.Signed(signer).Claims(jwt.Claims{Issuer: defaultIssuer}).CompactSerialize()
+	assert.NoError(t, err)
+	_, err = jwt.ParseSigned(raw)
+	assert.Error(t, err)
+}
+
+func TestJWKClientUnknownKeys(t *testing.T) {
+	opts, _, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var downloads uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &downloads, rt: http.DefaultTransport}}
+	opts.UnknownKeyTTL = time.Hour
+	opts.MaxUnknownKeys = 10
+	client := NewJWKClient(opts, nil)
+
+	// Flooding random kids keeps the unknown kids within their bound.
+	for i := 0; i < 100; i++ {
+		_, err := client.GetKey(strconv.Itoa(rand.Int()))
+		assert.Equal(t, ErrNoKeyFound, err)
+	}
+	assert.Equal(t, 10, client.unknownKeys.len())
+	assert.Equal(t, uint64(100), atomic.LoadUint64(&downloads))
+
+	// A remembered unknown kid is rejected without downloading the keys.
+	_, err = client.GetKey("unknown")
+	assert.Equal(t, ErrNoKeyFound, err)
+	_, err = client.GetKey("unknown")
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(101), atomic.LoadUint64(&downloads))
+
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+}
+
+func TestJWKClientKeyWithoutAlgorithm(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "keyRS256")
+	publicKey := key.Public()
+	publicKey.Algorithm = ""
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{publicKey}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	validator := NewValidator(NewConfiguration(client, defaultAudience, defaultIssuer, jose.RS256), nil)
+
+	token := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, key, "keyRS256")
+	assert.NoError(t, validator.ValidateToken(token))
+}
+
+func TestKeyAllowsAlgorithm(t *testing.T) {
+	rsaPrivateKey := genRSASSAJWK(jose.RS256, "rsa")
+	rsaKey := rsaPrivateKey.Public()
+	ecPrivateKey := genECDSAJWK(jose.ES384, "ec")
+	ecKey := ecPrivateKey.Public()
+	withAlg := func(key jose.JSONWebKey, alg string) jose.JSONWebKey {
+		key.Algorithm = alg
+		return key
+	}
+	withoutAlg := func(key jose.JSONWebKey) jose.JSONWebKey {
+		return withAlg(key, "")
+	}
+
+	tests := []struct {
+		name     string
+		key      jose.JSONWebKey
+		alg      jose.SignatureAlgorithm
+		expected bool
+	}{
+		{name: "declared algorithm", key: rsaKey, alg: jose.RS256, expected: true},
+		{name: "RSA key declared for another RSA algorithm", key: rsaKey, alg: jose.PS256, expected: true},
+		{name: "RSA key for an EC algorithm", key: rsaKey, alg: jose.ES256},
+		{name: "RSA key declared for RSA-OAEP", key: withAlg(rsaKey, string(jose.RSA_OAEP)), alg: jose.RS256},
+		{name: "RSA key declared for RSA1_5", key: withAlg(rsaKey, string(jose.RSA1_5)), alg: jose.PS256},
+		{name: "EC key declared for another EC algorithm", key: ecKey, alg: jose.ES256},
+		{name: "RSA key without alg", key: withoutAlg(rsaKey), alg: jose.RS256, expected: true},
+		{name: "EC key without alg", key: withoutAlg(ecKey), alg: jose.ES384, expected: true},
+		{name: "RSA key without alg for an EC algorithm", key: withoutAlg(rsaKey), alg: jose.ES256},
+		{name: "EC key without alg for a HMAC algorithm", key: withoutAlg(ecKey), alg: jose.HS256},
+		{name: "symmetric key without alg", key: jose.JSONWebKey{Key: []byte("secret")}, alg: jose.HS256, expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, keyAllowsAlgorithm(test.key, string(test.alg)))
+		})
+	}
+}
+
+func TestJWKClientOfflineOnly(t *testing.T) {
+	opts, tokenRS256, tokenES384, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// Seed the cache with the RS256 key only.
+	seeder := NewJWKClient(opts, nil)
+	seeded, err := seeder.GetKey("keyRS256")
+	assert.NoError(t, err)
+	keyCacher := NewMemoryKeyCacher(MaxKeyAgeNoCheck, MaxCacheSizeNoCheck)
+	_, err = keyCacher.Add("keyRS256", []jose.JSONWebKey{seeded})
+	assert.NoError(t, err)
+
+	var requests uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &requests, rt: http.DefaultTransport}}
+	opts.OfflineOnly = true
+	opts.DownloadGrace = time.Second
+	client := NewJWKClientWithCache(opts, nil, keyCacher)
+
+	testGetSecret(t, client, tokenRS256)
+
+	_, err = client.GetSecret(tokenES384)
+	assert.Equal(t, ErrOfflineKeyMissing, err)
+	assert.Equal(t, ErrOfflineKeyMissing, client.Refresh(context.Background()))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&requests), "no request should be made in offline mode")
+}
+
+func TestJWKClientRefreshAhead(t *testing.T) {
+	opts, _, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var downloads uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &downloads, rt: http.DefaultTransport}}
+	opts.RefreshAheadThreshold = 0.5
+	keyCacher := NewMemoryKeyCacher(time.Second, MaxCacheSizeNoCheck)
+	client := NewJWKClientWithCache(opts, nil, keyCacher)
+
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+
+	// Past the threshold the cached key is served while a single
+	// background refresh downloads the keys.
+	time.Sleep(600 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetKey("keyRS256")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&client.refreshing) == 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+
+	// The refreshed key is served from the cache past its first expiry.
+	time.Sleep(500 * time.Millisecond)
+	_, err = keyCacher.Get("keyRS256")
+	assert.NoError(t, err)
+}
+
+func TestJWKClientRefreshAheadClock(t *testing.T) {
+	opts, _, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var downloads uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &downloads, rt: http.DefaultTransport}}
+	opts.RefreshAheadThreshold = 0.5
+	clock := newFakeClock()
+	keyCacher := NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck, WithClock(clock.Now))
+	client := NewJWKClientWithCache(opts, nil, keyCacher)
+
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+
+	// The threshold is reached on the clock of the cacher.
+	clock.Advance(31 * time.Minute)
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&downloads) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientRefreshAheadSizedCacher(t *testing.T) {
+	opts, _, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var downloads uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &downloads, rt: http.DefaultTransport}}
+	opts.RefreshAheadThreshold = 0.5
+	clock := newFakeClock()
+	keyCacher := NewMemoryKeyCacher(time.Hour, 1, WithClock(clock.Now))
+	client := NewJWKClientWithCache(opts, nil, keyCacher)
+
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+
+	clock.Advance(31 * time.Minute)
+	_, err = client.GetKey("keyRS256")
+	assert.NoError(t, err)
+
+	deadline := time.Now().Add(time.Second)
+	for (atomic.LoadUint64(&downloads) < 2 || atomic.LoadInt32(&client.refreshing) == 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+
+	// Only the cached key is added again, the other key of the
+	// JWKS not evicting it from the cacher holding a single key.
+	_, err = keyCacher.Get("keyRS256")
+	assert.NoError(t, err)
+	_, err = keyCacher.Get("keyES384")
+	assert.Equal(t, ErrNoKeyFound, err)
+}
+
+func TestJWKClientGetKeyContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetKeyContext(ctx, "keyRS256")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	assert.True(t, time.Since(start) < time.Second, "the download should be cancelled with the context")
+}
+
+func TestJWKClientSharedDownloads(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+
+	var downloads uint64
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&downloads, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+
+	// The concurrent cache misses share a single download.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := client.GetKey("keyRS256")
+			assert.NoError(t, err)
+			assert.Equal(t, "keyRS256", key.KeyID)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientSharedDownloadCancelled(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+
+	var downloads uint64
+	cancelled := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddUint64(&downloads, 1) == 1 {
+			<-r.Context().Done()
+			cancelled <- struct{}{}
+			return
+		}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, ctx := range []context.Context{first, second} {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			_, err := client.GetKeyContext(ctx, "keyRS256")
+			assert.Equal(t, context.Canceled, err)
+		}(ctx)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The download goes on while a waiter is left.
+	cancelFirst()
+	select {
+	case <-cancelled:
+		t.Fatal("the download should not be cancelled while shared")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the download should be cancelled once all the waiters are gone")
+	}
+	wg.Wait()
+
+	// The next miss starts a new download.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	_, err := client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientConditionalDownload(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+
+	var downloads, notModified uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddUint64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddUint64(&downloads, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+
+	keyCacher := NewMemoryKeyCacher(100*time.Millisecond, MaxCacheSizeNoCheck)
+	client := NewJWKClientWithCache(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil, keyCacher)
+
+	_, err := client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	first, err := keyCacher.(KeyInfoCacher).Info("keyRS256")
+	assert.NoError(t, err)
+
+	// The expired key is served again from a 304 Not Modified.
+	time.Sleep(150 * time.Millisecond)
+	key, err := client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	assert.Equal(t, "keyRS256", key.KeyID)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&notModified))
+
+	refreshed, err := keyCacher.(KeyInfoCacher).Info("keyRS256")
+	assert.NoError(t, err)
+	assert.True(t, refreshed.AddedAt.After(first.AddedAt), "the max age of the key should start again")
+}
+
+func TestJWKClientRequestHeaders(t *testing.T) {
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+
+	var tenant, authorization []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header["X-Tenant"]
+		authorization = r.Header["Authorization"]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{
+		URI:               ts.URL,
+		AllowInsecureJWKS: true,
+		Headers:           http.Header{"X-Tenant": {"a", "b"}},
+		RequestModifier: func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+r.Header.Get("X-Tenant"))
+		},
+	}, nil)
+
+	_, err := client.GetKey("keyRS256")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, tenant)
+	assert.Equal(t, []string{"Bearer a"}, authorization)
+}
+
+func TestJWKClientWarmup(t *testing.T) {
+	opts, tokenRS256, tokenES384, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var downloads uint64
+	opts.Client = &http.Client{Transport: &mockRoundTripper{ops: &downloads, rt: http.DefaultTransport}}
+	client := NewJWKClient(opts, nil)
+
+	assert.NoError(t, client.Warmup(context.Background()))
+	testGetSecret(t, client, tokenRS256)
+	testGetSecret(t, client, tokenES384)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads), "the keys should be served from the warm cache")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	assert.True(t, errors.Is(client.Warmup(context.Background()), ErrJWKSStatus))
+}
+
+func TestJWKClientWarmupSizedCacher(t *testing.T) {
+	opts, _, _, err := genNewTestServer(true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	keyCacher := NewMemoryKeyCacher(time.Hour, 1)
+	client := NewJWKClientWithCache(opts, nil, keyCacher)
+
+	// Only the first key of the JWKS fits in the cacher,
+	// the next ones not evicting it.
+	assert.NoError(t, client.Warmup(context.Background()))
+	_, err = keyCacher.Get("keyRS256")
+	assert.NoError(t, err)
+	_, err = keyCacher.Get("keyES384")
+	assert.Equal(t, ErrNoKeyFound, err)
+}
+
+func TestNewJWKClientOptions(t *testing.T) {
+	options := NewJWKClientOptions("https://example.com/.well-known/jwks.json")
+	assert.Equal(t, "https://example.com/.well-known/jwks.json", options.URI)
+	assert.Equal(t, DefaultJWKSTimeout, options.Client.Timeout)
+	assert.Nil(t, options.RetryPolicy)
+
+	custom := &http.Client{Timeout: time.Minute}
+	options = NewJWKClientOptions("https://example.com/.well-known/jwks.json",
+		WithHTTPClient(custom),
+		WithTimeout(time.Second),
+		WithHeaders(http.Header{"X-Tenant": {"a"}}),
+		WithHeaders(http.Header{"X-Tenant": {"b"}}),
+		WithRetry(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}),
+	)
+	assert.Equal(t, time.Second, options.Client.Timeout)
+	assert.Equal(t, time.Minute, custom.Timeout, "the client passed should be left untouched")
+	assert.Equal(t, []string{"a", "b"}, options.Headers["X-Tenant"])
+	assert.Equal(t, &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, options.RetryPolicy)
+
+	jsonWebKeyRS256 := genRSASSAJWK(jose.RS256, "keyRS256")
+	var tenant []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.Header["X-Tenant"]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{jsonWebKeyRS256.Public()}})
+	}))
+	defer ts.Close()
+
+	// The options remain a struct, combined with the fields having no option.
+	options = NewJWKClientOptions(ts.URL, WithHeaders(http.Header{"X-Tenant": {"a"}}))
+	options.AllowInsecureJWKS = true
+	_, err := NewJWKClient(options, nil).GetKey("keyRS256")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, tenant)
+}
+
+func TestJWKClientDefaultTimeout(t *testing.T) {
+	client := NewJWKClient(JWKClientOptions{URI: "https://example.com/.well-known/jwks.json"}, nil)
+	assert.Equal(t, DefaultJWKSTimeout, client.options.Client.Timeout)
+	assert.NotZero(t, client.options.Client.Timeout)
+
+	custom := &http.Client{}
+	client = NewJWKClient(JWKClientOptions{URI: "https://example.com/.well-known/jwks.json", Client: custom}, nil)
+	assert.True(t, client.options.Client == custom, "the client provided should be used as is")
+}
+
+func TestJWKClientUnknownKeyRefetchedAfterTTL(t *testing.T) {
+	oldKey := genRSASSAJWK(jose.RS256, "old")
+	newKey := genRSASSAJWK(jose.RS256, "new")
+
+	var downloads uint64
+	var published int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&downloads, 1)
+		jwks := JWKS{Keys: []jose.JSONWebKey{oldKey.Public()}}
+		if atomic.LoadInt32(&published) == 1 {
+			jwks.Keys = append(jwks.Keys, newKey.Public())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, UnknownKeyTTL: time.Minute}, nil)
+	now := time.Now()
+	client.unknownKeys.now = func() time.Time { return now }
+
+	_, err := client.GetKey("new")
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+
+	// The key is published, but the kid is remembered as unknown until the TTL elapses.
+	atomic.StoreInt32(&published, 1)
+	_, err = client.GetKey("new")
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+
+	now = now.Add(time.Minute)
+	key, err := client.GetKey("new")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", key.KeyID)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientMinRefetchInterval(t *testing.T) {
+	oldKey := genRSASSAJWK(jose.RS256, "old")
+	otherKey := genRSASSAJWK(jose.RS256, "other")
+	newKey := genRSASSAJWK(jose.RS256, "new")
+
+	var downloads uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks := JWKS{Keys: []jose.JSONWebKey{oldKey.Public(), otherKey.Public()}}
+		if atomic.AddUint64(&downloads, 1) > 1 {
+			jwks.Keys = append(jwks.Keys, newKey.Public())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	// Only the requested keys are cached.
+	client := NewJWKClientWithCache(JWKClientOptions{
+		URI:                ts.URL,
+		AllowInsecureJWKS:  true,
+		MinRefetchInterval: 100 * time.Millisecond,
+	}, nil, NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck, WithCacheScope(CacheScopeMatched)))
+
+	_, err := client.GetKey("old")
+	assert.NoError(t, err)
+
+	// The misses within the interval are resolved from the keys just downloaded.
+	for i := 0; i < 10; i++ {
+		_, err = client.GetKey(strconv.Itoa(i))
+		assert.Equal(t, ErrNoKeyFound, err)
+	}
+	_, err = client.GetKey("new")
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+
+	// A downloaded key which was not cached is not downloaded again.
+	_, err = client.GetKey("other")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads))
+
+	time.Sleep(100 * time.Millisecond)
+	key, err := client.GetKey("new")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", key.KeyID)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientOnKeysChanged(t *testing.T) {
+	keyA := genRSASSAJWK(jose.RS256, "a")
+	keyB := genRSASSAJWK(jose.RS256, "b")
+	keyC := genRSASSAJWK(jose.RS256, "c")
+	keyD := genRSASSAJWK(jose.RS256, "d")
+
+	var mu sync.Mutex
+	served := []jose.JSONWebKey{keyA.Public(), keyB.Public()}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: served})
+	}))
+	defer ts.Close()
+
+	type change struct{ added, removed []string }
+	var changes []change
+	client := NewJWKClient(JWKClientOptions{
+		URI:               ts.URL,
+		AllowInsecureJWKS: true,
+		OnKeysChanged: func(added, removed []string) {
+			changes = append(changes, change{added, removed})
+		},
+	}, nil)
+
+	assert.NoError(t, client.Refresh(context.Background()))
+	assert.NoError(t, client.Refresh(context.Background()))
+	assert.Empty(t, changes, "neither the first download nor an unchanged key set should be reported")
+
+	mu.Lock()
+	served = []jose.JSONWebKey{keyB.Public(), keyC.Public()}
+	mu.Unlock()
+	assert.NoError(t, client.Refresh(context.Background()))
+	assert.Equal(t, []change{{added: []string{"c"}, removed: []string{"a"}}}, changes)
+
+	// The download on a cache miss is diffed as well.
+	mu.Lock()
+	served = []jose.JSONWebKey{keyC.Public(), keyD.Public()}
+	mu.Unlock()
+	_, err := client.GetKey("d")
+	assert.NoError(t, err)
+	assert.Equal(t, []change{
+		{added: []string{"c"}, removed: []string{"a"}},
+		{added: []string{"d"}, removed: []string{"b"}},
+	}, changes)
+}
+
+func TestJWKClientEmptyKeySet(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+
+	var empty int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.LoadInt32(&empty) == 1 {
+			fmt.Fprint(w, `{"keys":[]}`)
+			return
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	var changed bool
+	client := NewJWKClient(JWKClientOptions{
+		URI:               ts.URL,
+		AllowInsecureJWKS: true,
+		OnKeysChanged:     func(added, removed []string) { changed = true },
+	}, nil)
+	assert.NoError(t, client.Refresh(context.Background()))
+
+	atomic.StoreInt32(&empty, 1)
+	assert.Equal(t, ErrEmptyJWKS, client.Refresh(context.Background()))
+	_, err := client.GetKey("unknown")
+	assert.Equal(t, ErrEmptyJWKS, err)
+
+	// The last known good keys keep being served.
+	cached, err := client.GetKey("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "key", cached.KeyID)
+	assert.False(t, changed, "an empty key set should not be reported as a rotation")
+}
+
+func TestJWKClientMaxCachedKeys(t *testing.T) {
+	var keys []jose.JSONWebKey
+	for _, keyID := range []string{"1", "2", "3"} {
+		key := genRSASSAJWK(jose.RS256, keyID)
+		keys = append(keys, key.Public())
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: keys})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, MaxCachedKeys: 2}, nil)
+	_, err := client.GetKey("1")
+	assert.NoError(t, err)
+
+	keyCacher := client.keyCacher.(*memoryKeyCacher)
+	assert.True(t, keyCacher.IsPersistent())
+	assert.Len(t, keyCacher.Keys(), 2)
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+	tests := []struct {
+		value  string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{value: "", ok: false},
+		{value: "no-cache", ok: false},
+		{value: "max-age=60", maxAge: time.Minute, ok: true},
+		{value: "public, MAX-AGE=3600, must-revalidate", maxAge: time.Hour, ok: true},
+		{value: `max-age="120"`, maxAge: 2 * time.Minute, ok: true},
+		{value: "max-age=-1", ok: false},
+		{value: "max-age=soon", ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			maxAge, ok := cacheControlMaxAge(test.value)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.maxAge, maxAge)
+		})
+	}
+}
+
+func TestJWKClientHonorCacheControl(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "a")
+	var cacheControl atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if value := cacheControl.Load().(string); value != "" {
+			w.Header().Set("Cache-Control", value)
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		options      JWKClientOptions
+		expectedTTL  time.Duration
+	}{
+		{
+			name:         "not honored",
+			cacheControl: "max-age=60",
+			expectedTTL:  time.Hour,
+		},
+		{
+			name:         "honored",
+			cacheControl: "public, max-age=60",
+			options:      JWKClientOptions{HonorCacheControl: true},
+			expectedTTL:  time.Minute,
+		},
+		{
+			name:        "absent",
+			options:     JWKClientOptions{HonorCacheControl: true},
+			expectedTTL: time.Hour,
+		},
+		{
+			name:         "clamped to the min age",
+			cacheControl: "max-age=0",
+			options:      JWKClientOptions{HonorCacheControl: true, MinCacheControlAge: 10 * time.Second},
+			expectedTTL:  10 * time.Second,
+		},
+		{
+			name:         "clamped to the max age",
+			cacheControl: "max-age=86400",
+			options:      JWKClientOptions{HonorCacheControl: true, MaxCacheControlAge: 2 * time.Hour},
+			expectedTTL:  2 * time.Hour,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheControl.Store(test.cacheControl)
+			options := test.options
+			options.URI = ts.URL
+			options.AllowInsecureJWKS = true
+			keyCacher := NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck)
+			client := NewJWKClientWithCache(options, nil, keyCacher)
+
+			_, err := client.GetKey("a")
+			assert.NoError(t, err)
+			info, err := keyCacher.(KeyInfoCacher).Info("a")
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedTTL, info.ExpiresAt.Sub(info.AddedAt))
+		})
+	}
+}
+
+func TestJWKClientSoleKeyFallback(t *testing.T) {
+	keyA := genRSASSAJWK(jose.RS256, "a")
+	keyB := genRSASSAJWK(jose.RS256, "b")
+	var downloads uint64
+	var several int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&downloads, 1)
+		jwks := JWKS{Keys: []jose.JSONWebKey{keyA.Public()}}
+		if atomic.LoadInt32(&several) == 1 {
+			jwks.Keys = append(jwks.Keys, keyB.Public())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	token := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, keyA, "")
+
+	// Tokens without kid are rejected by default.
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, err := client.GetSecret(token)
+	assert.Equal(t, ErrNoKeyFound, err)
+
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, SoleKeyFallback: true}, nil)
+	atomic.StoreUint64(&downloads, 0)
+	for i := 0; i < 3; i++ {
+		secret, err := client.GetSecret(token)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", secret.(jose.JSONWebKey).KeyID)
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&downloads), "the sole key should be served from the cache")
+
+	atomic.StoreInt32(&several, 1)
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, SoleKeyFallback: true}, nil)
+	_, err = client.GetSecret(token)
+	assert.Equal(t, ErrAmbiguousKeyID, err)
+}
+
+func TestJWKClientNoOpKeyCacher(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "a")
+	var downloads uint64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&downloads, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClientWithCache(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil, NewNoOpKeyCacher())
+	for i := 0; i < 3; i++ {
+		downloadedKey, err := client.GetKey("a")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", downloadedKey.KeyID)
+	}
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&downloads))
+}
+
+func TestJWKClientLastKeySet(t *testing.T) {
+	keyA := genRSASSAJWK(jose.RS256, "a")
+	keyB := genECDSAJWK(jose.ES256, "b")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{keyA.Public(), keyB.Public()}})
+	}))
+	defer ts.Close()
+
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, _, err := client.LastKeySet()
+	assert.Equal(t, ErrNoKeySetDownloaded, err)
+
+	before := time.Now()
+	_, err = client.GetKey("a")
+	assert.NoError(t, err)
+
+	keySet, downloadedAt, err := client.LastKeySet()
+	assert.NoError(t, err)
+	assert.False(t, downloadedAt.Before(before))
+	assert.Len(t, keySet.Keys, 2)
+	assert.Equal(t, "a", keySet.Keys[0].KeyID)
+	assert.Equal(t, string(jose.RS256), keySet.Keys[0].Algorithm)
+	assert.Equal(t, "sig", keySet.Keys[0].Use)
+	assert.Equal(t, "b", keySet.Keys[1].KeyID)
+
+	// The returned key set is a copy.
+	keySet.Keys[0].KeyID = "modified"
+	keySet, _, _ = client.LastKeySet()
+	assert.Equal(t, "a", keySet.Keys[0].KeyID)
+}
+
+func TestJWKClientSkipsEncryptionKeys(t *testing.T) {
+	sigKey := genECDSAJWK(jose.ES256, "shared")
+	encKey := genRSASSAJWK(jose.RS256, "shared")
+	encKey.Use = "enc"
+	encOnlyKey := genRSASSAJWK(jose.RS256, "enc")
+	encOnlyKey.Use = "enc"
+	dupECKey := genECDSAJWK(jose.ES256, "dup")
+	dupRSAKey := genRSASSAJWK(jose.RS256, "dup")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// The keys which should not be selected are listed last.
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{
+			sigKey.Public(), encKey.Public(), encOnlyKey.Public(), dupECKey.Public(), dupRSAKey.Public(),
+		}})
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		key      jose.JSONWebKey
+		alg      jose.SignatureAlgorithm
+		expected error
+	}{
+		{name: "signing key sharing its kid with an encryption key", key: sigKey, alg: jose.ES256},
+		{name: "encryption key", key: encOnlyKey, alg: jose.RS256, expected: ErrNoKeyFound},
+		{name: "signing key sharing its kid with a key for another algorithm", key: dupECKey, alg: jose.ES256},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+			token := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), test.alg, test.key, test.key.KeyID)
+
+			secret, err := client.GetSecret(token)
+			if test.expected != nil {
+				assert.Equal(t, test.expected, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, token.Claims(secret, &jwt.Claims{}))
+		})
+	}
+
+	// The key set last downloaded keeps the keys for encryption,
+	// which are still skipped within the MinRefetchInterval.
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, MinRefetchInterval: time.Hour}, nil)
+	_, err := client.GetKey("shared")
+	assert.NoError(t, err)
+	keySet, _, err := client.LastKeySet()
+	assert.NoError(t, err)
+	assert.Len(t, keySet.Keys, 5)
+	_, err = client.GetKey("enc")
+	assert.Equal(t, ErrNoKeyFound, err)
+}
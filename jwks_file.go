@@ -0,0 +1,63 @@
+package auth0
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// FileJWKSProvider provides the keys of a JWKS file, e.g. a mounted
+// secret in air-gapped environments, resolved by the kid of the token
+// without any network call.
+type FileJWKSProvider struct {
+	path   string
+	mu     sync.RWMutex
+	keySet map[string]interface{}
+}
+
+// NewFileJWKSProvider creates a new FileJWKSProvider instance
+// from the JWKS file, failing when it is missing or malformed.
+func NewFileJWKSProvider(path string) (*FileJWKSProvider, error) {
+	p := &FileJWKSProvider{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the JWKS file again, e.g. once the keys were rotated.
+// The keys previously read are kept when the file cannot be read.
+func (p *FileJWKSProvider) Reload() error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("reading the JWKS file: %w", err)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return fmt.Errorf("parsing the JWKS file %s: %w", p.path, err)
+	}
+	if len(jwks.Keys) == 0 {
+		return fmt.Errorf("parsing the JWKS file %s: no keys found", p.path)
+	}
+
+	keySet := make(map[string]interface{}, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		keySet[key.KeyID] = key
+	}
+
+	p.mu.Lock()
+	p.keySet = keySet
+	p.mu.Unlock()
+	return nil
+}
+
+// GetSecret implements the GetSecret method of the SecretProvider interface.
+func (p *FileJWKSProvider) GetSecret(token *jwt.JSONWebToken) (interface{}, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return keyByID(p.keySet, token)
+}
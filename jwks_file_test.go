@@ -0,0 +1,78 @@
+package auth0
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func writeJWKSFile(t *testing.T, path string, keys ...jose.JSONWebKey) {
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileJWKSProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+
+	oldKey := genRSASSAJWK(jose.RS256, "old")
+	newKey := genRSASSAJWK(jose.RS256, "new")
+	writeJWKSFile(t, path, oldKey.Public())
+
+	provider, err := NewFileJWKSProvider(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	validator := NewValidator(NewConfiguration(provider, defaultAudience, defaultIssuer, jose.RS256), nil)
+
+	oldToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, oldKey, "old")
+	newToken := getTestTokenWithKid(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.RS256, newKey, "new")
+	assert.NoError(t, validator.ValidateToken(oldToken))
+	assert.Equal(t, ErrNoKeyFound, validator.ValidateToken(newToken))
+
+	writeJWKSFile(t, path, oldKey.Public(), newKey.Public())
+	assert.NoError(t, provider.Reload())
+	assert.NoError(t, validator.ValidateToken(newToken))
+
+	// The keys read are kept when the file becomes malformed.
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	assert.Error(t, provider.Reload())
+	assert.NoError(t, validator.ValidateToken(newToken))
+}
+
+func TestNewFileJWKSProviderErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewFileJWKSProvider(filepath.Join(dir, "missing.json"))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "got %v", err)
+
+	malformed := filepath.Join(dir, "malformed.json")
+	assert.NoError(t, ioutil.WriteFile(malformed, []byte("not json"), 0600))
+	_, err = NewFileJWKSProvider(malformed)
+	assert.Contains(t, err.Error(), "parsing the JWKS file")
+
+	empty := filepath.Join(dir, "empty.json")
+	writeJWKSFile(t, empty)
+	_, err = NewFileJWKSProvider(empty)
+	assert.Contains(t, err.Error(), "no keys found")
+}
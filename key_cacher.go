@@ -2,6 +2,10 @@ package auth0
 
 import (
 	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	jose "gopkg.in/square/go-jose.v2"
@@ -20,97 +24,687 @@ var (
 type KeyCacher interface {
 	Get(keyID string) (*jose.JSONWebKey, error)
 	Add(keyID string, webKeys []jose.JSONWebKey) (*jose.JSONWebKey, error)
+	// Remove evicts the key, e.g. once revoked, and returns
+	// ErrNoKeyFound when it is not cached.
+	Remove(keyID string) error
 }
 
+// CachedKeyInfo describes a cached key for diagnostics,
+// without exposing any key material.
+type CachedKeyInfo struct {
+	KeyID   string
+	AddedAt time.Time
+	// ExpiresAt is the zero time when the key never expires.
+	ExpiresAt time.Time
+}
+
+// DiagnosableKeyCacher is implemented by the key cachers
+// able to describe their entries for diagnostics.
+type DiagnosableKeyCacher interface {
+	KeyCacher
+	EntriesByExpiry() []CachedKeyInfo
+}
+
+// KeyInfoCacher is implemented by the key cachers able
+// to describe a single entry, e.g. to refresh it ahead of expiry.
+type KeyInfoCacher interface {
+	KeyCacher
+	Info(keyID string) (CachedKeyInfo, error)
+}
+
+// InspectableKeyCacher is implemented by the key cachers
+// able to report their live entries, e.g. for a debug endpoint.
+type InspectableKeyCacher interface {
+	KeyCacher
+	// Len returns the number of cached keys not expired.
+	Len() int
+	// Keys returns the sorted IDs of the cached keys not expired.
+	Keys() []string
+}
+
+// TTLKeyCacher is implemented by the key cachers able to keep
+// a key for its own time to live, e.g. from the cache hints of the
+// JWKS response, rather than for the max age of the cacher.
+type TTLKeyCacher interface {
+	KeyCacher
+	// AddWithTTL adds the keys like Add, the added keys expiring after
+	// the ttl. A zero ttl falls back to the max age of the cacher and
+	// MaxKeyAgeNoCheck keeps the keys until they are evicted.
+	AddWithTTL(keyID string, webKeys []jose.JSONWebKey, ttl time.Duration) (*jose.JSONWebKey, error)
+}
+
+// PersistentModeKeyCacher is implemented by the key cachers
+// able to report whether their keys never expire.
+type PersistentModeKeyCacher interface {
+	KeyCacher
+	// IsPersistent reports whether the cached keys never expire,
+	// whatever the max size of the cache.
+	IsPersistent() bool
+}
+
+// BatchKeyCacher is implemented by the key cachers able to get
+// several keys at once, e.g. to validate a batch of tokens.
+type BatchKeyCacher interface {
+	KeyCacher
+	// GetMany returns the cached keys not expired, the missing
+	// and expired ones being absent from the map.
+	GetMany(keyIDs []string) (map[string]*jose.JSONWebKey, error)
+}
+
+// StatsKeyCacher is implemented by the key cachers
+// counting their accesses, e.g. for a metrics scrape.
+type StatsKeyCacher interface {
+	KeyCacher
+	Stats() CacheStats
+}
+
+// CacheStats is a snapshot of the counters of a key cacher. The counters
+// are monotonic since the creation of the cacher, Size being the number
+// of stored entries, the expired ones included until they are deleted.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expiries  uint64
+	Size      int
+}
+
+// ResizableKeyCacher is implemented by the key cachers whose
+// max size can be changed while in use, e.g. on a configuration reload.
+type ResizableKeyCacher interface {
+	KeyCacher
+	// Resize sets the max size of the cache, evicting the entries
+	// in excess with the eviction policy of the cacher.
+	Resize(maxCacheSize int) error
+}
+
+// KeyCacheScope controls which of the downloaded keys are stored
+// by the memory key cacher when a key is added.
+type KeyCacheScope int
+
+const (
+	// CacheScopeDefault stores every downloaded key when the cache size
+	// is unbounded, and only the requested key otherwise.
+	CacheScopeDefault KeyCacheScope = iota
+	// CacheScopeAll stores every downloaded key. When the cache size is
+	// bounded the oldest entries are evicted, the requested key being
+	// always kept.
+	CacheScopeAll
+	// CacheScopeMatched stores only the requested key.
+	CacheScopeMatched
+)
+
+// EvictionPolicy selects the entry evicted by the memory
+// key cacher when its max size is exceeded.
+type EvictionPolicy int
+
+const (
+	// EvictFIFO evicts the entry added first.
+	EvictFIFO EvictionPolicy = iota
+	// EvictLRU evicts the entry accessed least recently, so that
+	// a key still actively signing is kept over newer idle keys.
+	EvictLRU
+)
+
+// CacheObserver is notified of the accesses to the memory key cacher,
+// e.g. to count them with a metrics library. OnEvict is called when a key
+// is evicted on overflow and OnExpire when an expired key is deleted,
+// both while holding the cache lock: as the other callbacks run on the
+// path of every validation, implementations must not block.
+type CacheObserver interface {
+	OnHit(keyID string)
+	OnMiss(keyID string)
+	OnEvict(keyID string)
+	OnExpire(keyID string)
+}
+
+// KeyCacherOption configures optional behaviors of the memory key cacher.
+type KeyCacherOption func(*memoryKeyCacher)
+
+// WithEvictionPolicy sets the entry evicted when the max size is exceeded.
+func WithEvictionPolicy(policy EvictionPolicy) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		mkc.policy = policy
+	}
+}
+
+// WithCacheScope sets which of the downloaded keys are stored by the cacher,
+// independently of its max size.
+func WithCacheScope(scope KeyCacheScope) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		mkc.scope = scope
+	}
+}
+
+// WithExpiryJitter spreads the expiry of each added key randomly within
+// plus or minus the fraction of its max age, e.g. 0.1 for ±10%, so that
+// the instances started together do not download the keys in lockstep.
+// Fractions outside of (0, 1) disable the jitter.
+func WithExpiryJitter(fraction float64) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		if fraction > 0 && fraction < 1 {
+			mkc.jitter = fraction
+		}
+	}
+}
+
+// WithClock replaces time.Now for the times of the entries and their
+// expiry, e.g. to expire the keys with a fake clock in tests.
+func WithClock(now func() time.Time) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		mkc.clock = now
+	}
+}
+
+// WithLockObserver sets the observer receiving the time spent waiting for
+// and holding the lock guarding the entries, read by every Get.
+func WithLockObserver(observer LockObserver) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		mkc.lockObserver = observer
+	}
+}
+
+// WithCacheObserver sets the observer notified of the accesses to the cacher.
+func WithCacheObserver(observer CacheObserver) KeyCacherOption {
+	return func(mkc *memoryKeyCacher) {
+		mkc.observer = observer
+	}
+}
+
+// memoryKeyCacher is safe for concurrent use: the entries are guarded
+// by mu, and an entry is never modified once stored, only replaced.
 type memoryKeyCacher struct {
-	entries      map[string]keyCacherEntry
+	// hits, misses, evictions and expiries are updated atomically.
+	// Kept first for alignment.
+	hits         uint64
+	misses       uint64
+	evictions    uint64
+	expiries     uint64
+	mu           sync.RWMutex
+	entries      map[string]*keyCacherEntry
 	maxKeyAge    time.Duration
 	maxCacheSize int
+	scope        KeyCacheScope
+	policy       EvictionPolicy
+	observer     CacheObserver
+	lockObserver LockObserver
+	jitter       float64
+	// clock, when set, replaces time.Now for the
+	// times of the entries and their expiry.
+	clock func() time.Time
 }
 
 type keyCacherEntry struct {
-	addedAt time.Time
+	// lastAccessed is the time in nanoseconds the entry was last got,
+	// updated atomically under the read lock. Kept first for alignment.
+	lastAccessed int64
+	addedAt      time.Time
+	// maxAge overrides the max age of the cacher when not zero.
+	maxAge time.Duration
 	jose.JSONWebKey
 }
 
 // NewMemoryKeyCacher creates a new Keycacher interface with option
 // to set max age of cached keys and max size of the cache.
-func NewMemoryKeyCacher(maxKeyAge time.Duration, maxCacheSize int) KeyCacher {
-	return &memoryKeyCacher{
-		entries:      map[string]keyCacherEntry{},
+// Any negative max size is treated as MaxCacheSizeNoCheck.
+// The max age and the max size are independent: with both unchecked,
+// the cache is persistent and grows with every new kid, see
+// NewPersistentKeyCacher for a bounded persistent cache.
+// A max size of zero stores nothing, as NewNoOpKeyCacher does explicitly.
+// Additional behaviors can be configured with options.
+func NewMemoryKeyCacher(maxKeyAge time.Duration, maxCacheSize int, opts ...KeyCacherOption) KeyCacher {
+	if maxCacheSize < 0 {
+		maxCacheSize = MaxCacheSizeNoCheck
+	}
+	mkc := &memoryKeyCacher{
+		entries:      map[string]*keyCacherEntry{},
 		maxKeyAge:    maxKeyAge,
 		maxCacheSize: maxCacheSize,
 	}
+	for _, opt := range opts {
+		opt(mkc)
+	}
+	return mkc
 }
 
-func newMemoryPersistentKeyCacher() KeyCacher {
-	return &memoryKeyCacher{
-		entries:      map[string]keyCacherEntry{},
-		maxKeyAge:    MaxKeyAgeNoCheck,
-		maxCacheSize: MaxCacheSizeNoCheck,
+// NewNoOpKeyCacher creates a new Keycacher interface storing nothing,
+// so that the keys are downloaded for each validation, e.g. to debug
+// a JWKClient without cache.
+func NewNoOpKeyCacher() KeyCacher {
+	return noOpKeyCacher{}
+}
+
+type noOpKeyCacher struct{}
+
+// Get never finds a key
+func (noOpKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
+	return nil, ErrNoKeyFound
+}
+
+// Add returns the key of the downloaded keys matching the key ID
+// without storing it
+func (noOpKeyCacher) Add(keyID string, downloadedKeys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	for _, key := range downloadedKeys {
+		if key.KeyID == keyID {
+			return &key, nil
+		}
 	}
+	return nil, ErrNoKeyFound
+}
+
+// Remove never finds a key
+func (noOpKeyCacher) Remove(keyID string) error {
+	return ErrNoKeyFound
+}
+
+// NewMemoryKeyCacherWithPolicy creates a new Keycacher interface
+// like NewMemoryKeyCacher, evicting the entries with the policy.
+func NewMemoryKeyCacherWithPolicy(maxKeyAge time.Duration, maxCacheSize int, policy EvictionPolicy, opts ...KeyCacherOption) KeyCacher {
+	return NewMemoryKeyCacher(maxKeyAge, maxCacheSize, append([]KeyCacherOption{WithEvictionPolicy(policy)}, opts...)...)
+}
+
+// NewPersistentKeyCacher creates a new Keycacher interface whose keys
+// never expire, storing all the downloaded keys. The keys being only
+// evicted on overflow, an unbounded max size grows the cache with every
+// new kid served by the JWKS endpoint, e.g. on frequent rotations: a max
+// size keeps the long-lived keys bounded, the oldest being evicted first.
+func NewPersistentKeyCacher(maxCacheSize int, opts ...KeyCacherOption) KeyCacher {
+	return NewMemoryKeyCacher(MaxKeyAgeNoCheck, maxCacheSize, append([]KeyCacherOption{WithCacheScope(CacheScopeAll)}, opts...)...)
+}
+
+func newMemoryPersistentKeyCacher() KeyCacher {
+	return NewPersistentKeyCacher(MaxCacheSizeNoCheck)
 }
 
 // Get obtains a key from the cache, and checks if the key is expired
+// The returned key is a copy, which stays valid once the entry is evicted:
+// modifying its fields does not affect the cache, but its material, such
+// as the public key it points to, is shared and must not be modified.
 func (mkc *memoryKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
+	acquired, wait := mkc.rlock()
 	searchKey, ok := mkc.entries[keyID]
+	mkc.runlock(acquired, wait)
 	if ok {
-		if mkc.maxKeyAge == MaxKeyAgeNoCheck || !mkc.keyIsExpired(keyID) {
-			return &searchKey.JSONWebKey, nil
+		if !mkc.entryIsExpired(searchKey) {
+			if mkc.policy == EvictLRU {
+				atomic.StoreInt64(&searchKey.lastAccessed, mkc.now().UnixNano())
+			}
+			atomic.AddUint64(&mkc.hits, 1)
+			if mkc.observer != nil {
+				mkc.observer.OnHit(keyID)
+			}
+			key := searchKey.JSONWebKey
+			return &key, nil
+		}
+		mkc.removeExpired(keyID, searchKey)
+		atomic.AddUint64(&mkc.misses, 1)
+		if mkc.observer != nil {
+			mkc.observer.OnMiss(keyID)
 		}
 		return nil, ErrKeyExpired
 	}
+	atomic.AddUint64(&mkc.misses, 1)
+	if mkc.observer != nil {
+		mkc.observer.OnMiss(keyID)
+	}
 	return nil, ErrNoKeyFound
 }
 
 // Add adds a key into the cache and handles overflow
 func (mkc *memoryKeyCacher) Add(keyID string, downloadedKeys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	return mkc.AddWithTTL(keyID, downloadedKeys, 0)
+}
+
+// AddWithTTL adds a key into the cache like Add, the
+// stored keys expiring after the ttl rather than the max age.
+func (mkc *memoryKeyCacher) AddWithTTL(keyID string, downloadedKeys []jose.JSONWebKey, ttl time.Duration) (*jose.JSONWebKey, error) {
+	defer mkc.unlock(mkc.lock())
+
 	var addingKey jose.JSONWebKey
+	cacheAll := mkc.cachesAllKeys()
 
 	for _, key := range downloadedKeys {
 		if key.KeyID == keyID {
 			addingKey = key
-		}
-		if mkc.maxCacheSize == -1 {
-			mkc.entries[key.KeyID] = keyCacherEntry{
-				addedAt:    time.Now(),
-				JSONWebKey: key,
-			}
+		} else if cacheAll {
+			mkc.store(key, ttl)
 		}
 	}
 	if addingKey.Key != nil {
-		if mkc.maxCacheSize != -1 {
-			mkc.entries[addingKey.KeyID] = keyCacherEntry{
-				addedAt:    time.Now(),
-				JSONWebKey: addingKey,
-			}
-			mkc.handleOverflow()
-		}
+		// The requested key is stored last so that it is never
+		// the one evicted on overflow.
+		mkc.store(addingKey, ttl)
 		return &addingKey, nil
 	}
 	return nil, ErrNoKeyFound
 }
 
-// keyIsExpired deletes the key from cache if it is expired
-func (mkc *memoryKeyCacher) keyIsExpired(keyID string) bool {
-	if time.Now().After(mkc.entries[keyID].addedAt.Add(mkc.maxKeyAge)) {
-		delete(mkc.entries, keyID)
+// Remove deletes a key from the cache
+func (mkc *memoryKeyCacher) Remove(keyID string) error {
+	defer mkc.unlock(mkc.lock())
+
+	if _, ok := mkc.entries[keyID]; !ok {
+		return ErrNoKeyFound
+	}
+	delete(mkc.entries, keyID)
+	return nil
+}
+
+// IsPersistent reports whether the cached keys never expire
+func (mkc *memoryKeyCacher) IsPersistent() bool {
+	return mkc.maxKeyAge == MaxKeyAgeNoCheck
+}
+
+// Resize sets the max size of the cache, the entries in excess being
+// evicted with the eviction policy, and never fails. As in the
+// constructor, any negative max size is treated as MaxCacheSizeNoCheck.
+func (mkc *memoryKeyCacher) Resize(maxCacheSize int) error {
+	if maxCacheSize < 0 {
+		maxCacheSize = MaxCacheSizeNoCheck
+	}
+
+	defer mkc.unlock(mkc.lock())
+
+	mkc.maxCacheSize = maxCacheSize
+	if mkc.maxCacheSize != MaxCacheSizeNoCheck {
+		mkc.handleOverflow(nil)
+	}
+	return nil
+}
+
+// capacity returns the max size of the cache,
+// MaxCacheSizeNoCheck when unbounded.
+func (mkc *memoryKeyCacher) capacity() int {
+	defer mkc.runlock(mkc.rlock())
+	return mkc.maxCacheSize
+}
+
+// rlock acquires the read lock of the entries. The time waited
+// is only measured when a lock observer is set.
+func (mkc *memoryKeyCacher) rlock() (acquired time.Time, wait time.Duration) {
+	if mkc.lockObserver == nil {
+		mkc.mu.RLock()
+		return time.Time{}, 0
+	}
+	start := time.Now()
+	mkc.mu.RLock()
+	acquired = time.Now()
+	return acquired, acquired.Sub(start)
+}
+
+// runlock releases the read lock of the entries
+// and reports its durations to the lock observer.
+func (mkc *memoryKeyCacher) runlock(acquired time.Time, wait time.Duration) {
+	mkc.mu.RUnlock()
+	if mkc.lockObserver != nil {
+		mkc.lockObserver(wait, time.Since(acquired))
+	}
+}
+
+// lock acquires the write lock of the entries. The time waited
+// is only measured when a lock observer is set.
+func (mkc *memoryKeyCacher) lock() (acquired time.Time, wait time.Duration) {
+	if mkc.lockObserver == nil {
+		mkc.mu.Lock()
+		return time.Time{}, 0
+	}
+	start := time.Now()
+	mkc.mu.Lock()
+	acquired = time.Now()
+	return acquired, acquired.Sub(start)
+}
+
+// unlock releases the write lock of the entries
+// and reports its durations to the lock observer.
+func (mkc *memoryKeyCacher) unlock(acquired time.Time, wait time.Duration) {
+	mkc.mu.Unlock()
+	if mkc.lockObserver != nil {
+		mkc.lockObserver(wait, time.Since(acquired))
+	}
+}
+
+// cachesAllKeys reports whether all the downloaded keys should be stored.
+func (mkc *memoryKeyCacher) cachesAllKeys() bool {
+	switch mkc.scope {
+	case CacheScopeAll:
 		return true
+	case CacheScopeMatched:
+		return false
+	default:
+		return mkc.maxCacheSize == MaxCacheSizeNoCheck
+	}
+}
+
+// now returns the time of the clock of the cacher.
+func (mkc *memoryKeyCacher) now() time.Time {
+	if mkc.clock == nil {
+		return time.Now()
+	}
+	return mkc.clock()
+}
+
+// store inserts a key into the cache and handles overflow.
+// Must be called with the write lock held.
+func (mkc *memoryKeyCacher) store(key jose.JSONWebKey, ttl time.Duration) {
+	if mkc.jitter > 0 {
+		ttl = mkc.jitteredMaxAge(ttl)
+	}
+	now := mkc.now()
+	entry := &keyCacherEntry{
+		lastAccessed: now.UnixNano(),
+		addedAt:      now,
+		maxAge:       ttl,
+		JSONWebKey:   key,
+	}
+	mkc.entries[key.KeyID] = entry
+	if mkc.maxCacheSize != MaxCacheSizeNoCheck {
+		mkc.handleOverflow(entry)
+	}
+}
+
+// EntriesByExpiry returns a snapshot of the cached keys sorted
+// by soonest expiry, the keys which never expire coming last.
+func (mkc *memoryKeyCacher) EntriesByExpiry() []CachedKeyInfo {
+	defer mkc.runlock(mkc.rlock())
+
+	infos := make([]CachedKeyInfo, 0, len(mkc.entries))
+	for keyID, entry := range mkc.entries {
+		infos = append(infos, mkc.info(keyID, entry))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return b.ExpiresAt.IsZero() || (!a.ExpiresAt.IsZero() && a.ExpiresAt.Before(b.ExpiresAt))
+		}
+		return a.KeyID < b.KeyID
+	})
+	return infos
+}
+
+// Info describes the cached key, without checking its expiry
+func (mkc *memoryKeyCacher) Info(keyID string) (CachedKeyInfo, error) {
+	acquired, wait := mkc.rlock()
+	entry, ok := mkc.entries[keyID]
+	mkc.runlock(acquired, wait)
+	if !ok {
+		return CachedKeyInfo{}, ErrNoKeyFound
+	}
+	return mkc.info(keyID, entry), nil
+}
+
+// GetMany obtains the keys from the cache under a single read lock,
+// the missing and expired keys being absent from the returned map.
+// The returned keys are copies, as the one returned by Get.
+func (mkc *memoryKeyCacher) GetMany(keyIDs []string) (map[string]*jose.JSONWebKey, error) {
+	entries := make(map[string]*keyCacherEntry, len(keyIDs))
+	acquired, wait := mkc.rlock()
+	for _, keyID := range keyIDs {
+		if entry, ok := mkc.entries[keyID]; ok {
+			entries[keyID] = entry
+		}
+	}
+	mkc.runlock(acquired, wait)
+
+	keys := make(map[string]*jose.JSONWebKey, len(entries))
+	seen := make(map[string]bool, len(keyIDs))
+	for _, keyID := range keyIDs {
+		if seen[keyID] {
+			continue
+		}
+		seen[keyID] = true
+		entry, ok := entries[keyID]
+		if ok && mkc.entryIsExpired(entry) {
+			mkc.removeExpired(keyID, entry)
+			ok = false
+		}
+		if !ok {
+			atomic.AddUint64(&mkc.misses, 1)
+			if mkc.observer != nil {
+				mkc.observer.OnMiss(keyID)
+			}
+			continue
+		}
+
+		if mkc.policy == EvictLRU {
+			atomic.StoreInt64(&entry.lastAccessed, mkc.now().UnixNano())
+		}
+		atomic.AddUint64(&mkc.hits, 1)
+		if mkc.observer != nil {
+			mkc.observer.OnHit(keyID)
+		}
+		key := entry.JSONWebKey
+		keys[keyID] = &key
+	}
+	return keys, nil
+}
+
+// Stats returns a snapshot of the counters of the cacher
+func (mkc *memoryKeyCacher) Stats() CacheStats {
+	acquired, wait := mkc.rlock()
+	size := len(mkc.entries)
+	mkc.runlock(acquired, wait)
+
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&mkc.hits),
+		Misses:    atomic.LoadUint64(&mkc.misses),
+		Evictions: atomic.LoadUint64(&mkc.evictions),
+		Expiries:  atomic.LoadUint64(&mkc.expiries),
+		Size:      size,
 	}
-	return false
 }
 
-// handleOverflow deletes the oldest key from the cache if overflowed
-func (mkc *memoryKeyCacher) handleOverflow() {
-	if mkc.maxCacheSize < len(mkc.entries) {
+// Len returns the number of cached keys not expired
+func (mkc *memoryKeyCacher) Len() int {
+	return len(mkc.Keys())
+}
+
+// Keys returns the sorted IDs of the cached keys not expired
+func (mkc *memoryKeyCacher) Keys() []string {
+	defer mkc.runlock(mkc.rlock())
+
+	keyIDs := make([]string, 0, len(mkc.entries))
+	for keyID, entry := range mkc.entries {
+		if !mkc.entryIsExpired(entry) {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	sort.Strings(keyIDs)
+	return keyIDs
+}
+
+func (mkc *memoryKeyCacher) info(keyID string, entry *keyCacherEntry) CachedKeyInfo {
+	info := CachedKeyInfo{
+		KeyID:   keyID,
+		AddedAt: entry.addedAt,
+	}
+	if maxAge := mkc.entryMaxAge(entry); maxAge != MaxKeyAgeNoCheck {
+		info.ExpiresAt = entry.addedAt.Add(maxAge)
+	}
+	return info
+}
+
+// entryIsExpired reports whether the already looked up entry is expired.
+func (mkc *memoryKeyCacher) entryIsExpired(entry *keyCacherEntry) bool {
+	maxAge := mkc.entryMaxAge(entry)
+	return maxAge != MaxKeyAgeNoCheck && mkc.now().After(entry.addedAt.Add(maxAge))
+}
+
+// jitteredMaxAge returns the max age of an entry added with the ttl,
+// offset randomly within the jitter. The keys which never expire are
+// left unchanged.
+func (mkc *memoryKeyCacher) jitteredMaxAge(ttl time.Duration) time.Duration {
+	maxAge := ttl
+	if maxAge == 0 {
+		maxAge = mkc.maxKeyAge
+	}
+	spread := int64(float64(maxAge) * mkc.jitter)
+	if maxAge <= 0 || spread <= 0 {
+		return ttl
+	}
+	return maxAge + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// entryMaxAge returns the max age of the entry, its own
+// ttl if any or the max age of the cacher.
+func (mkc *memoryKeyCacher) entryMaxAge(entry *keyCacherEntry) time.Duration {
+	if entry.maxAge != 0 {
+		return entry.maxAge
+	}
+	return mkc.maxKeyAge
+}
+
+// removeExpired deletes the expired entry from the cache under the
+// write lock. The entry is only deleted when it has not been replaced
+// since it was looked up, e.g. by a fresh download.
+func (mkc *memoryKeyCacher) removeExpired(keyID string, entry *keyCacherEntry) {
+	defer mkc.unlock(mkc.lock())
+
+	if mkc.entries[keyID] == entry {
+		delete(mkc.entries, keyID)
+		atomic.AddUint64(&mkc.expiries, 1)
+		if mkc.observer != nil {
+			mkc.observer.OnExpire(keyID)
+		}
+	}
+}
+
+// handleOverflow deletes the oldest keys from the cache while overflowed,
+// the age being measured from the last access with the LRU policy.
+// The entries of the same age are evicted in the order of their key IDs,
+// so that the same entries always evict the same one. The kept key, the
+// one just stored if any, is only evicted when no other entry is left.
+// Must be called with the write lock held.
+func (mkc *memoryKeyCacher) handleOverflow(keep *keyCacherEntry) {
+	for mkc.maxCacheSize < len(mkc.entries) {
+		// The oldest entry is always found, whatever its time, so that
+		// each iteration evicts one and the loop terminates.
 		var oldestEntryKeyID string
-		var latestAddedTime = time.Now()
+		var oldestTime time.Time
+		found := false
 		for entryKeyID, entry := range mkc.entries {
-			if entry.addedAt.Before(latestAddedTime) {
-				latestAddedTime = entry.addedAt
+			if entry == keep && len(mkc.entries) > 1 {
+				continue
+			}
+			t := mkc.evictionTime(entry)
+			if !found || t.Before(oldestTime) || (t.Equal(oldestTime) && entryKeyID < oldestEntryKeyID) {
+				oldestTime = t
 				oldestEntryKeyID = entryKeyID
+				found = true
 			}
 		}
 		delete(mkc.entries, oldestEntryKeyID)
+		atomic.AddUint64(&mkc.evictions, 1)
+		if mkc.observer != nil {
+			mkc.observer.OnEvict(oldestEntryKeyID)
+		}
+	}
+}
+
+// evictionTime returns the time the eviction policy orders the entries by.
+func (mkc *memoryKeyCacher) evictionTime(entry *keyCacherEntry) time.Time {
+	if mkc.policy == EvictLRU {
+		return time.Unix(0, atomic.LoadInt64(&entry.lastAccessed))
 	}
+	return entry.addedAt
 }
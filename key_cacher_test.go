@@ -1,8 +1,11 @@
 package auth0
 
 import (
+	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +14,29 @@ import (
 	"gopkg.in/square/go-jose.v2"
 )
 
+// fakeClock is advanced explicitly, for the tests
+// to expire and order the entries without sleeping.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestGet(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -21,7 +47,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "pass - persistent cacher",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -31,7 +57,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "fail - invalid key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -41,7 +67,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "fail - persistent cacher get immediately expired key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(0),
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -51,7 +77,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "pass - persistent cacher get not expired key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(10) * time.Second,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -91,7 +117,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "pass - custom cacher with -1 max age",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: 1,
 			},
@@ -101,7 +127,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "fail - custom cacher get immediately expired key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(0),
 				maxCacheSize: 1,
 			},
@@ -111,7 +137,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "pass - custom cacher not expired",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(100) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -121,7 +147,7 @@ func TestGet(t *testing.T) {
 		{
 			name: "fail - custom cacher with expired key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(-100) * time.Second, // setting max age negavtive time duration is equivalent to expired keys
 				maxCacheSize: 1,
 			},
@@ -132,7 +158,7 @@ func TestGet(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			if test.mkc.entries != nil {
-				test.mkc.entries["key1"] = keyCacherEntry{time.Now(), jose.JSONWebKey{KeyID: "test1"}}
+				test.mkc.entries["key1"] = &keyCacherEntry{addedAt: time.Now(), JSONWebKey: jose.JSONWebKey{KeyID: "test1"}}
 			}
 
 			_, err := test.mkc.Get(test.key)
@@ -170,7 +196,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - persistent cacher",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -182,7 +208,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - invalid key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -194,7 +220,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - add key for persistent cacher",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(0),
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -206,7 +232,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - add key for persistent cacher",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(10) * time.Second,
 				maxCacheSize: MaxCacheSizeNoCheck,
 			},
@@ -218,7 +244,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - no cacher with -1 max age",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: 0,
 			},
@@ -230,7 +256,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - no cacher",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(0),
 				maxCacheSize: 0,
 			},
@@ -242,7 +268,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - no cacher with 10sec max age",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(10) * time.Second,
 				maxCacheSize: 0,
 			},
@@ -254,7 +280,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - custom cacher with -1 max age",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    MaxKeyAgeNoCheck,
 				maxCacheSize: 1,
 			},
@@ -266,7 +292,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - custom cacher with 0 max age",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(0),
 				maxCacheSize: 1,
 			},
@@ -278,7 +304,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - custom cacher get latest added key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(100) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -289,7 +315,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - custom cacher add invalid key",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(100) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -301,7 +327,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "fail - custom cacher get key not in cache",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(100) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -312,7 +338,7 @@ func TestAdd(t *testing.T) {
 		{
 			name: "pass - custom cacher with capacity 3",
 			mkc: &memoryKeyCacher{
-				entries:      make(map[string]keyCacherEntry),
+				entries:      make(map[string]*keyCacherEntry),
 				maxKeyAge:    time.Duration(100) * time.Second,
 				maxCacheSize: 3,
 			},
@@ -349,7 +375,83 @@ func TestAdd(t *testing.T) {
 	}
 }
 
-func TestKeyIsExpired(t *testing.T) {
+func TestAddCacheScope(t *testing.T) {
+	downloadedKeys := []jose.JSONWebKey{
+		{Key: jose.JSONWebKey{}, KeyID: "test1"},
+		{Key: jose.JSONWebKey{}, KeyID: "test2"},
+		{Key: jose.JSONWebKey{}, KeyID: "test3"},
+	}
+
+	tests := []struct {
+		name         string
+		maxCacheSize int
+		scope        KeyCacheScope
+		expectedKeys []string
+	}{
+		{
+			name:         "persistent cacher with default scope caches all keys",
+			maxCacheSize: MaxCacheSizeNoCheck,
+			scope:        CacheScopeDefault,
+			expectedKeys: []string{"test1", "test2", "test3"},
+		},
+		{
+			name:         "persistent cacher caches matched key only",
+			maxCacheSize: MaxCacheSizeNoCheck,
+			scope:        CacheScopeMatched,
+			expectedKeys: []string{"test2"},
+		},
+		{
+			name:         "sized cacher with default scope caches matched key only",
+			maxCacheSize: 5,
+			scope:        CacheScopeDefault,
+			expectedKeys: []string{"test2"},
+		},
+		{
+			name:         "sized cacher caches all keys",
+			maxCacheSize: 5,
+			scope:        CacheScopeAll,
+			expectedKeys: []string{"test1", "test2", "test3"},
+		},
+		{
+			name:         "sized cacher caches all keys with eviction",
+			maxCacheSize: 1,
+			scope:        CacheScopeAll,
+			expectedKeys: []string{"test2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mkc := NewMemoryKeyCacher(time.Duration(100)*time.Second, test.maxCacheSize, WithCacheScope(test.scope)).(*memoryKeyCacher)
+
+			addedKey, err := mkc.Add("test2", downloadedKeys)
+			assert.NoError(t, err)
+			assert.Equal(t, "test2", addedKey.KeyID)
+
+			assert.Len(t, mkc.entries, len(test.expectedKeys))
+			for _, keyID := range test.expectedKeys {
+				assert.Contains(t, mkc.entries, keyID)
+			}
+		})
+	}
+}
+
+func TestNegativeMaxCacheSize(t *testing.T) {
+	for _, maxCacheSize := range []int{MaxCacheSizeNoCheck, -2, -100} {
+		t.Run(fmt.Sprintf("max size %d", maxCacheSize), func(t *testing.T) {
+			mkc := NewMemoryKeyCacher(time.Duration(100)*time.Second, maxCacheSize).(*memoryKeyCacher)
+			assert.Equal(t, MaxCacheSizeNoCheck, mkc.maxCacheSize)
+
+			for i := 0; i < 10; i++ {
+				keyID := fmt.Sprintf("test%d", i)
+				_, err := mkc.Add(keyID, []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: keyID}})
+				assert.NoError(t, err)
+			}
+			assert.Len(t, mkc.entries, 10)
+		})
+	}
+}
+
+func TestEntryIsExpired(t *testing.T) {
 	tests := []struct {
 		name         string
 		mkc          *memoryKeyCacher
@@ -359,7 +461,7 @@ func TestKeyIsExpired(t *testing.T) {
 		{
 			name: "true - key is expired",
 			mkc: &memoryKeyCacher{
-				entries:      map[string]keyCacherEntry{},
+				entries:      map[string]*keyCacherEntry{},
 				maxKeyAge:    time.Duration(1) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -368,7 +470,7 @@ func TestKeyIsExpired(t *testing.T) {
 		{
 			name: "false - key not expired",
 			mkc: &memoryKeyCacher{
-				entries:      map[string]keyCacherEntry{},
+				entries:      map[string]*keyCacherEntry{},
 				maxKeyAge:    time.Duration(10) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -378,11 +480,11 @@ func TestKeyIsExpired(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			if test.expectedBool {
-				test.mkc.entries["test1"] = keyCacherEntry{time.Now().Add(time.Duration(-10) * time.Second), jose.JSONWebKey{KeyID: "test1"}}
+				test.mkc.entries["test1"] = &keyCacherEntry{addedAt: time.Now().Add(time.Duration(-10) * time.Second), JSONWebKey: jose.JSONWebKey{KeyID: "test1"}}
 			} else {
-				test.mkc.entries["test1"] = keyCacherEntry{time.Now(), jose.JSONWebKey{KeyID: "test1"}}
+				test.mkc.entries["test1"] = &keyCacherEntry{addedAt: time.Now(), JSONWebKey: jose.JSONWebKey{KeyID: "test1"}}
 			}
-			if test.mkc.keyIsExpired("test1") != test.expectedBool {
+			if test.mkc.entryIsExpired(test.mkc.entries["test1"]) != test.expectedBool {
 				t.Errorf("Should have been " + strconv.FormatBool(test.expectedBool) + " but got different")
 			}
 		})
@@ -400,7 +502,7 @@ func TestHandleOverflow(t *testing.T) {
 		{
 			name: "true - overflowed and delete 1 key",
 			mkc: &memoryKeyCacher{
-				entries:      map[string]keyCacherEntry{},
+				entries:      map[string]*keyCacherEntry{},
 				maxKeyAge:    time.Duration(2) * time.Second,
 				maxCacheSize: 1,
 			},
@@ -409,7 +511,7 @@ func TestHandleOverflow(t *testing.T) {
 		{
 			name: "false - no overflow",
 			mkc: &memoryKeyCacher{
-				entries:      map[string]keyCacherEntry{},
+				entries:      map[string]*keyCacherEntry{},
 				maxKeyAge:    time.Duration(2) * time.Second,
 				maxCacheSize: 2,
 			},
@@ -418,12 +520,510 @@ func TestHandleOverflow(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			test.mkc.entries["first"] = keyCacherEntry{JSONWebKey: downloadedKeys[0]}
-			test.mkc.entries["second"] = keyCacherEntry{JSONWebKey: downloadedKeys[1]}
-			test.mkc.handleOverflow()
+			test.mkc.entries["first"] = &keyCacherEntry{JSONWebKey: downloadedKeys[0]}
+			test.mkc.entries["second"] = &keyCacherEntry{JSONWebKey: downloadedKeys[1]}
+			test.mkc.handleOverflow(nil)
 			if len(test.mkc.entries) != test.expectedLength {
 				t.Errorf("Should have been " + strconv.Itoa(test.expectedLength) + "but got different")
 			}
 		})
 	}
 }
+
+func TestEntriesByExpiry(t *testing.T) {
+	now := time.Now()
+	mkc := NewMemoryKeyCacher(time.Duration(10)*time.Minute, MaxCacheSizeNoCheck).(*memoryKeyCacher)
+	mkc.entries["late"] = &keyCacherEntry{addedAt: now, JSONWebKey: genRSASSAJWK(jose.RS256, "late")}
+	mkc.entries["soon"] = &keyCacherEntry{addedAt: now.Add(-8 * time.Minute), JSONWebKey: genRSASSAJWK(jose.RS256, "soon")}
+	mkc.entries["middle"] = &keyCacherEntry{addedAt: now.Add(-4 * time.Minute), JSONWebKey: genRSASSAJWK(jose.RS256, "middle")}
+
+	var cacher KeyCacher = mkc
+	diagnosable, ok := cacher.(DiagnosableKeyCacher)
+	if !assert.True(t, ok) {
+		t.FailNow()
+	}
+
+	infos := diagnosable.EntriesByExpiry()
+	if assert.Len(t, infos, 3) {
+		assert.Equal(t, "soon", infos[0].KeyID)
+		assert.Equal(t, "middle", infos[1].KeyID)
+		assert.Equal(t, "late", infos[2].KeyID)
+		assert.Equal(t, now.Add(2*time.Minute), infos[0].ExpiresAt)
+	}
+
+	// Only metadata is exposed.
+	infoType := reflect.TypeOf(CachedKeyInfo{})
+	for i := 0; i < infoType.NumField(); i++ {
+		field := infoType.Field(i)
+		assert.Contains(t, []reflect.Type{reflect.TypeOf(""), reflect.TypeOf(time.Time{})}, field.Type, field.Name)
+	}
+
+	// The snapshot is a copy of the entries.
+	infos[0].KeyID = "changed"
+	assert.Contains(t, mkc.entries, "soon")
+
+	mkc.maxKeyAge = MaxKeyAgeNoCheck
+	for _, info := range mkc.EntriesByExpiry() {
+		assert.True(t, info.ExpiresAt.IsZero())
+	}
+}
+
+func TestMemoryKeyCacherConcurrency(t *testing.T) {
+	mkc := NewMemoryKeyCacher(time.Millisecond, 5, WithCacheScope(CacheScopeAll)).(*memoryKeyCacher)
+	downloadedKeys := []jose.JSONWebKey{}
+	for i := 0; i < 10; i++ {
+		downloadedKeys = append(downloadedKeys, jose.JSONWebKey{Key: jose.JSONWebKey{}, KeyID: strconv.Itoa(i)})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keyID := strconv.Itoa(i % 10)
+			for j := 0; j < 50; j++ {
+				mkc.Add(keyID, downloadedKeys)
+				mkc.Get(keyID)
+				mkc.EntriesByExpiry()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, len(mkc.entries) <= 5)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       EvictionPolicy
+		expectedKeys []string
+	}{
+		{
+			name:         "FIFO evicts the key added first",
+			policy:       EvictFIFO,
+			expectedKeys: []string{"new", "newer"},
+		},
+		{
+			name:         "LRU evicts the key accessed least recently",
+			policy:       EvictLRU,
+			expectedKeys: []string{"hot", "newer"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			mkc := NewMemoryKeyCacherWithPolicy(time.Minute, 2, test.policy, WithClock(clock.Now)).(*memoryKeyCacher)
+
+			_, err := mkc.Add("hot", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "hot"}})
+			assert.NoError(t, err)
+			clock.Advance(time.Millisecond)
+			_, err = mkc.Add("new", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "new"}})
+			assert.NoError(t, err)
+			clock.Advance(time.Millisecond)
+
+			// The hot key is still actively signing.
+			_, err = mkc.Get("hot")
+			assert.NoError(t, err)
+			clock.Advance(time.Millisecond)
+
+			_, err = mkc.Add("newer", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "newer"}})
+			assert.NoError(t, err)
+
+			assert.Len(t, mkc.entries, len(test.expectedKeys))
+			for _, keyID := range test.expectedKeys {
+				assert.Contains(t, mkc.entries, keyID)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	mkc := NewMemoryKeyCacher(MaxKeyAgeNoCheck, MaxCacheSizeNoCheck)
+	downloadedKeys := []jose.JSONWebKey{
+		{Key: jose.JSONWebKey{}, KeyID: "revoked"},
+		{Key: jose.JSONWebKey{}, KeyID: "kept"},
+	}
+	_, err := mkc.Add("revoked", downloadedKeys)
+	assert.NoError(t, err)
+
+	assert.NoError(t, mkc.Remove("revoked"))
+	_, err = mkc.Get("revoked")
+	assert.Equal(t, ErrNoKeyFound, err)
+	_, err = mkc.Get("kept")
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrNoKeyFound, mkc.Remove("revoked"))
+}
+
+func TestLenAndKeys(t *testing.T) {
+	mkc := NewMemoryKeyCacher(time.Minute, MaxCacheSizeNoCheck).(InspectableKeyCacher)
+	assert.Equal(t, 0, mkc.Len())
+	assert.Equal(t, []string{}, mkc.Keys())
+
+	_, err := mkc.Add("b", []jose.JSONWebKey{
+		{Key: jose.JSONWebKey{}, KeyID: "c"},
+		{Key: jose.JSONWebKey{}, KeyID: "b"},
+		{Key: jose.JSONWebKey{}, KeyID: "a"},
+	})
+	assert.NoError(t, err)
+	mkc.(*memoryKeyCacher).entries["expired"] = &keyCacherEntry{addedAt: time.Now().Add(-time.Hour), JSONWebKey: jose.JSONWebKey{KeyID: "expired"}}
+
+	assert.Equal(t, 3, mkc.Len())
+	assert.Equal(t, []string{"a", "b", "c"}, mkc.Keys())
+}
+
+func TestHandleOverflowEvictsAllExcessEntries(t *testing.T) {
+	now := time.Now()
+	mkc := &memoryKeyCacher{
+		entries: map[string]*keyCacherEntry{
+			"old":    {addedAt: now.Add(-2 * time.Minute), JSONWebKey: jose.JSONWebKey{KeyID: "old"}},
+			"middle": {addedAt: now.Add(-time.Minute), JSONWebKey: jose.JSONWebKey{KeyID: "middle"}},
+			// An entry timed after now, e.g. after a clock adjustment,
+			// is evicted like the others.
+			"future": {addedAt: now.Add(time.Minute), JSONWebKey: jose.JSONWebKey{KeyID: "future"}},
+		},
+		maxKeyAge:    MaxKeyAgeNoCheck,
+		maxCacheSize: 0,
+	}
+	mkc.handleOverflow(nil)
+	assert.Empty(t, mkc.entries)
+
+	batch := NewMemoryKeyCacher(time.Minute, 1, WithCacheScope(CacheScopeAll))
+	_, err := batch.Add("c", []jose.JSONWebKey{
+		{Key: jose.JSONWebKey{}, KeyID: "a"},
+		{Key: jose.JSONWebKey{}, KeyID: "b"},
+		{Key: jose.JSONWebKey{}, KeyID: "c"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, batch.(InspectableKeyCacher).Keys())
+}
+
+func TestAddWithTTL(t *testing.T) {
+	clock := newFakeClock()
+	mkc := NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck, WithClock(clock.Now))
+	add := func(keyID string, ttl time.Duration) {
+		_, err := mkc.(TTLKeyCacher).AddWithTTL(keyID, []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: keyID}}, ttl)
+		assert.NoError(t, err)
+	}
+	add("short", time.Millisecond)
+	add("default", 0)
+	add("forever", MaxKeyAgeNoCheck)
+	_, err := mkc.Add("added", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "added"}})
+	assert.NoError(t, err)
+
+	clock.Advance(5 * time.Millisecond)
+	_, err = mkc.Get("short")
+	assert.Equal(t, ErrKeyExpired, err)
+	for _, keyID := range []string{"default", "forever", "added"} {
+		_, err = mkc.Get(keyID)
+		assert.NoError(t, err, keyID)
+	}
+
+	infos := map[string]CachedKeyInfo{}
+	for _, info := range mkc.(DiagnosableKeyCacher).EntriesByExpiry() {
+		infos[info.KeyID] = info
+	}
+	assert.Equal(t, infos["default"].AddedAt.Add(time.Hour), infos["default"].ExpiresAt)
+	assert.True(t, infos["forever"].ExpiresAt.IsZero())
+
+	// A ttl expires the keys of a cacher which never expires them otherwise.
+	persistent := NewMemoryKeyCacher(MaxKeyAgeNoCheck, MaxCacheSizeNoCheck, WithClock(clock.Now))
+	_, err = persistent.(TTLKeyCacher).AddWithTTL("short", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "short"}}, time.Millisecond)
+	assert.NoError(t, err)
+	clock.Advance(5 * time.Millisecond)
+	_, err = persistent.Get("short")
+	assert.Equal(t, ErrKeyExpired, err)
+}
+
+func TestExpiryJitter(t *testing.T) {
+	maxAges := func(mkc KeyCacher) map[string]time.Duration {
+		_, err := mkc.Add("a", []jose.JSONWebKey{
+			{Key: jose.JSONWebKey{}, KeyID: "a"},
+			{Key: jose.JSONWebKey{}, KeyID: "b"},
+		})
+		assert.NoError(t, err)
+		ages := map[string]time.Duration{}
+		for _, info := range mkc.(DiagnosableKeyCacher).EntriesByExpiry() {
+			if !info.ExpiresAt.IsZero() {
+				ages[info.KeyID] = info.ExpiresAt.Sub(info.AddedAt)
+			}
+		}
+		return ages
+	}
+
+	ages := maxAges(NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck, WithExpiryJitter(0.1)))
+	assert.NotEqual(t, ages["a"], ages["b"], "the keys added together should expire at distinct times")
+	for keyID, age := range ages {
+		assert.True(t, age >= 54*time.Minute && age <= 66*time.Minute, "%s expires after %v", keyID, age)
+	}
+
+	ages = maxAges(NewMemoryKeyCacher(time.Hour, MaxCacheSizeNoCheck))
+	assert.Equal(t, map[string]time.Duration{"a": time.Hour, "b": time.Hour}, ages)
+
+	ages = maxAges(NewMemoryKeyCacher(MaxKeyAgeNoCheck, MaxCacheSizeNoCheck, WithExpiryJitter(0.1)))
+	assert.Empty(t, ages, "the keys should never expire")
+}
+
+func TestResize(t *testing.T) {
+	clock := newFakeClock()
+	add := func(mkc KeyCacher, keyIDs ...string) {
+		for _, keyID := range keyIDs {
+			_, err := mkc.Add(keyID, []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: keyID}})
+			assert.NoError(t, err)
+			// The entries are ordered by their times.
+			clock.Advance(time.Millisecond)
+		}
+	}
+
+	t.Run("shrink", func(t *testing.T) {
+		observer := &recordingObserver{}
+		mkc := NewMemoryKeyCacher(time.Minute, 5, WithCacheObserver(observer), WithClock(clock.Now))
+		add(mkc, "1", "2", "3", "4", "5")
+
+		assert.NoError(t, mkc.(ResizableKeyCacher).Resize(2))
+		assert.Equal(t, []string{"4", "5"}, mkc.(InspectableKeyCacher).Keys())
+		assert.Equal(t, []string{"evict 1", "evict 2", "evict 3"}, observer.events)
+
+		add(mkc, "6")
+		assert.Equal(t, []string{"5", "6"}, mkc.(InspectableKeyCacher).Keys())
+	})
+
+	t.Run("shrink with the LRU policy", func(t *testing.T) {
+		mkc := NewMemoryKeyCacherWithPolicy(time.Minute, 5, EvictLRU, WithClock(clock.Now))
+		add(mkc, "1", "2", "3", "4", "5")
+		_, err := mkc.Get("1")
+		assert.NoError(t, err)
+
+		assert.NoError(t, mkc.(ResizableKeyCacher).Resize(2))
+		assert.Equal(t, []string{"1", "5"}, mkc.(InspectableKeyCacher).Keys())
+	})
+
+	t.Run("grow and disable the limit", func(t *testing.T) {
+		mkc := NewMemoryKeyCacher(time.Minute, 1, WithClock(clock.Now))
+		add(mkc, "1", "2")
+		assert.Equal(t, []string{"2"}, mkc.(InspectableKeyCacher).Keys())
+
+		assert.NoError(t, mkc.(ResizableKeyCacher).Resize(MaxCacheSizeNoCheck))
+		add(mkc, "3", "4", "5")
+		assert.Equal(t, []string{"2", "3", "4", "5"}, mkc.(InspectableKeyCacher).Keys())
+	})
+}
+
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnHit(keyID string)    { o.events = append(o.events, "hit "+keyID) }
+func (o *recordingObserver) OnMiss(keyID string)   { o.events = append(o.events, "miss "+keyID) }
+func (o *recordingObserver) OnEvict(keyID string)  { o.events = append(o.events, "evict "+keyID) }
+func (o *recordingObserver) OnExpire(keyID string) { o.events = append(o.events, "expire "+keyID) }
+
+func TestCacheObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	mkc := NewMemoryKeyCacher(time.Minute, 1, WithCacheObserver(observer))
+
+	_, err := mkc.Get("a")
+	assert.Equal(t, ErrNoKeyFound, err)
+	_, err = mkc.Add("a", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "a"}})
+	assert.NoError(t, err)
+	_, err = mkc.Get("a")
+	assert.NoError(t, err)
+	_, err = mkc.Add("b", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "b"}})
+	assert.NoError(t, err)
+
+	mkc.(*memoryKeyCacher).entries["b"].addedAt = time.Now().Add(-time.Hour)
+	_, err = mkc.Get("b")
+	assert.Equal(t, ErrKeyExpired, err)
+
+	assert.Equal(t, []string{"miss a", "hit a", "evict a", "expire b", "miss b"}, observer.events)
+}
+
+func TestLockObserver(t *testing.T) {
+	var mu sync.Mutex
+	var holds []time.Duration
+	mkc := NewMemoryKeyCacher(time.Minute, 1, WithLockObserver(func(wait, hold time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		holds = append(holds, hold)
+	}))
+
+	_, err := mkc.Add("a", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "a"}})
+	assert.NoError(t, err)
+	assert.Len(t, holds, 1, "the write lock of Add should be observed")
+
+	// The read lock taken by every Get is observed too.
+	for i := 0; i < 3; i++ {
+		_, err = mkc.Get("a")
+		assert.NoError(t, err)
+	}
+	assert.Len(t, holds, 4)
+	for _, hold := range holds {
+		assert.True(t, hold >= 0 && hold < 10*time.Second, "plausible hold %v", hold)
+	}
+}
+
+func TestGetRemovesExpiredKeyAfterReading(t *testing.T) {
+	mkc := NewMemoryKeyCacher(time.Minute, MaxCacheSizeNoCheck).(*memoryKeyCacher)
+	mkc.entries["expired"] = &keyCacherEntry{addedAt: time.Now().Add(-time.Hour), JSONWebKey: jose.JSONWebKey{KeyID: "expired"}}
+
+	// Checking the expiry does not delete the key.
+	assert.True(t, mkc.entryIsExpired(mkc.entries["expired"]))
+	assert.Contains(t, mkc.entries, "expired")
+
+	_, err := mkc.Get("expired")
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.NotContains(t, mkc.entries, "expired")
+
+	// An expired entry replaced concurrently is kept.
+	mkc.entries["replaced"] = &keyCacherEntry{addedAt: time.Now().Add(-time.Hour), JSONWebKey: jose.JSONWebKey{KeyID: "replaced"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mkc.Get("replaced")
+		}()
+		go func() {
+			defer wg.Done()
+			mkc.Add("replaced", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "replaced"}})
+		}()
+	}
+	wg.Wait()
+	_, err = mkc.Get("replaced")
+	assert.NoError(t, err)
+}
+
+func TestPersistentKeyCacher(t *testing.T) {
+	clock := newFakeClock()
+	mkc := NewPersistentKeyCacher(2, WithClock(clock.Now))
+	assert.True(t, mkc.(PersistentModeKeyCacher).IsPersistent())
+
+	for _, keyID := range []string{"1", "2", "3"} {
+		_, err := mkc.Add(keyID, []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: keyID}})
+		assert.NoError(t, err)
+		clock.Advance(time.Millisecond)
+	}
+	// The keys never expire but the oldest one is evicted past the max size.
+	assert.Equal(t, []string{"2", "3"}, mkc.(InspectableKeyCacher).Keys())
+
+	assert.True(t, newMemoryPersistentKeyCacher().(PersistentModeKeyCacher).IsPersistent())
+	assert.True(t, NewMemoryKeyCacher(MaxKeyAgeNoCheck, 5).(PersistentModeKeyCacher).IsPersistent())
+	assert.False(t, NewMemoryKeyCacher(time.Minute, MaxCacheSizeNoCheck).(PersistentModeKeyCacher).IsPersistent())
+}
+
+func TestCacheStats(t *testing.T) {
+	mkc := NewMemoryKeyCacher(time.Minute, 1)
+	assert.Equal(t, CacheStats{}, mkc.(StatsKeyCacher).Stats())
+
+	_, err := mkc.Get("a")
+	assert.Equal(t, ErrNoKeyFound, err)
+	_, err = mkc.Add("a", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "a"}})
+	assert.NoError(t, err)
+	_, err = mkc.Get("a")
+	assert.NoError(t, err)
+	_, err = mkc.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Size: 1}, mkc.(StatsKeyCacher).Stats())
+
+	_, err = mkc.Add("b", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Evictions: 1, Size: 1}, mkc.(StatsKeyCacher).Stats())
+
+	mkc.(*memoryKeyCacher).entries["b"].addedAt = time.Now().Add(-time.Hour)
+	_, err = mkc.Get("b")
+	assert.Equal(t, ErrKeyExpired, err)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Evictions: 1, Expiries: 1}, mkc.(StatsKeyCacher).Stats())
+}
+
+func TestGetMany(t *testing.T) {
+	observer := &recordingObserver{}
+	mkc := NewMemoryKeyCacher(time.Minute, MaxCacheSizeNoCheck, WithCacheObserver(observer))
+	for _, keyID := range []string{"a", "b", "c"} {
+		_, err := mkc.Add(keyID, []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: keyID}})
+		assert.NoError(t, err)
+	}
+	mkc.(*memoryKeyCacher).entries["c"].addedAt = time.Now().Add(-time.Hour)
+
+	keys, err := mkc.(BatchKeyCacher).GetMany([]string{"a", "b", "a", "c", "d"})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, "a", keys["a"].KeyID)
+	assert.Equal(t, "b", keys["b"].KeyID)
+
+	// The expired key is deleted and each key is reported once.
+	assert.Equal(t, []string{"a", "b"}, mkc.(InspectableKeyCacher).Keys())
+	assert.Equal(t, []string{"hit a", "hit b", "expire c", "miss c", "miss d"}, observer.events)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Expiries: 1, Size: 2}, mkc.(StatsKeyCacher).Stats())
+
+	keys, err = mkc.(BatchKeyCacher).GetMany(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestHandleOverflowTieBreak(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictFIFO, EvictLRU} {
+		// The map iteration order varies between the runs.
+		for i := 0; i < 20; i++ {
+			mkc := NewMemoryKeyCacherWithPolicy(time.Minute, MaxCacheSizeNoCheck, policy).(*memoryKeyCacher)
+			now := time.Now()
+			for _, keyID := range []string{"c", "a", "b"} {
+				mkc.entries[keyID] = &keyCacherEntry{addedAt: now, lastAccessed: now.UnixNano(), JSONWebKey: jose.JSONWebKey{KeyID: keyID}}
+			}
+
+			assert.NoError(t, mkc.Resize(1))
+			assert.Equal(t, []string{"c"}, mkc.Keys())
+		}
+	}
+
+	// The key just stored wins the tie over the smaller key IDs.
+	now := time.Now()
+	mkc := NewMemoryKeyCacher(time.Minute, 1, WithCacheScope(CacheScopeAll), WithClock(func() time.Time { return now }))
+	_, err := mkc.Add("a", []jose.JSONWebKey{
+		{Key: jose.JSONWebKey{}, KeyID: "a"},
+		{Key: jose.JSONWebKey{}, KeyID: "b"},
+	})
+	assert.NoError(t, err)
+	key, err := mkc.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", key.KeyID)
+}
+
+func TestNoOpKeyCacher(t *testing.T) {
+	nkc := NewNoOpKeyCacher()
+	downloadedKeys := []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "a"}, {Key: jose.JSONWebKey{}, KeyID: "b"}}
+
+	key, err := nkc.Add("b", downloadedKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", key.KeyID)
+	_, err = nkc.Add("c", downloadedKeys)
+	assert.Equal(t, ErrNoKeyFound, err)
+
+	_, err = nkc.Get("b")
+	assert.Equal(t, ErrNoKeyFound, err)
+	assert.Equal(t, ErrNoKeyFound, nkc.Remove("b"))
+}
+
+func TestGetReturnsCopy(t *testing.T) {
+	mkc := NewMemoryKeyCacher(time.Minute, 1)
+	_, err := mkc.Add("a", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "a", Use: "sig"}})
+	assert.NoError(t, err)
+
+	key, err := mkc.Get("a")
+	assert.NoError(t, err)
+	key.Use = "enc"
+	keys, err := mkc.(BatchKeyCacher).GetMany([]string{"a"})
+	assert.NoError(t, err)
+	keys["a"].KeyID = "modified"
+
+	cached, err := mkc.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "sig", cached.Use)
+	assert.Equal(t, "a", cached.KeyID)
+
+	// The returned key stays valid once evicted.
+	_, err = mkc.Add("b", []jose.JSONWebKey{{Key: jose.JSONWebKey{}, KeyID: "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "a", cached.KeyID)
+}
@@ -0,0 +1,27 @@
+package auth0
+
+// Logger receives the diagnostics of the JWKClient and the JWTValidator,
+// e.g. the downloads of the keys and the reasons of the failed validations.
+// Its methods format their arguments as fmt.Printf does, so that it is
+// easily adapted to the logging library of the application.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards the diagnostics when no logger is provided.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// loggerOrNop returns the logger, or a logger discarding
+// the diagnostics when nil.
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
@@ -0,0 +1,99 @@
+package auth0
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func (l *recordingLogger) hasLine(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestJWKClientLogger(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "a")
+	var failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	logger := &recordingLogger{}
+	client := NewJWKClient(NewJWKClientOptions(ts.URL, WithLogger(logger), func(o *JWKClientOptions) {
+		o.AllowInsecureJWKS = true
+	}), nil)
+
+	_, err := client.GetKey("a")
+	assert.NoError(t, err)
+	_, err = client.GetKey("a")
+	assert.NoError(t, err)
+	assert.True(t, logger.hasLine(`debug key "a" is not cached`))
+	assert.True(t, logger.hasLine("debug downloading the keys from "+ts.URL))
+	assert.True(t, logger.hasLine("debug downloaded 1 keys from "+ts.URL))
+	assert.True(t, logger.hasLine(`debug key "a" served from the cache`))
+
+	atomic.StoreInt32(&failing, 1)
+	_, err = client.GetKey("b")
+	assert.Error(t, err)
+	assert.True(t, logger.hasLine("error downloading the keys from "+ts.URL+" failed"))
+
+	// Without logger, the diagnostics are discarded.
+	client = NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, err = client.GetKey("b")
+	assert.Error(t, err)
+}
+
+func TestConfigurationLogger(t *testing.T) {
+	token := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, []byte("another secret"))
+
+	logger := &recordingLogger{}
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	configuration.Logger = logger
+	validator, req := genTestConfiguration(configuration, token)
+
+	_, err := validator.ValidateRequest(req)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"debug token validation failed at the signature step: " + jose.ErrCryptoFailure.Error()}, logger.lines)
+}
@@ -0,0 +1,189 @@
+package auth0
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// contextKey is the type of the keys under which
+// the middleware stores values in the request context.
+type contextKey int
+
+const (
+	rawTokenContextKey contextKey = iota
+	// TokenContextKey is the key under which the middleware stores
+	// the validated *jwt.JSONWebToken in the request context.
+	TokenContextKey
+	claimsContextKey
+)
+
+// MiddlewareOption configures the optional
+// behaviors of the middleware.
+type MiddlewareOption func(*middleware)
+
+type middleware struct {
+	validator *JWTValidator
+	rawToken  func(r *http.Request) (string, error)
+	scopes    []string
+	mapError  ErrorMapper
+	writeErr  func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// WithRawToken stores the compact serialized token of the validated
+// requests in their context, where RawTokenFromContext retrieves it
+// to forward the token to downstream services.
+// The extract function reads the raw token from the request, the
+// Bearer token of the authentication header being read when nil.
+// It replaces the extractor of the validator, so that the stored
+// token is the very one validated: validators reading the token
+// from a cookie or a query parameter must pass the matching function.
+func WithRawToken(extract func(r *http.Request) (string, error)) MiddlewareOption {
+	if extract == nil {
+		extract = RawFromHeader
+	}
+	return func(m *middleware) {
+		m.rawToken = extract
+	}
+}
+
+// RequireScope rejects the requests whose valid token does not grant
+// all the provided scopes with a 403 status and an insufficient_scope
+// challenge, as described in section 3.1 of RFC 6750. The scopes are
+// granted as with HasScope, by the scope or the permissions claim.
+func RequireScope(scopes ...string) MiddlewareOption {
+	return func(m *middleware) {
+		m.scopes = append(m.scopes, scopes...)
+	}
+}
+
+// WithErrorMapper overrides DefaultErrorMapper for this middleware.
+func WithErrorMapper(mapper ErrorMapper) MiddlewareOption {
+	return func(m *middleware) {
+		m.mapError = mapper
+	}
+}
+
+// WithErrorWriter replaces the response written for the rejected
+// requests, e.g. to answer a JSON body. The error is the one returned
+// by the validation, ErrInsufficientScope for a missing scope.
+func WithErrorWriter(write func(w http.ResponseWriter, r *http.Request, err error)) MiddlewareOption {
+	return func(m *middleware) {
+		m.writeErr = write
+	}
+}
+
+// Middleware validates the token of the incoming requests
+// with the validator before calling the next handler, which reads
+// the validated token and its claims from the request context
+// with TokenFromContext and ClaimsFromContext.
+// Requests without a valid token are rejected with the status
+// and Bearer challenge of the error mapper, a 401 by default.
+func Middleware(validator *JWTValidator, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	m := &middleware{validator: validator}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, raw, claims, err := m.validate(r)
+			if err != nil {
+				m.reject(w, r, err)
+				return
+			}
+
+			if missing := missingScopes(scopes(claims), m.scopes); len(missing) > 0 {
+				m.reject(w, r, ErrInsufficientScope)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), TokenContextKey, token)
+			ctx = WithClaims(ctx, claims)
+			if m.rawToken != nil {
+				ctx = context.WithValue(ctx, rawTokenContextKey, raw)
+			}
+			r = r.WithContext(ctx)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validate validates the token of the request, extracted with the
+// raw token function when set, in which case the raw token is returned.
+// The claims are decoded within the verification of the signature.
+func (m *middleware) validate(r *http.Request) (*jwt.JSONWebToken, string, map[string]interface{}, error) {
+	result := validationResult{claims: map[string]interface{}{}}
+	if m.rawToken == nil {
+		token, err := m.validator.validateRequestWithLeeway(r, m.validator.extractor, m.validator.config.leeway(), &result)
+		return token, "", result.claims, err
+	}
+
+	var raw string
+	extractor := RequestTokenExtractorFunc(func(r *http.Request) (*jwt.JSONWebToken, error) {
+		var err error
+		if raw, err = m.rawToken(r); err != nil {
+			return nil, err
+		}
+		if raw == "" {
+			return nil, ErrTokenNotFound
+		}
+		return parseToken(raw)
+	})
+	token, err := m.validator.validateRequestWithLeeway(r, extractor, m.validator.config.leeway(), &result)
+	return token, raw, result.claims, err
+}
+
+// reject answers the status, challenge and message mapped from the error.
+// The insufficient_scope challenge lists the required scopes, if any.
+func (m *middleware) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if m.writeErr != nil {
+		m.writeErr(w, r, err)
+		return
+	}
+	mapError := m.mapError
+	if mapError == nil {
+		mapError = DefaultErrorMapper
+	}
+	status, code, message := mapError(err)
+
+	challenge := "Bearer"
+	if code != "" {
+		challenge += fmt.Sprintf(` error="%s"`, code)
+	}
+	if code == "insufficient_scope" && len(m.scopes) > 0 {
+		challenge += fmt.Sprintf(`, scope="%s"`, strings.Join(m.scopes, " "))
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, message, status)
+}
+
+// RawTokenFromContext returns the compact serialized token
+// stored by the middleware in the request context.
+func RawTokenFromContext(ctx context.Context) (string, bool) {
+	raw, ok := ctx.Value(rawTokenContextKey).(string)
+	return raw, ok
+}
+
+// TokenFromContext returns the validated token
+// stored by the middleware in the request context.
+func TokenFromContext(ctx context.Context) (*jwt.JSONWebToken, bool) {
+	token, ok := ctx.Value(TokenContextKey).(*jwt.JSONWebToken)
+	return token, ok
+}
+
+// WithClaims returns a copy of the context storing the claims,
+// as done by the middleware for the validated token.
+func WithClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// ClaimsFromContext returns the claims of the validated token
+// stored by the middleware in the request context.
+func ClaimsFromContext(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims, ok
+}
@@ -0,0 +1,283 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestMiddlewareRawToken(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	expiredToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	fromCookie := WithRawToken(func(r *http.Request) (string, error) {
+		cookie, err := r.Cookie("access_token")
+		if err != nil {
+			return "", ErrTokenNotFound
+		}
+		return cookie.Value, nil
+	})
+
+	tests := []struct {
+		name           string
+		opts           []MiddlewareOption
+		token          string
+		cookie         string
+		expectedStatus int
+		expectedRaw    string
+	}{
+		{
+			name:           "raw token stored when enabled",
+			opts:           []MiddlewareOption{WithRawToken(nil)},
+			token:          validToken,
+			expectedStatus: http.StatusOK,
+			expectedRaw:    validToken,
+		},
+		{
+			name:           "raw token not stored when disabled",
+			token:          validToken,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid token rejected",
+			opts:           []MiddlewareOption{WithRawToken(nil)},
+			token:          expiredToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "raw token read from a cookie",
+			opts:           []MiddlewareOption{fromCookie},
+			cookie:         validToken,
+			expectedStatus: http.StatusOK,
+			expectedRaw:    validToken,
+		},
+		{
+			name:           "raw token validated rather than the header token",
+			opts:           []MiddlewareOption{fromCookie},
+			token:          validToken,
+			cookie:         expiredToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator, req := genTestConfiguration(configuration, test.token)
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "access_token", Value: test.cookie})
+			}
+
+			var raw string
+			var called, found bool
+			handler := Middleware(validator, test.opts...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				raw, found = RawTokenFromContext(r.Context())
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			assert.Equal(t, test.expectedStatus == http.StatusOK, called)
+			assert.Equal(t, test.expectedRaw != "", found)
+			assert.Equal(t, test.expectedRaw, raw)
+		})
+	}
+}
+
+func TestMiddlewareRequireScope(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	claims := func(scope interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss": defaultIssuer,
+			"aud": defaultAudience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		if scope != nil {
+			claims["scope"] = scope
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name              string
+		token             string
+		expectedStatus    int
+		expectedChallenge string
+	}{
+		{
+			name:           "all scopes granted",
+			token:          getTestTokenWithClaims(claims("openid read:messages write:messages"), jose.HS256, defaultSecret),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:              "scope missing",
+			token:             getTestTokenWithClaims(claims("openid read:messages"), jose.HS256, defaultSecret),
+			expectedStatus:    http.StatusForbidden,
+			expectedChallenge: `Bearer error="insufficient_scope", scope="read:messages write:messages"`,
+		},
+		{
+			name:           "all scopes granted as an array",
+			token:          getTestTokenWithClaims(claims([]string{"read:messages", "write:messages"}), jose.HS256, defaultSecret),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "all scopes granted as permissions",
+			token: getTestTokenWithClaims(map[string]interface{}{
+				"iss":         defaultIssuer,
+				"aud":         defaultAudience,
+				"exp":         time.Now().Add(time.Hour).Unix(),
+				"permissions": []string{"read:messages", "write:messages"},
+			}, jose.HS256, defaultSecret),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:              "scope claim absent",
+			token:             getTestTokenWithClaims(claims(nil), jose.HS256, defaultSecret),
+			expectedStatus:    http.StatusForbidden,
+			expectedChallenge: `Bearer error="insufficient_scope", scope="read:messages write:messages"`,
+		},
+		{
+			name:              "invalid token",
+			token:             getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret),
+			expectedStatus:    http.StatusUnauthorized,
+			expectedChallenge: `Bearer error="invalid_token"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator, req := genTestConfiguration(configuration, test.token)
+			handler := Middleware(validator, RequireScope("read:messages", "write:messages"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			assert.Equal(t, test.expectedChallenge, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestMiddlewareInsufficientScopeWithoutRequiredScopes(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	expiredToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	validator, req := genTestConfiguration(configuration, expiredToken)
+	mapper := func(err error) (int, string, string) {
+		return http.StatusForbidden, "insufficient_scope", "forbidden"
+	}
+	handler := Middleware(validator, WithErrorMapper(mapper))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestMiddlewareTokenFromContext(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	validator, req := genTestConfiguration(configuration, validToken)
+
+	var token *jwt.JSONWebToken
+	var found bool
+	handler := Middleware(validator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found = TokenFromContext(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, found)
+	if assert.NotNil(t, token) {
+		claims := jwt.Claims{}
+		assert.NoError(t, validator.Claims(token, &claims))
+		assert.Equal(t, defaultIssuer, claims.Issuer)
+	}
+
+	_, found = TokenFromContext(context.Background())
+	assert.False(t, found)
+}
+
+func TestMiddlewareErrorWriter(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	expiredToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	validator, req := genTestConfiguration(configuration, expiredToken)
+
+	var written error
+	handler := Middleware(validator, WithErrorWriter(func(w http.ResponseWriter, r *http.Request, err error) {
+		written = err
+		w.WriteHeader(http.StatusTeapot)
+	}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the next handler should not be called")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Empty(t, rec.Header().Get("WWW-Authenticate"))
+	assert.True(t, errors.Is(written, jwt.ErrExpired), "got %v", written)
+}
+
+func TestMiddlewareClaimsFromContext(t *testing.T) {
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	validator, req := genTestConfiguration(configuration, validToken)
+
+	var claims map[string]interface{}
+	var found bool
+	handler := Middleware(validator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, found = ClaimsFromContext(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, found)
+	assert.Equal(t, defaultIssuer, claims["iss"])
+
+	_, found = ClaimsFromContext(context.Background())
+	assert.False(t, found)
+
+	stored := map[string]interface{}{"sub": "user"}
+	claims, found = ClaimsFromContext(WithClaims(context.Background(), stored))
+	assert.True(t, found)
+	assert.Equal(t, stored, claims)
+}
+
+func TestMiddlewareVerifiesOnce(t *testing.T) {
+	var lookups int
+	provider := SecretProviderFunc(func(token *jwt.JSONWebToken) (interface{}, error) {
+		lookups++
+		return defaultSecret, nil
+	})
+	configuration := NewConfiguration(provider, defaultAudience, defaultIssuer, jose.HS256)
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+
+	for _, opts := range [][]MiddlewareOption{nil, {WithRawToken(nil)}} {
+		lookups = 0
+		validator, req := genTestConfiguration(configuration, validToken)
+		var claims map[string]interface{}
+		handler := Middleware(validator, opts...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ = ClaimsFromContext(r.Context())
+		}))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, defaultIssuer, claims["iss"])
+		assert.Equal(t, 1, lookups, "the claims should be decoded with the validation")
+	}
+}
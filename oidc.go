@@ -0,0 +1,84 @@
+package auth0
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	// Registering the hash functions used by the OIDC hash claims.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	// ErrInvalidAccessTokenHash is returned when the at_hash claim of an ID token
+	// is missing or does not match the access token.
+	ErrInvalidAccessTokenHash = errors.New("at_hash claim does not match the access token")
+	// ErrInvalidCodeHash is returned when the c_hash claim of an ID token
+	// is missing or does not match the authorization code.
+	ErrInvalidCodeHash = errors.New("c_hash claim does not match the authorization code")
+	// ErrUnsupportedHashAlgorithm is returned when no OIDC hash function
+	// can be derived from the signing algorithm.
+	ErrUnsupportedHashAlgorithm = errors.New("no hash function for the signing algorithm")
+)
+
+// ValidateAccessTokenHash checks that the at_hash claim of the provided
+// ID token claims binds the ID token to the access token, as described in
+// section 3.1.3.6 of OpenID Connect Core.
+// The algorithm is the one used to sign the ID token.
+func ValidateAccessTokenHash(claims map[string]interface{}, accessToken string, alg jose.SignatureAlgorithm) error {
+	return validateOIDCHash(claims, "at_hash", accessToken, alg, ErrInvalidAccessTokenHash)
+}
+
+// ValidateCodeHash checks that the c_hash claim of the provided
+// ID token claims binds the ID token to the authorization code, as described
+// in section 3.3.2.11 of OpenID Connect Core.
+// The algorithm is the one used to sign the ID token.
+func ValidateCodeHash(claims map[string]interface{}, code string, alg jose.SignatureAlgorithm) error {
+	return validateOIDCHash(claims, "c_hash", code, alg, ErrInvalidCodeHash)
+}
+
+func validateOIDCHash(claims map[string]interface{}, claim string, value string, alg jose.SignatureAlgorithm, mismatch error) error {
+	expected, ok := claims[claim].(string)
+	if !ok || expected == "" {
+		return mismatch
+	}
+
+	computed, err := oidcHash(value, alg)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(computed)) != 1 {
+		return mismatch
+	}
+	return nil
+}
+
+// oidcHash computes the base64url encoding of the left-most half
+// of the hash of value, using the hash function of the signing algorithm.
+func oidcHash(value string, alg jose.SignatureAlgorithm) (string, error) {
+	var h crypto.Hash
+	switch {
+	case alg == jose.EdDSA:
+		h = crypto.SHA512
+	case strings.HasSuffix(string(alg), "256"):
+		h = crypto.SHA256
+	case strings.HasSuffix(string(alg), "384"):
+		h = crypto.SHA384
+	case strings.HasSuffix(string(alg), "512"):
+		h = crypto.SHA512
+	default:
+		return "", ErrUnsupportedHashAlgorithm
+	}
+
+	hasher := h.New()
+	hasher.Write([]byte(value))
+	sum := hasher.Sum(nil)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
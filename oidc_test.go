@@ -0,0 +1,79 @@
+package auth0
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Values taken from the examples of OpenID Connect Core, appendix A.
+const (
+	oidcAccessToken = "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"
+	oidcAtHash      = "77QmUPtjPfzWtF2AnpK9RQ"
+	oidcCode        = "Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk"
+	oidcCHash       = "LDktKdoQak3Pk0cnXxCltA"
+)
+
+func TestValidateAccessTokenHash(t *testing.T) {
+	tests := []struct {
+		name             string
+		claims           map[string]interface{}
+		accessToken      string
+		alg              jose.SignatureAlgorithm
+		expectedErrorMsg string
+	}{
+		{
+			name:        "pass - matching at_hash",
+			claims:      map[string]interface{}{"at_hash": oidcAtHash},
+			accessToken: oidcAccessToken,
+			alg:         jose.RS256,
+		},
+		{
+			name:             "fail - at_hash bound to another access token",
+			claims:           map[string]interface{}{"at_hash": oidcAtHash},
+			accessToken:      "another-access-token",
+			alg:              jose.RS256,
+			expectedErrorMsg: ErrInvalidAccessTokenHash.Error(),
+		},
+		{
+			name:             "fail - at_hash computed with another hash function",
+			claims:           map[string]interface{}{"at_hash": oidcAtHash},
+			accessToken:      oidcAccessToken,
+			alg:              jose.RS512,
+			expectedErrorMsg: ErrInvalidAccessTokenHash.Error(),
+		},
+		{
+			name:             "fail - missing at_hash",
+			claims:           map[string]interface{}{},
+			accessToken:      oidcAccessToken,
+			alg:              jose.RS256,
+			expectedErrorMsg: ErrInvalidAccessTokenHash.Error(),
+		},
+		{
+			name:             "fail - unsupported algorithm",
+			claims:           map[string]interface{}{"at_hash": oidcAtHash},
+			accessToken:      oidcAccessToken,
+			alg:              jose.SignatureAlgorithm("none"),
+			expectedErrorMsg: ErrUnsupportedHashAlgorithm.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateAccessTokenHash(test.claims, test.accessToken, test.alg)
+			if test.expectedErrorMsg != "" {
+				assert.EqualError(t, err, test.expectedErrorMsg)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateCodeHash(t *testing.T) {
+	claims := map[string]interface{}{"c_hash": oidcCHash}
+
+	assert.NoError(t, ValidateCodeHash(claims, oidcCode, jose.RS256))
+	assert.Equal(t, ErrInvalidCodeHash, ValidateCodeHash(claims, "another-code", jose.RS256))
+}
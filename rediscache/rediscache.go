@@ -0,0 +1,118 @@
+// Package rediscache provides a KeyCacher backed by Redis, so that
+// the keys downloaded by a pod are shared with the others.
+// It is a separate module to keep the Redis dependency optional.
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/auth0-community/go-auth0"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/square/go-jose.v2"
+)
+
+type redisKeyCacher struct {
+	client redis.UniversalClient
+	prefix string
+	maxAge time.Duration
+}
+
+// entry is the value stored for each key. The time it was added
+// detects the keys outliving their max age, e.g. on clock skew
+// between the pods and Redis.
+type entry struct {
+	AddedAt time.Time       `json:"added_at"`
+	Key     jose.JSONWebKey `json:"key"`
+}
+
+// NewRedisKeyCacher creates a new KeyCacher storing the keys under
+// prefix:keyID, with a Redis TTL of maxAge. With auth0.MaxKeyAgeNoCheck
+// the keys never expire, while with a zero or another negative maxAge
+// they expire at once and are not stored. All the downloaded keys are
+// stored, so that the other pods find them without downloading them again.
+func NewRedisKeyCacher(client redis.UniversalClient, prefix string, maxAge time.Duration) auth0.KeyCacher {
+	return &redisKeyCacher{
+		client: client,
+		prefix: prefix,
+		maxAge: maxAge,
+	}
+}
+
+// Get obtains a key from Redis, and checks if the key is expired
+func (rkc *redisKeyCacher) Get(keyID string) (*jose.JSONWebKey, error) {
+	data, err := rkc.client.Get(context.Background(), rkc.redisKey(keyID)).Bytes()
+	if err == redis.Nil {
+		return nil, auth0.ErrNoKeyFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if rkc.maxAge != auth0.MaxKeyAgeNoCheck && time.Now().After(e.AddedAt.Add(rkc.maxAge)) {
+		return nil, auth0.ErrKeyExpired
+	}
+	return &e.Key, nil
+}
+
+// Add stores the downloaded keys in a single pipeline
+// and returns a copy of the key with the provided ID
+func (rkc *redisKeyCacher) Add(keyID string, downloadedKeys []jose.JSONWebKey) (*jose.JSONWebKey, error) {
+	var addingKey *jose.JSONWebKey
+	for _, key := range downloadedKeys {
+		if key.KeyID == keyID {
+			addingKey = &key
+			break
+		}
+	}
+	if rkc.maxAge != auth0.MaxKeyAgeNoCheck && rkc.maxAge <= 0 {
+		if addingKey == nil {
+			return nil, auth0.ErrNoKeyFound
+		}
+		return addingKey, nil
+	}
+
+	now := time.Now()
+	ttl := rkc.maxAge
+	if ttl == auth0.MaxKeyAgeNoCheck {
+		ttl = 0
+	}
+
+	pipe := rkc.client.Pipeline()
+	for _, key := range downloadedKeys {
+		data, err := json.Marshal(entry{AddedAt: now, Key: key})
+		if err != nil {
+			return nil, err
+		}
+		pipe.Set(context.Background(), rkc.redisKey(key.KeyID), data, ttl)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if addingKey == nil {
+		return nil, auth0.ErrNoKeyFound
+	}
+	return addingKey, nil
+}
+
+// Remove deletes a key from Redis
+func (rkc *redisKeyCacher) Remove(keyID string) error {
+	deleted, err := rkc.client.Del(context.Background(), rkc.redisKey(keyID)).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return auth0.ErrNoKeyFound
+	}
+	return nil
+}
+
+func (rkc *redisKeyCacher) redisKey(keyID string) string {
+	return rkc.prefix + ":" + keyID
+}
@@ -0,0 +1,104 @@
+package rediscache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/auth0-community/go-auth0"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func genKeyCacher(t *testing.T, maxAge time.Duration) (auth0.KeyCacher, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisKeyCacher(client, "jwks", maxAge), server
+}
+
+func TestAddAndGet(t *testing.T) {
+	keyCacher, server := genKeyCacher(t, time.Minute)
+	downloadedKeys := []jose.JSONWebKey{
+		{Key: []byte("secret1"), KeyID: "test1", Algorithm: "HS256"},
+		{Key: []byte("secret2"), KeyID: "test2", Algorithm: "HS256"},
+	}
+
+	addedKey, err := keyCacher.Add("test2", downloadedKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, "test2", addedKey.KeyID)
+
+	for _, keyID := range []string{"test1", "test2"} {
+		key, err := keyCacher.Get(keyID)
+		assert.NoError(t, err)
+		assert.Equal(t, keyID, key.KeyID)
+		assert.Equal(t, "HS256", key.Algorithm)
+		assert.Equal(t, time.Minute, server.TTL("jwks:"+keyID))
+	}
+
+	_, err = keyCacher.Get("unknown")
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+	_, err = keyCacher.Add("unknown", downloadedKeys)
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+}
+
+func TestGetExpired(t *testing.T) {
+	keyCacher, server := genKeyCacher(t, time.Minute)
+	_, err := keyCacher.Add("test1", []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}})
+	assert.NoError(t, err)
+
+	// Removed by Redis once the TTL is over.
+	server.FastForward(time.Minute)
+	_, err = keyCacher.Get("test1")
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+
+	// Outliving its max age in Redis, e.g. on clock skew.
+	server.Set("jwks:test2", `{"added_at":"2000-01-01T00:00:00Z","key":{"kty":"oct","kid":"test2","k":"c2VjcmV0Mg"}}`)
+	_, err = keyCacher.Get("test2")
+	assert.Equal(t, auth0.ErrKeyExpired, err)
+}
+
+func TestNoMaxAge(t *testing.T) {
+	keyCacher, server := genKeyCacher(t, auth0.MaxKeyAgeNoCheck)
+	_, err := keyCacher.Add("test1", []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), server.TTL("jwks:test1"))
+
+	_, err = keyCacher.Get("test1")
+	assert.NoError(t, err)
+}
+
+func TestZeroMaxAge(t *testing.T) {
+	keyCacher, server := genKeyCacher(t, 0)
+	addedKey, err := keyCacher.Add("test1", []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "test1", addedKey.KeyID)
+	assert.False(t, server.Exists("jwks:test1"), "the keys expiring at once should not be stored")
+
+	_, err = keyCacher.Get("test1")
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+	_, err = keyCacher.Add("unknown", []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}})
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+}
+
+func TestAddReturnsCopy(t *testing.T) {
+	keyCacher, _ := genKeyCacher(t, time.Minute)
+	downloadedKeys := []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}}
+
+	addedKey, err := keyCacher.Add("test1", downloadedKeys)
+	assert.NoError(t, err)
+	addedKey.KeyID = "modified"
+	assert.Equal(t, "test1", downloadedKeys[0].KeyID)
+}
+
+func TestRemove(t *testing.T) {
+	keyCacher, _ := genKeyCacher(t, time.Minute)
+	_, err := keyCacher.Add("test1", []jose.JSONWebKey{{Key: []byte("secret1"), KeyID: "test1"}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, keyCacher.Remove("test1"))
+	_, err = keyCacher.Get("test1")
+	assert.Equal(t, auth0.ErrNoKeyFound, err)
+	assert.Equal(t, auth0.ErrNoKeyFound, keyCacher.Remove("test1"))
+}
@@ -0,0 +1,120 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jitter selects how the delays of a RetryPolicy are randomized.
+type Jitter int
+
+const (
+	// NoJitter waits for the exact exponential delay.
+	NoJitter Jitter = iota
+	// FullJitter waits for a random delay between
+	// zero and the exponential delay.
+	FullJitter
+	// EqualJitter waits for half the exponential delay plus
+	// a random delay up to the other half.
+	EqualJitter
+)
+
+// RetryPolicy retries the failed downloads of the keys with
+// an exponential backoff, bounded by MaxDelay and decorrelated
+// across instances by the jitter. Only the network errors and the
+// 5xx statuses are retried, the other failures being permanent.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of downloads, the first included.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry,
+	// doubled for each of the following ones.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	// Zero leaves the delay uncapped.
+	MaxDelay time.Duration
+	Jitter   Jitter
+	// Rand is the source of the jitter, math/rand being used when nil.
+	// It may be shared by concurrent downloads and clients, its use
+	// being serialized, but must not be used elsewhere meanwhile.
+	Rand *rand.Rand
+}
+
+// randMu serializes the uses of the RetryPolicy.Rand sources,
+// which are not safe for concurrent use unlike math/rand.
+var randMu sync.Mutex
+
+// delay returns the time to wait before the provided retry, zero based.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < retry; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		if d > time.Duration(1<<62) {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	switch p.Jitter {
+	case FullJitter:
+		return time.Duration(p.int63n(int64(d) + 1))
+	case EqualJitter:
+		half := d / 2
+		return d - half + time.Duration(p.int63n(int64(half)+1))
+	}
+	return d
+}
+
+func (p RetryPolicy) int63n(n int64) int64 {
+	if p.Rand != nil {
+		randMu.Lock()
+		defer randMu.Unlock()
+		return p.Rand.Int63n(n)
+	}
+	return rand.Int63n(n)
+}
+
+// RetryError is returned when a download with a RetryPolicy fails.
+// It gathers the errors of all the attempts and unwraps to the last one.
+type RetryError struct {
+	Attempts []error
+}
+
+func (e *RetryError) Error() string {
+	messages := make([]string, len(e.Attempts))
+	for i, err := range e.Attempts {
+		messages[i] = fmt.Sprintf("attempt %d: %v", i+1, err)
+	}
+	return fmt.Sprintf("downloading the keys failed after %d attempts: %s", len(e.Attempts), strings.Join(messages, "; "))
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Attempts[len(e.Attempts)-1]
+}
+
+// retryable reports whether a failed download is worth retrying:
+// a network error or a 5xx status of the JWKS endpoint.
+func retryable(err error) bool {
+	var statusErr *JWKSStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
@@ -0,0 +1,119 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+	assert.Equal(t, 100*time.Millisecond, policy.delay(0))
+	assert.Equal(t, 200*time.Millisecond, policy.delay(1))
+	assert.Equal(t, 1600*time.Millisecond, policy.delay(4))
+	assert.Equal(t, 2*time.Second, policy.delay(5))
+	assert.Equal(t, 2*time.Second, policy.delay(100))
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter Jitter
+		min    func(time.Duration) time.Duration
+	}{
+		{
+			name:   "full jitter",
+			jitter: FullJitter,
+			min:    func(d time.Duration) time.Duration { return 0 },
+		},
+		{
+			name:   "equal jitter",
+			jitter: EqualJitter,
+			min:    func(d time.Duration) time.Duration { return d / 2 },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unjittered := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+			policy := unjittered
+			policy.Jitter = test.jitter
+			policy.Rand = rand.New(rand.NewSource(1))
+
+			jittered := false
+			for retry := 0; retry < 20; retry++ {
+				d := policy.delay(retry)
+				assert.True(t, d <= policy.MaxDelay, "delay %v exceeds the cap", d)
+				assert.True(t, d >= test.min(unjittered.delay(retry)), "delay %v below the jitter floor", d)
+				if d != unjittered.delay(retry) {
+					jittered = true
+				}
+			}
+			assert.True(t, jittered, "jitter should be applied")
+
+			seeded := unjittered
+			seeded.Jitter = test.jitter
+			seeded.Rand = rand.New(rand.NewSource(1))
+			policy.Rand = rand.New(rand.NewSource(1))
+			for retry := 0; retry < 20; retry++ {
+				assert.Equal(t, seeded.delay(retry), policy.delay(retry), "seeded jitter should be deterministic")
+			}
+		})
+	}
+}
+
+func TestRetryPolicySharedRand(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, Jitter: FullJitter, Rand: rand.New(rand.NewSource(1))}
+
+	// Run with -race: the source is shared by the concurrent downloads.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for retry := 0; retry < 100; retry++ {
+				policy.delay(0)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "network error", err: &url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("connection refused")}, retryable: true},
+		{name: "server error", err: &JWKSStatusError{StatusCode: http.StatusBadGateway}, retryable: true},
+		{name: "client error", err: &JWKSStatusError{StatusCode: http.StatusForbidden}, retryable: false},
+		{name: "cancelled download", err: &url.Error{Op: "Get", URL: "https://example.com", Err: context.Canceled}, retryable: false},
+		{name: "invalid content type", err: ErrInvalidContentType, retryable: false},
+		{name: "insecure URI", err: ErrInsecureJWKSURI, retryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.retryable, retryable(test.err))
+		})
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	err := &RetryError{Attempts: []error{
+		&JWKSStatusError{StatusCode: http.StatusServiceUnavailable},
+		ErrInvalidContentType,
+	}}
+	assert.Equal(t, "downloading the keys failed after 2 attempts: attempt 1: JWKS endpoint returned 503; attempt 2: should have a JSON content type for JWKS endpoint", err.Error())
+	assert.True(t, errors.Is(err, ErrInvalidContentType))
+	assert.False(t, errors.Is(err, ErrJWKSStatus), "only the last attempt is unwrapped")
+}
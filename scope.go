@@ -0,0 +1,76 @@
+package auth0
+
+import (
+	"errors"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrInsufficientScope is returned when a valid
+	// token does not grant the required scopes.
+	ErrInsufficientScope = errors.New("token does not grant the required scope")
+)
+
+// HasScope reports whether the token grants the scope, either in its
+// scope claim or in the permissions claim of the Auth0 RBAC. The claims
+// are read with the key which verified the token, e.g. the one returned
+// by the secret provider of the validator.
+func HasScope(token *jwt.JSONWebToken, key interface{}, scope string) (bool, error) {
+	claims := map[string]interface{}{}
+	if err := token.Claims(key, &claims); err != nil {
+		return false, err
+	}
+	return len(missingScopes(scopes(claims), []string{scope})) == 0, nil
+}
+
+// scopes returns the scopes granted by the scope claim, either
+// a space separated list as described in RFC 8693 or, as emitted
+// by some providers, an array of strings, along with the ones
+// granted by the permissions claim of the Auth0 RBAC.
+func scopes(claims map[string]interface{}) []string {
+	return append(claimValues(claims["scope"]), claimValues(claims["permissions"])...)
+}
+
+// claimValues returns the space separated values of
+// a claim, either a string or an array of strings.
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var granted []string
+		for _, s := range value {
+			if s, ok := s.(string); ok {
+				granted = append(granted, strings.Fields(s)...)
+			}
+		}
+		return granted
+	case []string:
+		var granted []string
+		for _, s := range value {
+			granted = append(granted, strings.Fields(s)...)
+		}
+		return granted
+	}
+	return nil
+}
+
+// missingScopes returns the required scopes which are not granted.
+func missingScopes(granted []string, required []string) []string {
+	var missing []string
+	for _, r := range required {
+		found := false
+		for _, g := range granted {
+			if g == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
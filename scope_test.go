@@ -0,0 +1,83 @@
+package auth0
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		expected []string
+	}{
+		{
+			name:     "space delimited string",
+			claims:   map[string]interface{}{"scope": "openid  read:messages"},
+			expected: []string{"openid", "read:messages"},
+		},
+		{
+			name:     "array of strings",
+			claims:   map[string]interface{}{"scope": []interface{}{"openid", "read:messages"}},
+			expected: []string{"openid", "read:messages"},
+		},
+		{
+			name:     "array with non string elements",
+			claims:   map[string]interface{}{"scope": []interface{}{"openid", 42.0}},
+			expected: []string{"openid"},
+		},
+		{
+			name:     "permissions claim",
+			claims:   map[string]interface{}{"scope": "openid", "permissions": []interface{}{"read:messages"}},
+			expected: []string{"openid", "read:messages"},
+		},
+		{
+			name:   "absent claim",
+			claims: map[string]interface{}{},
+		},
+		{
+			name:   "unexpected type",
+			claims: map[string]interface{}{"scope": 42.0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, scopes(test.claims))
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		scope    string
+		expected bool
+	}{
+		{name: "space delimited scope", claims: map[string]interface{}{"scope": "openid read:messages"}, scope: "read:messages", expected: true},
+		{name: "scope array", claims: map[string]interface{}{"scope": []string{"openid", "read:messages"}}, scope: "read:messages", expected: true},
+		{name: "permissions", claims: map[string]interface{}{"scope": "openid", "permissions": []string{"read:messages"}}, scope: "read:messages", expected: true},
+		{name: "prefix of a granted scope", claims: map[string]interface{}{"scope": "read:messages"}, scope: "read", expected: false},
+		{name: "no scope", claims: map[string]interface{}{}, scope: "read:messages", expected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := jwt.ParseSigned(getTestTokenWithClaims(test.claims, jose.HS256, defaultSecret))
+			assert.NoError(t, err)
+
+			granted, err := HasScope(token, defaultSecret, test.scope)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, granted)
+		})
+	}
+
+	token, err := jwt.ParseSigned(getTestTokenWithClaims(map[string]interface{}{"scope": "openid"}, jose.HS256, defaultSecret))
+	assert.NoError(t, err)
+	_, err = HasScope(token, []byte("another secret"), "openid")
+	assert.Error(t, err, "the claims should only be read with the verifying key")
+}
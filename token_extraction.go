@@ -52,17 +52,98 @@ func FromMultiple(extractors ...RequestTokenExtractor) RequestTokenExtractor {
 // if not present.
 // TODO: Implement parsing form data.
 func FromHeader(r *http.Request) (*jwt.JSONWebToken, error) {
+	return fromBearerHeader(r, "Authorization")
+}
+
+// FromProxyHeader looks for the request in the
+// Proxy-Authorization header, as sent through
+// some forward proxies.
+func FromProxyHeader(r *http.Request) (*jwt.JSONWebToken, error) {
+	return fromBearerHeader(r, "Proxy-Authorization")
+}
+
+// FromHeaderChain looks for a chain of tokens in the
+// authentication header, the tokens being separated
+// by spaces or commas after the Bearer scheme.
+// The tokens are returned in the order they were sent.
+// As with FromHeader, an encrypted token is reported
+// with an error matching ErrEncryptedToken.
+func FromHeaderChain(r *http.Request) ([]*jwt.JSONWebToken, error) {
+	parts, err := rawHeaderChain(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*jwt.JSONWebToken, 0, len(parts))
+	for _, part := range parts {
+		token, err := parseToken(part)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// rawHeaderChain returns the compact serialized tokens
+// of the chain sent in the authentication header.
+func rawHeaderChain(r *http.Request) ([]string, error) {
 	if r == nil {
 		return nil, ErrNilRequest
 	}
-	raw := ""
-	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[0:7], "BEARER ") {
-		raw = h[7:]
+	raw := bearerCredentials(r.Header.Get("Authorization"))
+	parts := strings.FieldsFunc(raw, func(c rune) bool {
+		return c == ' ' || c == ','
+	})
+	if len(parts) == 0 {
+		return nil, ErrTokenNotFound
 	}
+	return parts, nil
+}
+
+// RawFromHeader returns the compact serialized JWT passed
+// with the Bearer scheme in the authentication header.
+func RawFromHeader(r *http.Request) (string, error) {
+	return rawFromBearerHeader(r, "Authorization")
+}
+
+// RawFromBearer returns the compact serialized JWT of a value with
+// the Bearer scheme, e.g. the authorization metadata of a gRPC call.
+func RawFromBearer(value string) (string, error) {
+	raw := bearerCredentials(value)
 	if raw == "" {
-		return nil, ErrTokenNotFound
+		return "", ErrTokenNotFound
 	}
-	return jwt.ParseSigned(raw)
+	return raw, nil
+}
+
+// fromBearerHeader returns the JWT passed with the
+// Bearer scheme in the provided header.
+func fromBearerHeader(r *http.Request, name string) (*jwt.JSONWebToken, error) {
+	raw, err := rawFromBearerHeader(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseToken(raw)
+}
+
+func rawFromBearerHeader(r *http.Request, name string) (string, error) {
+	if r == nil {
+		return "", ErrNilRequest
+	}
+	return RawFromBearer(r.Header.Get(name))
+}
+
+// bearerCredentials returns the credentials of a header value with
+// the Bearer scheme, or an empty string for another scheme. The scheme
+// is matched case insensitively and the whitespaces surrounding the
+// credentials are tolerated, as sent by some clients and proxies.
+func bearerCredentials(h string) string {
+	h = strings.TrimSpace(h)
+	if len(h) < 7 || !strings.EqualFold(h[0:6], "BEARER") || (h[6] != ' ' && h[6] != '\t') {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
 }
 
 // FromParams returns the JWT when passed as the URL query param "token".
@@ -70,18 +151,75 @@ func FromParams(r *http.Request) (*jwt.JSONWebToken, error) {
 	if r == nil {
 		return nil, ErrNilRequest
 	}
-	raw := r.URL.Query().Get("token")
+	return fromQuery(r, "token")
+}
+
+// FromQuery returns an extractor reading the JWT from the query
+// parameter with the provided name, for clients such as EventSource
+// which cannot set headers.
+// Tokens passed in URLs end up in the access logs of servers and
+// proxies and in the browser history: prefer short-lived tokens.
+func FromQuery(name string) RequestTokenExtractor {
+	return RequestTokenExtractorFunc(func(r *http.Request) (*jwt.JSONWebToken, error) {
+		if r == nil {
+			return nil, ErrNilRequest
+		}
+		return fromQuery(r, name)
+	})
+}
+
+func fromQuery(r *http.Request, name string) (*jwt.JSONWebToken, error) {
+	raw := r.URL.Query().Get(name)
 	if raw == "" {
 		return nil, ErrTokenNotFound
 	}
-	return jwt.ParseSigned(raw)
+	return parseToken(raw)
+}
+
+// FromFormValue returns an extractor reading the JWT from the field with
+// the provided name of a form encoded body, e.g. "access_token" as
+// described in RFC 6750. The body is consumed by r.ParseForm, which
+// caches the fields in r.PostForm and r.Form: the next handlers must
+// read the form from there rather than from the body.
+// A body which cannot be parsed as a form holds no token, so that
+// FromMultiple goes on with the next extractors.
+func FromFormValue(name string) RequestTokenExtractor {
+	return RequestTokenExtractorFunc(func(r *http.Request) (*jwt.JSONWebToken, error) {
+		if r == nil {
+			return nil, ErrNilRequest
+		}
+		if err := r.ParseForm(); err != nil {
+			return nil, ErrTokenNotFound
+		}
+		raw := r.PostForm.Get(name)
+		if raw == "" {
+			return nil, ErrTokenNotFound
+		}
+		return parseToken(raw)
+	})
 }
 
 // FromCookie returns the JWT when passed in a Cookie as "access_token".
 func FromCookie(r *http.Request) (*jwt.JSONWebToken, error) {
-	raw, err := r.Cookie("access_token")
-	if err != nil {
+	return fromCookie(r, "access_token")
+}
+
+// FromNamedCookie returns an extractor reading the JWT from the cookie
+// with the provided name, e.g. an HttpOnly cookie set for browser clients.
+// It can be combined with FromHeader with FromMultiple.
+func FromNamedCookie(name string) RequestTokenExtractor {
+	return RequestTokenExtractorFunc(func(r *http.Request) (*jwt.JSONWebToken, error) {
+		return fromCookie(r, name)
+	})
+}
+
+func fromCookie(r *http.Request, name string) (*jwt.JSONWebToken, error) {
+	if r == nil {
+		return nil, ErrNilRequest
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
 		return nil, ErrTokenNotFound
 	}
-	return jwt.ParseSigned(raw.Value)
+	return parseToken(cookie.Value)
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -182,3 +184,188 @@ func TestFromParams(t *testing.T) {
 		})
 	}
 }
+
+func TestFromProxyHeader(t *testing.T) {
+	referenceToken := getTestToken(defaultAudience, defaultIssuer, time.Now(), jose.HS256, defaultSecret)
+
+	proxyTokenRequest := httptest.NewRequest("", "http://localhost", nil)
+	proxyTokenRequest.Header.Add("Proxy-Authorization", fmt.Sprintf("Bearer %s", referenceToken))
+
+	token, err := FromProxyHeader(proxyTokenRequest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	claims := jwt.Claims{}
+	err = token.Claims([]byte("secret"), &claims)
+	if err != nil {
+		t.Errorf("Claims should be decoded correctly with default token: %q \n", err)
+		t.FailNow()
+	}
+
+	if claims.Issuer != defaultIssuer || !reflect.DeepEqual(claims.Audience, jwt.Audience(defaultAudience)) {
+		t.Error("Invalid issuer, audience or subject:", claims.Issuer, claims.Audience)
+	}
+
+	if _, err := FromHeader(proxyTokenRequest); err != ErrTokenNotFound {
+		t.Errorf("FromHeader() should not read the Proxy-Authorization header, got: %v", err)
+	}
+
+	extractor := FromMultiple(RequestTokenExtractorFunc(FromHeader), RequestTokenExtractorFunc(FromProxyHeader))
+	if _, err := extractor.Extract(proxyTokenRequest); err != nil {
+		t.Errorf("The Proxy-Authorization header should be read when combined: %v", err)
+	}
+}
+
+func TestFromQuery(t *testing.T) {
+	referenceToken := getTestToken(defaultAudience, defaultIssuer, time.Now(), jose.HS256, defaultSecret)
+
+	req := httptest.NewRequest("", "http://localhost?sse_token="+referenceToken, nil)
+
+	token, err := FromQuery("sse_token").Extract(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	claims := jwt.Claims{}
+	err = token.Claims([]byte("secret"), &claims)
+	if err != nil {
+		t.Errorf("Claims should be decoded correctly with default token: %q \n", err)
+		t.FailNow()
+	}
+
+	if claims.Issuer != defaultIssuer || !reflect.DeepEqual(claims.Audience, jwt.Audience(defaultAudience)) {
+		t.Error("Invalid issuer, audience or subject:", claims.Issuer, claims.Audience)
+	}
+
+	if _, err := FromQuery("token").Extract(req); err != ErrTokenNotFound {
+		t.Errorf("FromQuery() should only read the named parameter, got: %v", err)
+	}
+
+	if _, err := FromQuery("sse_token").Extract(nil); err != ErrNilRequest {
+		t.Errorf("FromQuery() should reject a nil request, got: %v", err)
+	}
+}
+
+func TestFromNamedCookie(t *testing.T) {
+	referenceToken := getTestToken(defaultAudience, defaultIssuer, time.Now(), jose.HS256, defaultSecret)
+
+	req := httptest.NewRequest("", "http://localhost", nil)
+	req.AddCookie(&http.Cookie{Name: "session_jwt", Value: referenceToken})
+
+	token, err := FromNamedCookie("session_jwt").Extract(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	claims := jwt.Claims{}
+	if err := token.Claims([]byte("secret"), &claims); err != nil {
+		t.Errorf("Claims should be decoded correctly with default token: %q \n", err)
+		t.FailNow()
+	}
+	if claims.Issuer != defaultIssuer {
+		t.Error("Invalid issuer:", claims.Issuer)
+	}
+
+	if _, err := FromNamedCookie("access_token").Extract(req); err != ErrTokenNotFound {
+		t.Errorf("FromNamedCookie() should only read the named cookie, got: %v", err)
+	}
+
+	if _, err := FromNamedCookie("session_jwt").Extract(nil); err != ErrNilRequest {
+		t.Errorf("FromNamedCookie() should reject a nil request, got: %v", err)
+	}
+
+	malformed := httptest.NewRequest("", "http://localhost", nil)
+	malformed.AddCookie(&http.Cookie{Name: "session_jwt", Value: "malformed"})
+	if _, err := FromNamedCookie("session_jwt").Extract(malformed); err == nil || err == ErrTokenNotFound {
+		t.Errorf("FromNamedCookie() should fail to parse a malformed token, got: %v", err)
+	}
+
+	extractor := FromMultiple(RequestTokenExtractorFunc(FromHeader), FromNamedCookie("session_jwt"))
+	if _, err := extractor.Extract(req); err != nil {
+		t.Errorf("The cookie should be read when combined: %v", err)
+	}
+}
+
+func TestFromHeaderLenientBearer(t *testing.T) {
+	referenceToken := getTestToken(defaultAudience, defaultIssuer, time.Now(), jose.HS256, defaultSecret)
+
+	tests := []struct {
+		name    string
+		header  string
+		wantErr error
+	}{
+		{"lowercase scheme", "bearer " + referenceToken, nil},
+		{"uppercase scheme", "BEARER " + referenceToken, nil},
+		{"double space", "Bearer  " + referenceToken, nil},
+		{"tab separator", "Bearer\t" + referenceToken, nil},
+		{"surrounding whitespaces", "  Bearer " + referenceToken + "  ", nil},
+		{"no token", "Bearer   ", ErrTokenNotFound},
+		{"scheme only", "Bearer", ErrTokenNotFound},
+		{"scheme without separator", "Bearer" + referenceToken, ErrTokenNotFound},
+		{"other scheme", "Basic dXNlcjpwYXNz", ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("", "https://", nil)
+			req.Header.Set("Authorization", tt.header)
+			_, err := FromHeader(req)
+			if err != tt.wantErr {
+				t.Errorf("FromHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRawFromBearer(t *testing.T) {
+	if raw, err := RawFromBearer("bearer  a.b.c "); err != nil || raw != "a.b.c" {
+		t.Errorf("RawFromBearer() = %q, %v", raw, err)
+	}
+	if _, err := RawFromBearer("Basic dXNlcjpwYXNz"); err != ErrTokenNotFound {
+		t.Errorf("RawFromBearer() should reject another scheme, got: %v", err)
+	}
+}
+
+func TestFromFormValue(t *testing.T) {
+	referenceToken := getTestToken(defaultAudience, defaultIssuer, time.Now(), jose.HS256, defaultSecret)
+	form := url.Values{"access_token": {referenceToken}, "state": {"xyz"}}
+
+	req := httptest.NewRequest("POST", "http://localhost", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if _, err := FromFormValue("access_token").Extract(req); err != nil {
+		t.Error(err)
+		return
+	}
+	if state := req.PostForm.Get("state"); state != "xyz" {
+		t.Errorf("The other fields should be available to the next handlers, got: %q", state)
+	}
+
+	if _, err := FromFormValue("token").Extract(req); err != ErrTokenNotFound {
+		t.Errorf("FromFormValue() should only read the named field, got: %v", err)
+	}
+
+	query := httptest.NewRequest("GET", "http://localhost?access_token="+referenceToken, nil)
+	if _, err := FromFormValue("access_token").Extract(query); err != ErrTokenNotFound {
+		t.Errorf("FromFormValue() should not read the query, got: %v", err)
+	}
+
+	if _, err := FromFormValue("access_token").Extract(nil); err != ErrNilRequest {
+		t.Errorf("FromFormValue() should reject a nil request, got: %v", err)
+	}
+
+	// A malformed form does not abort the chain of extractors.
+	malformed := httptest.NewRequest("POST", "http://localhost", strings.NewReader("access_token=%zz"))
+	malformed.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	malformed.Header.Set("Authorization", "Bearer "+referenceToken)
+	if _, err := FromFormValue("access_token").Extract(malformed); err != ErrTokenNotFound {
+		t.Errorf("FromFormValue() should not find a token in a malformed form, got: %v", err)
+	}
+	extractor := FromMultiple(FromFormValue("access_token"), RequestTokenExtractorFunc(FromHeader))
+	if _, err := extractor.Extract(malformed); err != nil {
+		t.Errorf("FromMultiple() should fall back to the header, got: %v", err)
+	}
+}
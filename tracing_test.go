@@ -0,0 +1,99 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type spanContextKey struct{}
+
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	errors     []error
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *recordedSpan) RecordError(err error)                      { s.errors = append(s.errors, err) }
+func (s *recordedSpan) End()                                       { s.ended = true }
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &recordedSpan{name: name, attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func TestJWKClientTracer(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "a")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	tracer := &recordingTracer{}
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, Tracer: tracer}, nil)
+	_, err := client.GetKey("a")
+	assert.NoError(t, err)
+	_, err = client.GetKey("a")
+	assert.NoError(t, err)
+	_, err = client.GetKey("b")
+	assert.Equal(t, ErrNoKeyFound, err)
+
+	assert.Len(t, tracer.spans, 5)
+	miss, download, hit := tracer.spans[0], tracer.spans[1], tracer.spans[2]
+	assert.Equal(t, "auth0.GetKey", miss.name)
+	assert.Equal(t, map[string]interface{}{"jwks.uri": ts.URL, "jwks.kid": "a", "jwks.cache_hit": false}, miss.attributes)
+	assert.Equal(t, "auth0.DownloadKeys", download.name)
+	assert.Equal(t, "auth0.GetKey", download.parent)
+	assert.Equal(t, ts.URL, download.attributes["jwks.uri"])
+	assert.Equal(t, 1, download.attributes["jwks.keys"])
+	assert.Equal(t, true, hit.attributes["jwks.cache_hit"])
+	assert.Equal(t, []error{ErrNoKeyFound}, tracer.spans[3].errors)
+	for _, span := range tracer.spans {
+		assert.True(t, span.ended, span.name)
+	}
+}
+
+func TestConfigurationTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	configuration.Tracer = tracer
+
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	validator, req := genTestConfiguration(configuration, validToken)
+	_, err := validator.ValidateRequest(req)
+	assert.NoError(t, err)
+
+	expiredToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret)
+	validator, req = genTestConfiguration(configuration, expiredToken)
+	_, err = validator.ValidateRequest(req)
+	assert.Error(t, err)
+
+	assert.Len(t, tracer.spans, 2)
+	assert.Equal(t, "auth0.ValidateRequest", tracer.spans[0].name)
+	assert.Equal(t, map[string]interface{}{"auth0.outcome": "valid", "auth0.issuer": defaultIssuer}, tracer.spans[0].attributes)
+	assert.Equal(t, map[string]interface{}{"auth0.outcome": "invalid", "auth0.reason": jwt.ErrExpired.Error()}, tracer.spans[1].attributes)
+	assert.True(t, tracer.spans[1].ended)
+}
@@ -0,0 +1,84 @@
+package auth0
+
+import (
+	"container/list"
+	"time"
+)
+
+// DefaultMaxUnknownKeys is the default number of unknown kids
+// remembered when UnknownKeyTTL is set without MaxUnknownKeys.
+const DefaultMaxUnknownKeys = 1000
+
+// unknownKeyCache remembers the kids missing from the downloaded keys,
+// so that tokens with unknown kids do not trigger a download each.
+// It is bounded, the least recently used kids being evicted first,
+// so that a flood of random kids cannot exhaust the memory.
+// It is not safe for concurrent use.
+type unknownKeyCache struct {
+	ttl     time.Duration
+	maxSize int
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type unknownKeyEntry struct {
+	keyID   string
+	addedAt time.Time
+}
+
+func newUnknownKeyCache(ttl time.Duration, maxSize int) *unknownKeyCache {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxUnknownKeys
+	}
+	return &unknownKeyCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+// contains reports whether the kid is known to be missing.
+// Expired kids are forgotten.
+func (c *unknownKeyCache) contains(keyID string) bool {
+	element, ok := c.entries[keyID]
+	if !ok {
+		return false
+	}
+	if c.now().Sub(element.Value.(unknownKeyEntry).addedAt) >= c.ttl {
+		c.remove(element)
+		return false
+	}
+	c.order.MoveToFront(element)
+	return true
+}
+
+// add remembers the kid as missing, evicting the least
+// recently used kids beyond the max size.
+func (c *unknownKeyCache) add(keyID string) {
+	if element, ok := c.entries[keyID]; ok {
+		c.remove(element)
+	}
+	c.entries[keyID] = c.order.PushFront(unknownKeyEntry{keyID: keyID, addedAt: c.now()})
+	for c.order.Len() > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget forgets the kid, e.g. once it is found in refreshed keys.
+func (c *unknownKeyCache) forget(keyID string) {
+	if element, ok := c.entries[keyID]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *unknownKeyCache) len() int {
+	return c.order.Len()
+}
+
+func (c *unknownKeyCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(unknownKeyEntry).keyID)
+}
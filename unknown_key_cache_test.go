@@ -0,0 +1,38 @@
+package auth0
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownKeyCache(t *testing.T) {
+	now := time.Now()
+	c := newUnknownKeyCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	c.add("kid1")
+	c.add("kid2")
+	assert.True(t, c.contains("kid1"), "kid1 is now the most recently used")
+
+	c.add("kid3")
+	assert.Equal(t, 2, c.len())
+	assert.True(t, c.contains("kid1"))
+	assert.False(t, c.contains("kid2"), "the least recently used kid should be evicted")
+	assert.True(t, c.contains("kid3"))
+
+	now = now.Add(time.Minute)
+	assert.False(t, c.contains("kid1"), "expired kids should be forgotten")
+	assert.Equal(t, 1, c.len())
+
+	c.forget("kid3")
+	c.forget("kid4")
+	assert.Equal(t, 0, c.len())
+	assert.False(t, c.contains("kid3"))
+}
+
+func TestUnknownKeyCacheDefaultMaxSize(t *testing.T) {
+	c := newUnknownKeyCache(time.Minute, 0)
+	assert.Equal(t, DefaultMaxUnknownKeys, c.maxSize)
+}
@@ -0,0 +1,78 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrTokenMalformed is matched by the errors of the
+	// tokens which could not be parsed.
+	ErrTokenMalformed = errors.New("token is malformed")
+	// ErrTokenExpired is matched by the errors of the expired tokens,
+	// which the client can replace with a fresh one.
+	ErrTokenExpired = errors.New("token is expired")
+	// ErrInvalidSignature is matched by the errors of the
+	// tokens whose signature does not verify with their key.
+	ErrInvalidSignature = errors.New("token signature is invalid")
+	// ErrKeyFetchFailed is matched by the errors of the validations
+	// which failed to download the signing keys, a server side failure.
+	ErrKeyFetchFailed = errors.New("signing keys could not be fetched")
+)
+
+// ValidationError is returned by the failed validations of a kind known
+// to the library: it matches its kind, e.g. ErrTokenExpired, with
+// errors.Is and unwraps to its cause, whose message it keeps.
+type ValidationError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the failure.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is the kind of the failure.
+func (e *ValidationError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyError wraps the error of the failed step in a
+// ValidationError of its kind, the other errors being left as is.
+func classifyError(step ValidationStep, err error) error {
+	var kind error
+	switch {
+	case step == StepParse:
+		kind = ErrTokenMalformed
+	case step == StepSignature:
+		kind = ErrInvalidSignature
+	case errors.Is(err, jwt.ErrExpired):
+		kind = ErrTokenExpired
+	case step == StepKeyResolution && isFetchFailure(err):
+		kind = ErrKeyFetchFailed
+	default:
+		return err
+	}
+	return &ValidationError{Kind: kind, Err: err}
+}
+
+// isFetchFailure reports whether the error is a failed download of the keys.
+func isFetchFailure(err error) bool {
+	var retryErr *RetryError
+	var urlErr *url.Error
+	return errors.Is(err, ErrJWKSStatus) ||
+		errors.Is(err, ErrInvalidContentType) ||
+		errors.Is(err, ErrInsecureJWKSURI) ||
+		errors.Is(err, ErrEmptyJWKS) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &retryErr) ||
+		errors.As(err, &urlErr)
+}
@@ -0,0 +1,87 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestValidationErrorKinds(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	unreachable := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	key := genRSASSAJWK(jose.RS256, "key")
+
+	tests := []struct {
+		name          string
+		provider      SecretProvider
+		raw           string
+		expectedKind  error
+		expectedCause error
+	}{
+		{
+			name:         "malformed token",
+			provider:     defaultSecretProvider,
+			raw:          "not a token",
+			expectedKind: ErrTokenMalformed,
+		},
+		{
+			name:          "expired token",
+			provider:      defaultSecretProvider,
+			raw:           getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret),
+			expectedKind:  ErrTokenExpired,
+			expectedCause: jwt.ErrExpired,
+		},
+		{
+			name:          "invalid signature",
+			provider:      NewKeyProvider([]byte("another secret")),
+			raw:           getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret),
+			expectedKind:  ErrInvalidSignature,
+			expectedCause: jose.ErrCryptoFailure,
+		},
+		{
+			name:          "keys not fetched",
+			provider:      unreachable,
+			raw:           getTestTokenWithClaims(jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience}, jose.RS256, key),
+			expectedKind:  ErrKeyFetchFailed,
+			expectedCause: ErrJWKSStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := NewValidator(NewConfigurationTrustProvider(test.provider, defaultAudience, defaultIssuer), nil)
+			_, err := validator.ValidateRawToken(context.Background(), test.raw)
+
+			var validationErr *ValidationError
+			if !assert.True(t, errors.As(err, &validationErr), "got %v", err) {
+				return
+			}
+			assert.True(t, errors.Is(err, test.expectedKind))
+			assert.Equal(t, validationErr.Err.Error(), err.Error(), "the message of the cause should be kept")
+			if test.expectedCause != nil {
+				assert.True(t, errors.Is(err, test.expectedCause))
+			}
+		})
+	}
+}
+
+func TestValidationErrorUnclassified(t *testing.T) {
+	validator := NewValidator(NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256), nil)
+	raw := getTestToken(defaultAudience, "https://other.example.com/", time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+
+	_, err := validator.ValidateRawToken(context.Background(), raw)
+	assert.Equal(t, jwt.ErrInvalidIssuer, err)
+
+	_, err = validator.ValidateRawToken(context.Background(), "")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
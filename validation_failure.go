@@ -0,0 +1,110 @@
+package auth0
+
+import (
+	"errors"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ValidationStep names the step of the validation which failed.
+type ValidationStep string
+
+const (
+	StepExtraction    ValidationStep = "extraction"
+	StepParse         ValidationStep = "parse"
+	StepDecryption    ValidationStep = "decryption"
+	StepHeader        ValidationStep = "header"
+	StepKeyResolution ValidationStep = "key-resolution"
+	StepSignature     ValidationStep = "signature"
+	StepClaims        ValidationStep = "claims"
+)
+
+// ValidationFailure describes a failed validation for logging.
+// The reason is chosen among the messages of the errors known to the
+// library, so that neither the token nor any secret can be logged.
+type ValidationFailure struct {
+	Step   ValidationStep
+	Reason string
+}
+
+// FailureHook is called with the failure of each failed validation.
+type FailureHook func(failure ValidationFailure)
+
+// sanitizedErrors are the errors whose messages hold
+// no material of the token and can be reported as is.
+var sanitizedErrors = []error{
+	ErrTokenNotFound,
+	ErrNilRequest,
+	ErrNoJWTHeaders,
+	ErrUnexpectedKeyID,
+	ErrUnsupportedCriticalHeader,
+	ErrInvertedValidityWindow,
+	ErrInvalidAuthorizedParty,
+	ErrEncryptedToken,
+	ErrUnknownIssuer,
+	ErrInvalidAlgorithm,
+	ErrNoKeyFound,
+	ErrKeyExpired,
+	ErrInvalidContentType,
+	ErrJWKSStatus,
+	ErrInsecureJWKSURI,
+	ErrEmptyJWKS,
+	ErrOfflineKeyMissing,
+	ErrAmbiguousKeyID,
+	ErrCertificateMismatch,
+	ErrUntrustedCertificate,
+	jose.ErrCryptoFailure,
+	jwt.ErrUnmarshalAudience,
+	jwt.ErrUnmarshalNumericDate,
+	jwt.ErrInvalidClaims,
+	jwt.ErrInvalidIssuer,
+	jwt.ErrInvalidSubject,
+	jwt.ErrInvalidAudience,
+	jwt.ErrInvalidID,
+	jwt.ErrNotValidYet,
+	jwt.ErrExpired,
+}
+
+// reportFailure calls the failure hook and the logger, if any, with a
+// sanitized reason: the message of a known error, or the failed step
+// otherwise, as the messages of the other errors may quote the token.
+func (c Configuration) reportFailure(step ValidationStep, err error) {
+	if c.FailureHook == nil && c.Logger == nil {
+		return
+	}
+
+	reason, ok := sanitizedReason(err)
+	if !ok {
+		reason = "validation failed at the " + string(step) + " step"
+	}
+	if c.Logger != nil {
+		if step == StepKeyResolution && isFetchFailure(err) {
+			c.Logger.Warnf("token validation failed at the %s step: %s", step, reason)
+		} else {
+			c.Logger.Debugf("token validation failed at the %s step: %s", step, reason)
+		}
+	}
+	if c.FailureHook != nil {
+		c.FailureHook(ValidationFailure{Step: step, Reason: reason})
+	}
+}
+
+// sanitizedReason returns the message of the known error matching the
+// error, if any, as it holds no material of the token.
+func sanitizedReason(err error) (string, bool) {
+	for _, known := range sanitizedErrors {
+		if errors.Is(err, known) {
+			return known.Error(), true
+		}
+	}
+	return "", false
+}
+
+// extractionStep returns the step at which the extraction of a token failed.
+func extractionStep(err error) ValidationStep {
+	if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrNilRequest) {
+		return StepExtraction
+	}
+	return StepParse
+}
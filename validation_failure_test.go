@@ -0,0 +1,94 @@
+package auth0
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestFailureHook(t *testing.T) {
+	validToken := getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, defaultSecret)
+	parts := strings.Split(validToken, ".")
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStep   ValidationStep
+		expectedReason string
+	}{
+		{
+			name:           "missing token",
+			expectedStep:   StepExtraction,
+			expectedReason: ErrTokenNotFound.Error(),
+		},
+		{
+			name:           "malformed token",
+			token:          "not.a.token",
+			expectedStep:   StepParse,
+			expectedReason: "validation failed at the parse step",
+		},
+		{
+			name:           "forged signature",
+			token:          getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS256, []byte("another secret")),
+			expectedStep:   StepSignature,
+			expectedReason: jose.ErrCryptoFailure.Error(),
+		},
+		{
+			name:           "signature of another token",
+			token:          parts[0] + "." + parts[1] + "." + strings.Split(getTestToken(defaultAudience, "another issuer", time.Now().Add(time.Hour), jose.HS256, defaultSecret), ".")[2],
+			expectedStep:   StepSignature,
+			expectedReason: jose.ErrCryptoFailure.Error(),
+		},
+		{
+			name:           "expired token",
+			token:          getTestToken(defaultAudience, defaultIssuer, time.Now().Add(-time.Hour), jose.HS256, defaultSecret),
+			expectedStep:   StepClaims,
+			expectedReason: jwt.ErrExpired.Error(),
+		},
+		{
+			name:           "unexpected algorithm",
+			token:          getTestToken(defaultAudience, defaultIssuer, time.Now().Add(time.Hour), jose.HS384, defaultSecret),
+			expectedStep:   StepHeader,
+			expectedReason: ErrInvalidAlgorithm.Error(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var failures []ValidationFailure
+			configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+			configuration.FailureHook = func(failure ValidationFailure) {
+				failures = append(failures, failure)
+			}
+
+			validator := NewValidator(configuration, nil)
+			req, _ := http.NewRequest("", "http://localhost", nil)
+			if test.token != "" {
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", test.token))
+			}
+
+			_, err := validator.ValidateRequest(req)
+			assert.Error(t, err)
+			assert.Equal(t, []ValidationFailure{{Step: test.expectedStep, Reason: test.expectedReason}}, failures)
+			for _, part := range strings.Split(test.token, ".") {
+				if len(part) > 8 {
+					assert.NotContains(t, fmt.Sprintf("%+v", failures), part, "no token material should be reported")
+				}
+			}
+		})
+	}
+
+	var called bool
+	configuration := NewConfiguration(defaultSecretProvider, defaultAudience, defaultIssuer, jose.HS256)
+	configuration.FailureHook = func(ValidationFailure) { called = true }
+	validator, req := genTestConfiguration(configuration, validToken)
+	_, err := validator.ValidateRequest(req)
+	assert.NoError(t, err)
+	assert.False(t, called, "the hook should only be called on failures")
+}
@@ -0,0 +1,95 @@
+package auth0
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ValidatorRegistry routes the validation of the tokens to the
+// validator registered for their issuer, each validator being fully
+// configured for its issuer.
+type ValidatorRegistry struct {
+	mu         sync.RWMutex
+	validators map[string]*JWTValidator
+	extractor  RequestTokenExtractor
+}
+
+// NewValidatorRegistry creates a new ValidatorRegistry reading
+// the tokens with the extractor, the authentication header
+// being read when nil.
+func NewValidatorRegistry(extractor RequestTokenExtractor) *ValidatorRegistry {
+	if extractor == nil {
+		extractor = RequestTokenExtractorFunc(FromHeader)
+	}
+	return &ValidatorRegistry{
+		validators: map[string]*JWTValidator{},
+		extractor:  extractor,
+	}
+}
+
+// Register sets the validator of the tokens of the issuer.
+func (vr *ValidatorRegistry) Register(issuer string, validator *JWTValidator) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	vr.validators[issuer] = validator
+}
+
+// Validate validates the token within the http request with the
+// validator of its issuer. The iss claim is read before the signature
+// is verified, the selected validator then verifying the token fully
+// like ValidateRequest, within the context of the request. An encrypted
+// token is decrypted with the key of the validator of its issuer.
+// Tokens without issuer or of an unregistered one are rejected with
+// ErrUnknownIssuer.
+func (vr *ValidatorRegistry) Validate(r *http.Request) (*jwt.JSONWebToken, error) {
+	token, err := vr.extractor.Extract(r)
+	var encrypted *encryptedToken
+	if errors.As(err, &encrypted) {
+		return vr.validateEncrypted(r, encrypted.raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.Claims{}
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, err
+	}
+
+	vr.mu.RLock()
+	validator, ok := vr.validators[claims.Issuer]
+	vr.mu.RUnlock()
+	if !ok || claims.Issuer == "" {
+		return nil, ErrUnknownIssuer
+	}
+	return validator.validateExtracted(r, token)
+}
+
+// validateEncrypted validates the encrypted token with the validator
+// whose decryption key decrypts a token of its own issuer.
+func (vr *ValidatorRegistry) validateEncrypted(r *http.Request, raw string) (*jwt.JSONWebToken, error) {
+	vr.mu.RLock()
+	decrypting := map[string]*JWTValidator{}
+	for issuer, validator := range vr.validators {
+		if issuer != "" && validator.config.DecryptionKey != nil {
+			decrypting[issuer] = validator
+		}
+	}
+	vr.mu.RUnlock()
+
+	for issuer, validator := range decrypting {
+		token, err := validator.config.decrypt(raw)
+		if err != nil {
+			continue
+		}
+		claims := jwt.Claims{}
+		if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil || claims.Issuer != issuer {
+			continue
+		}
+		return validator.validateExtracted(r, token)
+	}
+	return nil, ErrUnknownIssuer
+}
@@ -0,0 +1,103 @@
+package auth0
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestValidatorRegistry(t *testing.T) {
+	keyA := genRSASSAJWK(jose.RS256, "keyA")
+	keyB := genECDSAJWK(jose.ES384, "keyB")
+
+	registry := NewValidatorRegistry(nil)
+	registry.Register("https://a.example.com/", NewValidator(NewConfiguration(NewKeyProvider(keyA.Public()), defaultAudience, "https://a.example.com/", jose.RS256), nil))
+	registry.Register("https://b.example.com/", NewValidator(NewConfiguration(NewKeyProvider(keyB.Public()), defaultAudience, "https://b.example.com/", jose.ES384), nil))
+
+	tests := []struct {
+		name          string
+		issuer        string
+		alg           jose.SignatureAlgorithm
+		key           jose.JSONWebKey
+		expectedError error
+	}{
+		{name: "first issuer", issuer: "https://a.example.com/", alg: jose.RS256, key: keyA},
+		{name: "second issuer", issuer: "https://b.example.com/", alg: jose.ES384, key: keyB},
+		{name: "unknown issuer", issuer: "https://c.example.com/", alg: jose.RS256, key: keyA, expectedError: ErrUnknownIssuer},
+		{name: "absent issuer", alg: jose.RS256, key: keyA, expectedError: ErrUnknownIssuer},
+		{name: "issuer with the algorithm of another", issuer: "https://b.example.com/", alg: jose.RS256, key: keyA, expectedError: ErrInvalidAlgorithm},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := getTestTokenWithClaims(jwt.Claims{
+				Issuer:   test.issuer,
+				Audience: defaultAudience,
+				Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			}, test.alg, test.key)
+
+			_, req := genTestConfiguration(Configuration{}, raw)
+			token, err := registry.Validate(req)
+			assert.Equal(t, test.expectedError, err)
+			assert.Equal(t, test.expectedError == nil, token != nil)
+		})
+	}
+}
+
+func TestValidatorRegistryRequest(t *testing.T) {
+	key := genRSASSAJWK(jose.RS256, "key")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{key.Public()}})
+	}))
+	defer ts.Close()
+
+	// A JWKClientSet resolves the keys from the request only.
+	set := NewJWKClientSet(func(r *http.Request) (string, error) {
+		return ts.URL, nil
+	}, JWKClientOptions{AllowInsecureJWKS: true})
+	registry := NewValidatorRegistry(nil)
+	registry.Register(defaultIssuer, NewValidator(NewConfiguration(set, defaultAudience, defaultIssuer, jose.RS256), nil))
+
+	raw := getTestTokenWithClaims(jwt.Claims{
+		Issuer:   defaultIssuer,
+		Audience: defaultAudience,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, jose.RS256, key)
+	_, req := genTestConfiguration(Configuration{}, raw)
+	_, err := registry.Validate(req)
+	assert.NoError(t, err)
+}
+
+func TestValidatorRegistryEncryptedToken(t *testing.T) {
+	decryptionKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	validator := func(issuer string, key *rsa.PrivateKey) *JWTValidator {
+		configuration := NewConfiguration(defaultSecretProvider, defaultAudience, issuer, jose.HS256)
+		configuration.DecryptionKey = key
+		return NewValidator(configuration, nil)
+	}
+
+	registry := NewValidatorRegistry(nil)
+	registry.Register("https://other.example.com/", validator("https://other.example.com/", otherKey))
+	registry.Register(defaultIssuer, validator(defaultIssuer, decryptionKey))
+
+	claims := jwt.Claims{Issuer: defaultIssuer, Audience: defaultAudience, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	_, req := genTestConfiguration(Configuration{}, getTestEncryptedToken(claims, &decryptionKey.PublicKey, jose.RSA_OAEP, "JWT"))
+	token, err := registry.Validate(req)
+	assert.NoError(t, err)
+	assert.NotNil(t, token)
+
+	// The token of an issuer must be decrypted with the key of its validator.
+	_, req = genTestConfiguration(Configuration{}, getTestEncryptedToken(claims, &otherKey.PublicKey, jose.RSA_OAEP, "JWT"))
+	_, err = registry.Validate(req)
+	assert.Equal(t, ErrUnknownIssuer, err)
+}
@@ -0,0 +1,77 @@
+package auth0
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	// ErrCertificateMismatch is returned with VerifyX5C when the leaf
+	// certificate of the x5c chain of a key does not hold the key, or
+	// does not match the x5t or x5t#S256 thumbprint of the token.
+	ErrCertificateMismatch = errors.New("certificate of the key does not match the key or the token thumbprint")
+	// ErrUntrustedCertificate is returned with VerifyX5C when the
+	// x5c chain of a key does not chain up to the X5CRoots.
+	ErrUntrustedCertificate = errors.New("certificate chain of the key is not trusted")
+)
+
+// verifyCertificates checks the x5c certificate chain of the key, if any:
+// its leaf must hold the key and match the x5t and x5t#S256 thumbprints
+// of the token header when present, and the chain must chain up to the
+// roots when set. A key without chain is not checked.
+func verifyCertificates(key jose.JSONWebKey, header jose.Header, roots *x509.CertPool) error {
+	if len(key.Certificates) == 0 {
+		return nil
+	}
+	leaf := key.Certificates[0]
+
+	leafKey, err := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+	if err != nil {
+		return ErrCertificateMismatch
+	}
+	jwkKey, err := x509.MarshalPKIXPublicKey(key.Key)
+	if err != nil || !bytes.Equal(leafKey, jwkKey) {
+		return ErrCertificateMismatch
+	}
+
+	sha1Sum := sha1.Sum(leaf.Raw)
+	sha256Sum := sha256.Sum256(leaf.Raw)
+	thumbprints := map[jose.HeaderKey][]byte{
+		"x5t":      sha1Sum[:],
+		"x5t#S256": sha256Sum[:],
+	}
+	for name, sum := range thumbprints {
+		value, ok := header.ExtraHeaders[name]
+		if !ok {
+			continue
+		}
+		thumbprint, _ := value.(string)
+		if thumbprint != base64.RawURLEncoding.EncodeToString(sum) {
+			return ErrCertificateMismatch
+		}
+	}
+
+	if roots == nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range key.Certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedCertificate, err)
+	}
+	return nil
+}
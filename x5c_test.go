@@ -0,0 +1,130 @@
+package auth0
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// genCertificate issues a certificate of the public key, signed by the
+// parent certificate and key, or self-signed when the parent is nil.
+func genCertificate(publicKey interface{}, parent *x509.Certificate, parentKey *rsa.PrivateKey, isCA bool) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func getTestTokenWithHeaders(key jose.JSONWebKey, headers map[jose.HeaderKey]interface{}) *jwt.JSONWebToken {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, &jose.SignerOptions{ExtraHeaders: headers})
+	if err != nil {
+		panic(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(jwt.Claims{Issuer: defaultIssuer}).CompactSerialize()
+	if err != nil {
+		panic(err)
+	}
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func TestJWKClientVerifyX5C(t *testing.T) {
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ca := genCertificate(&caKey.PublicKey, nil, caKey, true)
+	otherCAKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherCA := genCertificate(&otherCAKey.PublicKey, nil, otherCAKey, true)
+
+	keyA := genRSASSAJWK(jose.RS256, "a")
+	leafA := genCertificate(keyA.Public().Key, ca, caKey, false)
+	keyB := genRSASSAJWK(jose.RS256, "b")
+	keyC := genRSASSAJWK(jose.RS256, "c")
+
+	publicA := keyA.Public()
+	publicA.Certificates = []*x509.Certificate{leafA}
+	// The chain of b holds the key of a.
+	publicB := keyB.Public()
+	publicB.Certificates = []*x509.Certificate{leafA}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []jose.JSONWebKey{publicA, publicB, keyC.Public()}})
+	}))
+	defer ts.Close()
+
+	sha1Sum := sha1.Sum(leafA.Raw)
+	sha256Sum := sha256.Sum256(leafA.Raw)
+	x5t := base64.RawURLEncoding.EncodeToString(sha1Sum[:])
+	x5tS256 := base64.RawURLEncoding.EncodeToString(sha256Sum[:])
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+
+	tests := []struct {
+		name     string
+		key      jose.JSONWebKey
+		headers  map[jose.HeaderKey]interface{}
+		roots    *x509.CertPool
+		expected error
+	}{
+		{name: "without thumbprint", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a"}},
+		{name: "matching thumbprints", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a", "x5t": x5t, "x5t#S256": x5tS256}},
+		{name: "mismatching x5t", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a", "x5t": x5tS256}, expected: ErrCertificateMismatch},
+		{name: "mismatching x5t#S256", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a", "x5t#S256": x5t}, expected: ErrCertificateMismatch},
+		{name: "certificate of another key", key: keyB, headers: map[jose.HeaderKey]interface{}{"kid": "b"}, expected: ErrCertificateMismatch},
+		{name: "without chain", key: keyC, headers: map[jose.HeaderKey]interface{}{"kid": "c", "x5t": x5t}},
+		{name: "trusted chain", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a"}, roots: roots},
+		{name: "untrusted chain", key: keyA, headers: map[jose.HeaderKey]interface{}{"kid": "a"}, roots: otherRoots, expected: ErrUntrustedCertificate},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true, VerifyX5C: true, X5CRoots: test.roots}, nil)
+			_, err := client.GetSecret(getTestTokenWithHeaders(test.key, test.headers))
+			if test.expected == nil {
+				assert.NoError(t, err)
+			} else {
+				assertErrorIs(t, test.expected, err)
+			}
+		})
+	}
+
+	// The chains are not checked by default.
+	client := NewJWKClient(JWKClientOptions{URI: ts.URL, AllowInsecureJWKS: true}, nil)
+	_, err := client.GetSecret(getTestTokenWithHeaders(keyB, map[jose.HeaderKey]interface{}{"kid": "b"}))
+	assert.NoError(t, err)
+}